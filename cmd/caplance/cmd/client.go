@@ -1,9 +1,14 @@
 package cmd
 
 import (
+	"crypto/tls"
 	"net"
+	"strconv"
+	"time"
 
 	"github.com/pwpon500/caplance/internal/client"
+	"github.com/pwpon500/caplance/pkg/protocol"
+	"github.com/pwpon500/caplance/pkg/util"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -19,10 +24,7 @@ var clientCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Infoln("Reading in config file")
 		readConfig()
-		vip := net.ParseIP(conf.VIP)
-		if vip == nil {
-			log.Fatalln("Could not parse vip: " + conf.VIP)
-		}
+		vips := parseVIPs()
 		dataIP := net.ParseIP(conf.Client.DataIP)
 		if dataIP == nil {
 			log.Fatalln("Could not parse data ip: " + conf.Client.DataIP)
@@ -30,18 +32,97 @@ var clientCmd = &cobra.Command{
 		if conf.Client.Name == "" {
 			log.Fatalln("Please provide a client name")
 		}
-		c := client.NewClient(conf.Client.Name, vip, dataIP, conf.ReadTimeout, conf.WriteTimeout, conf.HealthRate, conf.Sockaddr)
-		connectIP := net.ParseIP(conf.Client.ConnectIP)
-		if connectIP == nil {
-			connectIP = net.ParseIP(conf.Server.MngIP)
-			if connectIP == nil {
-				log.Fatalf("Could not parse Client.ConnectIP (%v) or Server.MngIP (%v)\n", conf.Client.ConnectIP, conf.Server.MngIP)
-			}
+		if conf.Client.Weight < 1 {
+			log.Fatalln("Client weight " + strconv.Itoa(conf.Client.Weight) + " must be positive")
+		}
+		if conf.Client.ProtocolVersion < protocol.V1 || conf.Client.ProtocolVersion > protocol.Latest {
+			log.Fatalln("Unknown protocol version: " + strconv.Itoa(conf.Client.ProtocolVersion))
 		}
+		switch conf.Client.Encap {
+		case client.EncapUDP, client.EncapFOU, client.EncapGUE, client.EncapIPIP, client.EncapGRE:
+		default:
+			log.Fatalln("Unknown encapsulation: " + conf.Client.Encap)
+		}
+		c := client.NewClient(client.Config{
+			Name:         conf.Client.Name,
+			VIPs:         vips,
+			DataIP:       dataIP,
+			ReadTimeout:  conf.ReadTimeout,
+			WriteTimeout: conf.WriteTimeout,
+			HealthRate:   conf.HealthRate,
+			Sockaddr:     conf.Client.Sockaddr,
+			Encap:        conf.Client.Encap,
+			EncapPort:    conf.Client.EncapPort,
+			Weight:       conf.Client.Weight,
+			Service:      conf.Client.Service,
+			Health:       parseProbes(),
+			TLS:          parseClientTLS(),
+			Labels:       conf.Client.Labels,
+			Protocol:     conf.Client.ProtocolVersion,
+			Batch:        parseBatch(),
+		})
 		log.Infoln("Starting client")
-		err := c.Start(connectIP)
+		err := c.Start(parseConnectIPs())
 		if err != nil {
 			log.Fatalln("Failed to start with error: " + err.Error())
 		}
 	},
 }
+
+// parseProbes builds the client's health config from its probe config
+func parseProbes() client.HealthConfig {
+	health := client.HealthConfig{Fall: conf.Client.ProbeFall, Rise: conf.Client.ProbeRise}
+	for _, raw := range conf.Client.Probes {
+		switch raw.Type {
+		case client.ProbeHTTP, client.ProbeTCP, client.ProbeExec:
+		default:
+			log.Fatalln("Unknown probe type: " + raw.Type)
+		}
+		if raw.Target == "" {
+			log.Fatalln("Please provide a target for the " + raw.Type + " probe")
+		}
+		timeout := raw.Timeout
+		if timeout == 0 {
+			timeout = 2
+		}
+		health.Probes = append(health.Probes, &client.Probe{
+			Type:    raw.Type,
+			Target:  raw.Target,
+			Timeout: time.Duration(timeout) * time.Second,
+		})
+	}
+	return health
+}
+
+// parseClientTLS loads the tls config for the connections to the balancers. The client connects
+// in plaintext unless tls is enabled
+func parseClientTLS() *tls.Config {
+	raw := conf.Client.TLS
+	if !raw.Enabled {
+		return nil
+	}
+	tlsConf, err := util.ClientTLSConfig(raw.CA, raw.Cert, raw.Key, raw.ServerName)
+	if err != nil {
+		log.Fatalln("Failed to load tls config: " + err.Error())
+	}
+	return tlsConf
+}
+
+// parseConnectIPs returns the balancers to register with. Client.ConnectIPs lists every balancer
+// of an active/standby pair or behind ecmp, and Client.ConnectIP and Server.MngIP are used if it
+// is empty
+func parseConnectIPs() []net.IP {
+	raw := conf.Client.ConnectIPs
+	if len(raw) == 0 {
+		raw = []string{conf.Client.ConnectIP}
+		if conf.Client.ConnectIP == "" {
+			raw = []string{conf.Server.MngIP}
+		}
+	}
+
+	ips, err := util.ParseIPs(raw)
+	if err != nil {
+		log.Fatalln("Could not parse balancer ips: " + err.Error())
+	}
+	return ips
+}
@@ -3,30 +3,138 @@ package cmd
 import (
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+
+	"github.com/pwpon500/caplance/pkg/protocol"
+	"github.com/pwpon500/caplance/pkg/util"
 )
 
+type healthCheckConfig struct {
+	Type     string
+	Port     int
+	Path     string
+	Status   int
+	Send     string
+	Expect   string
+	Interval int
+	Timeout  int
+	Rise     int
+	Fall     int
+}
+
+type serviceConfig struct {
+	Name            string
+	VIPs            []string
+	Ports           []string
+	BackendCapacity int
+	Weights         map[string]int
+	HashPolicy      string
+	SymmetricHash   bool
+	HealthCheck     healthCheckConfig
+	StatusRise      int
+	StatusFall      int
+}
+
 type config struct {
 	Client struct {
-		ConnectIP string
-		DataIP    string
-		Name      string
+		ConnectIP  string
+		ConnectIPs []string
+		DataIP     string
+		Name       string
+		Encap      string
+		EncapPort  int
+		Weight     int
+		Service    string
+		Probes     []struct {
+			Type    string
+			Target  string
+			Timeout int
+		}
+		ProbeFall       int
+		ProbeRise       int
+		Labels          map[string]string
+		ProtocolVersion int
+		Sockaddr        string // unix socket caplancectl controls the client over
+		TLS             struct {
+			Enabled    bool
+			CA         string
+			Cert       string
+			Key        string
+			ServerName string
+		}
 	}
 	Server struct {
 		MngIP           string
+		MetricsAddr     string
+		Sockaddr        string // unix socket caplancectl controls the balancer over
+		DrainTimeout    int
 		BackendCapacity int
+		Ports           []string
+		Weights         map[string]int
+		HashPolicy      string
+		SymmetricHash   bool
+		HealthCheck     healthCheckConfig
+		StatusRise      int
+		StatusFall      int
+		ConnTrack       struct {
+			MaxEntries     int
+			TCPTimeout     int
+			UDPTimeout     int
+			ClosingTimeout int
+		}
+		Services []serviceConfig
+		ECMP     bool
+		TLS      struct {
+			Cert     string
+			Key      string
+			ClientCA string // backends need a certificate signed by it if set
+		}
+		PacketSource struct {
+			Type       string
+			Queues     int
+			Interfaces []string
+			Fanout     int
+			BlockSize  int
+			Blocks     int
+		}
+		// XDP forwards flows in the kernel ahead of the packet source. It only speeds up
+		// backends decapsulating in the kernel, over fou, gue, ipip or gre. udp backends, the
+		// default, authenticate their packets and are still served through the packet source.
+		// Turns connection tracking off, and with it draining
+		XDP struct {
+			Enabled    bool
+			Interfaces []string
+			Generic    bool
+		}
+		HA struct {
+			Peer         string
+			Port         int
+			Priority     int
+			Interval     int
+			DeadInterval int
+			Key          string // shared by the pair to sign their messages with
+		}
 	}
 	VIP  string
+	VIPs []string
 	Test bool
 
 	HealthRate   int
 	ReadTimeout  int
 	WriteTimeout int
 
-	Sockaddr string
+	// packets per sendmmsg/recvmmsg on the data path, and how many microseconds a packet waits
+	// for its batch to fill up. Off by default, as that wait only pays off for flows fast enough
+	// to fill batches before the flush and adds latency to the rest
+	Batch struct {
+		Size          int
+		FlushInterval int
+	}
 }
 
 var (
@@ -52,7 +160,30 @@ func init() {
 	viper.SetDefault("RegisterTimeout", 10)
 	viper.SetDefault("ReadTimeout", 30)
 	viper.SetDefault("WriteTimeout", 10)
-	viper.SetDefault("Sockaddr", "/var/run/caplance.sock")
+	viper.SetDefault("Batch.Size", 1)
+	viper.SetDefault("Batch.FlushInterval", 100)
+	viper.SetDefault("Client.Encap", "udp")
+	viper.SetDefault("Client.EncapPort", 5555)
+	viper.SetDefault("Client.Weight", 1)
+	viper.SetDefault("Client.ProbeFall", 3)
+	viper.SetDefault("Client.ProbeRise", 2)
+	viper.SetDefault("Client.ProtocolVersion", protocol.Latest)
+	viper.SetDefault("Client.Sockaddr", "/var/run/caplance-client.sock")
+	viper.SetDefault("Server.MetricsAddr", "127.0.0.1:9338")
+	viper.SetDefault("Server.DrainTimeout", 300)
+	viper.SetDefault("Server.Sockaddr", "/var/run/caplance-server.sock")
+	viper.SetDefault("Server.PacketSource.Type", "nfqueue")
+	viper.SetDefault("Server.PacketSource.Queues", 1)
+	viper.SetDefault("Server.StatusRise", 2)
+	viper.SetDefault("Server.StatusFall", 3)
+	viper.SetDefault("Server.HA.Port", 1339)
+	viper.SetDefault("Server.HA.Priority", 100)
+	viper.SetDefault("Server.HA.Interval", 1)
+	viper.SetDefault("Server.HA.DeadInterval", 3)
+	viper.SetDefault("Server.ConnTrack.MaxEntries", 262144)
+	viper.SetDefault("Server.ConnTrack.TCPTimeout", 600)
+	viper.SetDefault("Server.ConnTrack.UDPTimeout", 30)
+	viper.SetDefault("Server.ConnTrack.ClosingTimeout", 30)
 
 	rootCmd.PersistentFlags().StringVarP(&configLocation, "file", "f", "", "choose a non-standard config location")
 
@@ -80,3 +211,32 @@ var rootCmd = &cobra.Command{
 	Short: "caplancectl is the controller for caplance",
 	Long:  `For more information, visit https://github.com/Pwpon500/caplance`,
 }
+
+// parseVIPs parses the VIP and VIPs config options into a single list of ips
+func parseVIPs() []net.IP {
+	raw := conf.VIPs
+	if conf.VIP != "" {
+		raw = append([]string{conf.VIP}, raw...)
+	}
+	return parseIPs(raw)
+}
+
+// parseIPs parses a list of vips from config
+func parseIPs(raw []string) []net.IP {
+	if len(raw) == 0 {
+		log.Fatal("Please provide at least one vip")
+	}
+	vips, err := util.ParseIPs(raw)
+	if err != nil {
+		log.Fatal("Could not parse vips: " + err.Error())
+	}
+	return vips
+}
+
+// parseBatch returns how packets on the data path are batched into syscalls
+func parseBatch() util.BatchConfig {
+	return util.BatchConfig{
+		Size:  conf.Batch.Size,
+		Flush: time.Duration(conf.Batch.FlushInterval) * time.Microsecond,
+	}
+}
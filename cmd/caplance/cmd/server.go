@@ -1,10 +1,19 @@
 package cmd
 
 import (
+	"crypto/tls"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/pwpon500/caplance/internal/balancer"
+	"github.com/pwpon500/caplance/internal/balancer/backends"
+	"github.com/pwpon500/caplance/internal/balancer/conntrack"
+	"github.com/pwpon500/caplance/internal/balancer/ha"
+	"github.com/pwpon500/caplance/internal/balancer/metrics"
+	"github.com/pwpon500/caplance/internal/balancer/source"
+	"github.com/pwpon500/caplance/internal/balancer/xdp"
+	"github.com/pwpon500/caplance/pkg/util"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -20,22 +29,213 @@ var serverCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Infoln("Reading in config file")
 		readConfig()
-		vip := net.ParseIP(conf.VIP)
-		if vip == nil {
-			log.Fatal("Could not parse vip: " + conf.VIP)
-		}
 		mngIP := net.ParseIP(conf.Server.MngIP)
 		if mngIP == nil {
 			log.Fatal("Could not parse management ip: " + conf.Server.MngIP)
 		}
-		if conf.Server.BackendCapacity <= 0 {
-			log.Fatal("Backend capacity " + strconv.Itoa(conf.Server.BackendCapacity) + " must be postive.")
+		services := parseServices()
+		fast := parseXDP()
+		var conns *conntrack.Table
+		if ct := conf.Server.ConnTrack; ct.MaxEntries > 0 && fast != nil {
+			log.Infoln("Connection tracking is off, as flows forwarded by the xdp fast path never make it into its table")
+		} else if ct.MaxEntries > 0 {
+			conns = conntrack.New(ct.MaxEntries,
+				time.Duration(ct.TCPTimeout)*time.Second,
+				time.Duration(ct.UDPTimeout)*time.Second,
+				time.Duration(ct.ClosingTimeout)*time.Second)
 		}
-		b, err := balancer.New(vip, mngIP, conf.Server.BackendCapacity, conf.ReadTimeout, conf.WriteTimeout)
+		b, err := balancer.New(balancer.Config{
+			Services:     services,
+			ConnectIP:    mngIP,
+			ReadTimeout:  conf.ReadTimeout,
+			WriteTimeout: conf.WriteTimeout,
+			DrainTimeout: conf.Server.DrainTimeout,
+			Sockaddr:     conf.Server.Sockaddr,
+			Conns:        conns,
+			TLS:          parseServerTLS(),
+			HA:           parseHA(),
+			ECMP:         conf.Server.ECMP,
+			Source:       parsePacketSource(),
+			XDP:          fast,
+			Batch:        parseBatch(),
+		})
 		if err != nil {
 			log.Fatal("Error when creating balancer: " + err.Error())
 		}
+		if conf.Server.MetricsAddr != "" {
+			go func() {
+				log.Errorln("Metrics endpoint stopped: " + metrics.Serve(conf.Server.MetricsAddr).Error())
+			}()
+		}
 		log.Infoln("Starting load balancer")
 		b.Start()
 	},
 }
+
+// parseServices builds the balancer services from config. Without a services list, the
+// top level vips and server options make up a single service
+func parseServices() []balancer.ServiceConfig {
+	raw := conf.Server.Services
+	if len(raw) == 0 {
+		raw = []serviceConfig{{
+			Name:            "default",
+			VIPs:            append([]string{conf.VIP}, conf.VIPs...),
+			Ports:           conf.Server.Ports,
+			BackendCapacity: conf.Server.BackendCapacity,
+			Weights:         conf.Server.Weights,
+			HashPolicy:      conf.Server.HashPolicy,
+			SymmetricHash:   conf.Server.SymmetricHash,
+			HealthCheck:     conf.Server.HealthCheck,
+		}}
+		if conf.VIP == "" {
+			raw[0].VIPs = conf.VIPs
+		}
+	}
+
+	services := make([]balancer.ServiceConfig, 0, len(raw))
+	for i, svc := range raw {
+		if svc.Name == "" {
+			svc.Name = "service-" + strconv.Itoa(i)
+		}
+		capacity := svc.BackendCapacity
+		if capacity == 0 {
+			capacity = conf.Server.BackendCapacity
+		}
+		if capacity <= 0 {
+			log.Fatal("Backend capacity " + strconv.Itoa(capacity) + " of service " + svc.Name + " must be postive.")
+		}
+		status := backends.StatusPolicy{Rise: svc.StatusRise, Fall: svc.StatusFall}
+		if status.Rise == 0 {
+			status.Rise = conf.Server.StatusRise
+		}
+		if status.Fall == 0 {
+			status.Fall = conf.Server.StatusFall
+		}
+		policy, err := balancer.ParseHashPolicy(svc.HashPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ports := make([]balancer.PortRange, 0, len(svc.Ports))
+		for _, raw := range svc.Ports {
+			r, err := balancer.ParsePortRange(raw)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ports = append(ports, r)
+		}
+		services = append(services, balancer.ServiceConfig{
+			Name:     svc.Name,
+			VIPs:     parseIPs(svc.VIPs),
+			Ports:    ports,
+			Capacity: capacity,
+			Hashing:  balancer.HashConfig{Policy: policy, Symmetric: svc.SymmetricHash},
+			Weights:  svc.Weights,
+			Check:    parseHealthCheck(svc.HealthCheck),
+			Status:   status,
+		})
+	}
+	return services
+}
+
+// parseHealthCheck builds a service's health check from config, filling in defaults for
+// anything left out. Returns nil if the service has no health check
+func parseHealthCheck(raw healthCheckConfig) *backends.HealthCheck {
+	if raw.Type == "" {
+		return nil
+	}
+	if raw.Interval == 0 {
+		raw.Interval = 5
+	}
+	if raw.Timeout == 0 {
+		raw.Timeout = 2
+	}
+	if raw.Rise == 0 {
+		raw.Rise = 2
+	}
+	if raw.Fall == 0 {
+		raw.Fall = 3
+	}
+	return &backends.HealthCheck{
+		Type:     raw.Type,
+		Port:     raw.Port,
+		Path:     raw.Path,
+		Status:   raw.Status,
+		Send:     raw.Send,
+		Expect:   raw.Expect,
+		Interval: time.Duration(raw.Interval) * time.Second,
+		Timeout:  time.Duration(raw.Timeout) * time.Second,
+		Rise:     raw.Rise,
+		Fall:     raw.Fall,
+	}
+}
+
+// parseServerTLS loads the tls config for the management protocol. Backends register in
+// plaintext if no certificate is configured
+func parseServerTLS() *tls.Config {
+	raw := conf.Server.TLS
+	if raw.Cert == "" {
+		return nil
+	}
+	tlsConf, err := util.ServerTLSConfig(raw.Cert, raw.Key, raw.ClientCA)
+	if err != nil {
+		log.Fatal("Failed to load tls config: " + err.Error())
+	}
+	return tlsConf
+}
+
+// parseHA builds the election config for an active/standby pair. The balancer is standalone if
+// no peer is configured
+func parseHA() *ha.Config {
+	raw := conf.Server.HA
+	if raw.Peer == "" {
+		return nil
+	}
+	peer := net.ParseIP(raw.Peer)
+	if peer == nil {
+		log.Fatal("Could not parse ha peer ip: " + raw.Peer)
+	}
+	if len(raw.Key) < ha.MinKeyLen {
+		log.Fatal("HA key must be at least " + strconv.Itoa(ha.MinKeyLen) + " characters long")
+	}
+	return &ha.Config{
+		Peer:      peer,
+		Port:      raw.Port,
+		Priority:  raw.Priority,
+		Interval:  time.Duration(raw.Interval) * time.Second,
+		DeadAfter: time.Duration(raw.DeadInterval) * time.Second,
+		Key:       []byte(raw.Key),
+	}
+}
+
+// parsePacketSource returns where the balancer reads packets from
+func parsePacketSource() source.Config {
+	raw := conf.Server.PacketSource
+	switch raw.Type {
+	case source.NFQueue, source.AFPacket:
+	default:
+		log.Fatal("Unknown packet source: " + raw.Type)
+	}
+	if raw.Queues < 1 || raw.Queues > 65535 {
+		log.Fatal("Packet source queues must be between 1 and 65535")
+	}
+	return source.Config{
+		Type:       raw.Type,
+		Queues:     raw.Queues,
+		Interfaces: raw.Interfaces,
+		Fanout:     raw.Fanout,
+		BlockSize:  raw.BlockSize,
+		Blocks:     raw.Blocks,
+	}
+}
+
+// parseXDP returns where the xdp fast path is attached. nil if it is disabled
+func parseXDP() *xdp.Config {
+	raw := conf.Server.XDP
+	if !raw.Enabled {
+		return nil
+	}
+	return &xdp.Config{
+		Interfaces: raw.Interfaces,
+		Generic:    raw.Generic,
+	}
+}
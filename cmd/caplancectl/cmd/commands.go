@@ -8,7 +8,9 @@ func init() {
 	rootCmd.AddCommand(deregister)
 	rootCmd.AddCommand(pause)
 	rootCmd.AddCommand(resume)
+	rootCmd.AddCommand(drainClient)
 	rootCmd.AddCommand(getstate)
+	rootCmd.AddCommand(weight)
 }
 
 var deregister = &cobra.Command{
@@ -41,6 +43,18 @@ var resume = &cobra.Command{
 	},
 }
 
+var drainClient = &cobra.Command{
+	Use:   "drain",
+	Short: "Drain the client",
+	Long: `Send a drain request to the load balancer. The client gets no new flows,
+	and is paused once its established flows close or the drain timeout of the
+	load balancer runs out. Load balancers without connection tracking refuse
+	to drain, pause the client instead.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runCommand("Drain")
+	},
+}
+
 var getstate = &cobra.Command{
 	Use:   "getstate",
 	Short: "Get the client state",
@@ -48,3 +62,15 @@ var getstate = &cobra.Command{
 		runCommand("GetState")
 	},
 }
+
+var weight = &cobra.Command{
+	Use:   "weight <weight>",
+	Short: "Change the client weight",
+	Long: `Send a weight change to the load balancer. The client's share of new
+	connections is proportional to its weight. Weights pinned in the load balancer
+	config cannot be changed this way.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runCommandWithArg("SetWeight", args[0])
+	},
+}
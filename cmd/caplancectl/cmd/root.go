@@ -9,18 +9,44 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// default sockets of caplance, as set by its Server.Sockaddr and Client.Sockaddr
 const (
-	SOCKADDR = "/var/sock/caplance.sock"
+	defaultServerSock = "/var/run/caplance-server.sock"
+	defaultClientSock = "/var/run/caplance-client.sock"
 )
 
+// sockaddr is the socket to control caplance over. The default of the side a command runs against
+// if empty
+var sockaddr string
+
+func init() {
+	rootCmd.PersistentFlags().StringVarP(&sockaddr, "sockaddr", "s", "", "socket caplance listens on (default "+defaultClientSock+", or "+defaultServerSock+" for server commands)")
+}
+
 func runCommand(funcName string) {
-	client, err := rpc.DialHTTP("unix", SOCKADDR)
+	runCommandWithArg(funcName, "")
+}
+
+func runCommandWithArg(funcName, arg string) {
+	call(defaultClientSock, "Client."+funcName, arg)
+}
+
+func runServerCommand(funcName, arg string) {
+	call(defaultServerSock, "Balancer."+funcName, arg)
+}
+
+func call(defaultSock, method, arg string) {
+	sock := sockaddr
+	if sock == "" {
+		sock = defaultSock
+	}
+	client, err := rpc.DialHTTP("unix", sock)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	var reply string
-	err = client.Call("Client."+funcName, "", &reply)
+	err = client.Call(method, arg, &reply)
 	if err != nil {
 		log.Fatal(err)
 	}
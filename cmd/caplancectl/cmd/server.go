@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	server.AddCommand(list)
+	server.AddCommand(forcePause)
+	server.AddCommand(forceResume)
+	server.AddCommand(drain)
+	server.AddCommand(evict)
+	server.AddCommand(role)
+	server.AddCommand(fingerprint)
+	rootCmd.AddCommand(server)
+}
+
+var server = &cobra.Command{
+	Use:   "server",
+	Short: "Control the load balancer",
+	Long: `Commands run against the load balancer on this host rather than a client.
+	Backends are named as <pool>/<name>, or just <name> if it is unique.`,
+}
+
+var list = &cobra.Command{
+	Use:   "list",
+	Short: "List the registered backends",
+	Run: func(cmd *cobra.Command, args []string) {
+		runServerCommand("ListBackends", "")
+	},
+}
+
+var forcePause = &cobra.Command{
+	Use:   "pause <backend>",
+	Short: "Pause a backend",
+	Long: `Take a backend out of its pool from the load balancer side. The client
+	is told it has been paused.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runServerCommand("PauseBackend", args[0])
+	},
+}
+
+var forceResume = &cobra.Command{
+	Use:   "resume <backend>",
+	Short: "Resume a backend",
+	Long: `Put a paused or draining backend back into its pool from the load
+	balancer side. The client is told it has been resumed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runServerCommand("ResumeBackend", args[0])
+	},
+}
+
+var drain = &cobra.Command{
+	Use:   "drain <backend>",
+	Short: "Drain a backend",
+	Long: `Stop sending new flows to a backend while its established flows keep
+	being forwarded. Only flows in the connection tracking table stay with it. The
+	backend is paused once they close or the drain timeout runs out. Refused when
+	connection tracking is off, as then no flow stays with the backend. Pause it
+	instead.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runServerCommand("DrainBackend", args[0])
+	},
+}
+
+var evict = &cobra.Command{
+	Use:   "evict <backend>",
+	Short: "Evict a backend",
+	Long:  `Deregister a backend from the load balancer side.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runServerCommand("EvictBackend", args[0])
+	},
+}
+
+var fingerprint = &cobra.Command{
+	Use:   "fingerprint",
+	Short: "Show a fingerprint of each service's lookup table",
+	Long: `Show a fingerprint of the maglev table of each service. Balancers behind
+	ecmp only send a flow to the same backend if their fingerprints match.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runServerCommand("Fingerprints", "")
+	},
+}
+
+var role = &cobra.Command{
+	Use:   "role",
+	Short: "Show whether the load balancer holds the VIPs",
+	Long: `Show whether the load balancer is the leader of its active/standby pair,
+	a standby or running standalone.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runServerCommand("GetRole", "")
+	},
+}
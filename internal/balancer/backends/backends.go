@@ -1,61 +1,184 @@
 package backends
 
 import (
+	"errors"
 	"net"
-
-	"github.com/kkdai/maglev"
+	"sync"
 )
 
 // Handler contains a maglev hashtable of backends and a mapping from neighbor name to backend
 type Handler struct {
-	backHash   *maglev.Maglev      // maglev hash for consistent hashing
+	backHash   *maglev             // weighted maglev hash for consistent hashing
 	backendMap map[string]*Backend // hash from backend name to backend struct
+	pool       string              // name of the pool the handler backs, qualifying backend ids
+	mux        sync.RWMutex        // guards backendMap and onChange
+	onChange   func()              // called after the maglev table changed. nil if unset
 }
 
-// NewHandler creates a new Handler
+// NewHandler creates a new Handler. Throws error if capacity is not prime
 func NewHandler(capacity int) (*Handler, error) {
-	mag, err := maglev.NewMaglev([]string{}, uint64(capacity))
+	mag, err := newMaglev(uint64(capacity))
 	if err != nil {
 		return nil, err
 	}
-	return &Handler{mag, make(map[string]*Backend)}, nil
+	return &Handler{backHash: mag, backendMap: make(map[string]*Backend)}, nil
 }
 
 // Get gets the backend device name for a given string. Returns error if something goes wrong in
 // maglev hashing process
 func (bh *Handler) Get(key string) (*Backend, error) {
-	back, err := bh.backHash.Get(key)
+	return bh.Lookup([]byte(key))
+}
+
+// Lookup is Get for a key held in a byte slice. It doesn't allocate
+func (bh *Handler) Lookup(key []byte) (*Backend, error) {
+	back, err := bh.backHash.Lookup(key)
 	if err != nil {
 		return nil, err
 	}
-	return bh.backendMap[back], nil
+	backend := bh.GetByName(back)
+	if backend == nil {
+		// removed between the two lookups
+		return nil, errNoBackends
+	}
+	return backend, nil
+}
+
+// GetByName gets the backend registered under name. Returns nil if no such backend exists
+func (bh *Handler) GetByName(name string) *Backend {
+	bh.mux.RLock()
+	defer bh.mux.RUnlock()
+	return bh.backendMap[name]
 }
 
-// Add adds a new backend and its associated Backend struct. Throws error if the maglev table is out of
-// slots or if the entry already exists
-func (bh *Handler) Add(name string, ip net.IP) error {
-	err := bh.backHash.Add(name)
+// Add adds a new backend and its associated Backend struct, forwarding to it with the given
+// encapsulation and giving it a share of the maglev table proportional to weight. Throws error
+// if the maglev table is out of slots or if the entry already exists
+func (bh *Handler) Add(name string, ip net.IP, encap Encap, weight int) error {
+	// the check and both inserts happen under one hold, so concurrent adds of a name can't both
+	// get through and maglev never hands out a name that isn't in the map
+	bh.mux.Lock()
+	if bh.backendMap[name] != nil {
+		bh.mux.Unlock()
+		return errors.New("backend " + name + " already exists")
+	}
+	writer, err := NewForwarder(bh.pool, name, ip, encap)
 	if err != nil {
+		bh.mux.Unlock()
 		return err
 	}
-	conn, err := net.Dial("udp", ip.String()+":1337")
-	backend := NewBackend(name, ip, NewUDPForwarder(conn))
+	backend := NewBackend(name, ip, writer)
+	backend.id = backendID(bh.pool, name)
+	backend.encap = encap
 	bh.backendMap[name] = backend
+	err = bh.backHash.Add(name, weight)
+	if err != nil {
+		delete(bh.backendMap, name)
+		bh.mux.Unlock()
+		writer.Close()
+		return err
+	}
+	bh.mux.Unlock()
+
+	bh.changed()
 	return nil
 }
 
-// Remove removes an entry from the backends. Throws error if backend does not exist
+// OnChange sets f to be called whenever a backend is added to or taken out of the maglev table,
+// or its weight changes. f must not call back into the Handler's mutating methods
+func (bh *Handler) OnChange(f func()) {
+	bh.mux.Lock()
+	bh.onChange = f
+	bh.mux.Unlock()
+}
+
+func (bh *Handler) changed() {
+	bh.mux.RLock()
+	f := bh.onChange
+	bh.mux.RUnlock()
+	if f != nil {
+		f()
+	}
+}
+
+// Slots returns the name of the backend owning each slot of the maglev table
+func (bh *Handler) Slots() []string {
+	return bh.backHash.Slots()
+}
+
+// Capacity returns the size of the maglev table
+func (bh *Handler) Capacity() int {
+	return int(bh.backHash.size)
+}
+
+// Fingerprint identifies the current maglev table. Handlers with the same capacity and the
+// same backends and weights have the same fingerprint
+func (bh *Handler) Fingerprint() string {
+	return bh.backHash.Fingerprint()
+}
+
+// SetWeight changes the share of the maglev table owned by a backend. Throws error if backend does
+// not exist or weight is not positive
+func (bh *Handler) SetWeight(name string, weight int) error {
+	err := bh.backHash.SetWeight(name, weight)
+	if err == nil {
+		bh.changed()
+	}
+	return err
+}
+
+// Remove removes an entry from the backends, whether it is active or drained. Throws error if
+// backend does not exist
 func (bh *Handler) Remove(name string) error {
-	err := bh.backHash.Remove(name)
-	if err != nil {
-		return err
+	if bh.GetByName(name) == nil {
+		return errors.New("backend " + name + " not found")
 	}
+	// drained backends are already out of the maglev table
+	bh.backHash.Remove(name)
+
+	bh.mux.Lock()
+	backend, ok := bh.backendMap[name]
 	delete(bh.backendMap, name)
+	bh.mux.Unlock()
+
+	bh.changed()
+	if ok {
+		backend.Writer.Close()
+	}
 	return nil
 }
 
+// Drain takes a backend out of the maglev table so it gets no new flows, while keeping it
+// reachable by name for flows already pinned to it. Throws error if backend is not active
+func (bh *Handler) Drain(name string) error {
+	if bh.GetByName(name) == nil {
+		return errors.New("backend " + name + " not found")
+	}
+	err := bh.backHash.Remove(name)
+	if err == nil {
+		bh.changed()
+	}
+	return err
+}
+
+// Undrain puts a drained backend back into the maglev table with weight. Throws error if
+// backend does not exist or is not drained
+func (bh *Handler) Undrain(name string, weight int) error {
+	if bh.GetByName(name) == nil {
+		return errors.New("backend " + name + " not found")
+	}
+	err := bh.backHash.Add(name, weight)
+	if err == nil {
+		bh.changed()
+	}
+	return err
+}
+
 // GetBackends returns a slice of all the backends
 func (bh *Handler) GetBackends() []*Backend {
+	bh.mux.RLock()
+	defer bh.mux.RUnlock()
+
 	toReturn := make([]*Backend, 0, len(bh.backendMap))
 	for _, val := range bh.backendMap {
 		toReturn = append(toReturn, val)
@@ -1,44 +1,243 @@
 package backends
 
-import "net"
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/pwpon500/caplance/internal/balancer/metrics"
+	"github.com/pwpon500/caplance/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// EncapUDP sends the raw packet as the payload of a udp datagram to the caplance client
+	EncapUDP = "udp"
+	// EncapFOU sends the raw packet as the payload of a udp datagram to a kernel fou port
+	EncapFOU = "fou"
+	// EncapGUE sends the raw packet behind a GUE header to a kernel fou port in gue mode
+	EncapGUE = "gue"
+	// EncapIPIP sends the raw packet through a kernel ipip tunnel to the backend
+	EncapIPIP = "ipip"
+	// EncapGRE sends the raw packet through a kernel gre tunnel to the backend
+	EncapGRE = "gre"
+
+	// DataPort is the port the caplance client listens on for udp encapsulated packets
+	// and control messages
+	DataPort = 1337
+)
+
+// Encap describes how packets are wrapped on their way to a backend
+type Encap struct {
+	Type  string           // one of EncapUDP, EncapFOU, EncapGUE, EncapIPIP or EncapGRE
+	Port  int              // udp port on the backend to send encapsulated packets to. unused by tunnels
+	Auth  *util.DataAuth   // authenticates udp packets to the backend. nil if it didn't send a key
+	Batch util.BatchConfig // how packets to udp ports are batched into syscalls. unused by tunnels
+	// where control messages to backends decapsulating in the kernel go inside the tunnel. a vip
+	// for backends of ipv6-only pools, whose tunnels only carry ipv6. their data ip if nil
+	Control net.IP
+}
 
 // PacketForwarder is an interface for forwarding packets to the appropriate backend
 type PacketForwarder interface {
 	SendData(data []byte) error
+	SendControl(data []byte) error
 	Close() error
 }
 
 // Backend is the data struct for a single backend
 type Backend struct {
 	name   string          // name of backend
+	id     string          // name of backend qualified by its pool, unique across pools
 	ip     net.IP          // ip for the balancer to send data to
+	encap  Encap           // how packets to the backend are wrapped
 	Writer PacketForwarder // interface for sending to backend
 }
 
 // NewBackend creates a new Backend
 func NewBackend(name string, ip net.IP, writer PacketForwarder) *Backend {
-	return &Backend{name, ip, writer}
+	return &Backend{name: name, ip: ip, Writer: writer}
+}
+
+// ID returns the name of the backend qualified by the name of its pool, which unlike the name
+// alone is unique across pools
+func (b *Backend) ID() string {
+	return b.id
+}
+
+// Name returns the name the backend registered with
+func (b *Backend) Name() string {
+	return b.name
+}
+
+// IP returns the ip the balancer sends the backend's data to
+func (b *Backend) IP() net.IP {
+	return b.ip
+}
+
+// Encap returns how packets to the backend are wrapped
+func (b *Backend) Encap() Encap {
+	return b.encap
+}
+
+// forwardCounters count the packets a forwarder sent its backend. Looking counters up by label
+// values allocates, so forwarders do it once when they are made
+type forwardCounters struct {
+	packets prometheus.Counter // nil if the forwarder isn't counted
+	bytes   prometheus.Counter
+}
+
+func newForwardCounters(pool, name string) forwardCounters {
+	return forwardCounters{
+		packets: metrics.ForwardedPackets.WithLabelValues(pool, name),
+		bytes:   metrics.ForwardedBytes.WithLabelValues(pool, name),
+	}
+}
+
+// sent counts a packet of n bytes handed to the kernel
+func (c *forwardCounters) sent(n int) {
+	if c.packets != nil {
+		c.packets.Inc()
+		c.bytes.Add(float64(n))
+	}
+}
+
+// flushed returns the FlushFunc counting what a forwarder's batch sent and dropped. Each packet in
+// the batch carries overhead bytes of encapsulation, which aren't counted
+func (c *forwardCounters) flushed(overhead int) util.FlushFunc {
+	return func(sent, bytes, failed int, err error) {
+		if c.packets != nil && sent > 0 {
+			c.packets.Add(float64(sent))
+			c.bytes.Add(float64(bytes - sent*overhead))
+		}
+		if failed > 0 {
+			metrics.DroppedPackets.WithLabelValues(metrics.DropSendError).Add(float64(failed))
+			log.Println("Failed to send " + strconv.Itoa(failed) + " packets of a batch: " + err.Error())
+		}
+	}
+}
+
+// NewForwarder sets up the PacketForwarder matching encap for the backend named name at ip
+// in pool, counting the packets it forwards in the pool's metrics. Throws error if the
+// encapsulation type is unknown
+func NewForwarder(pool, name string, ip net.IP, encap Encap) (PacketForwarder, error) {
+	counters := newForwardCounters(pool, name)
+	if encap.Type == EncapIPIP || encap.Type == EncapGRE {
+		f, err := NewTunnelForwarder(backendID(pool, name), ip, encap.Type)
+		if err != nil {
+			return nil, err
+		}
+		f.counters = counters
+		f.control = encap.Control
+		return f, nil
+	}
+
+	port := encap.Port
+	if port == 0 {
+		port = DataPort
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	switch encap.Type {
+	case EncapUDP, "":
+		f := NewUDPForwarder(conn, encap.Auth, encap.Batch)
+		f.counters = counters
+		return f, nil
+	case EncapFOU, EncapGUE:
+		f := NewFOUForwarder(conn, encap.Type == EncapGUE, encap.Batch)
+		f.counters = counters
+		f.control = encap.Control
+		return f, nil
+	}
+	conn.Close()
+	return nil, errors.New("unknown encapsulation type " + encap.Type)
 }
 
 // UDPForwarder is an implementation of PacketForwarder that uses UDP as the
 // underlying packet encapsulation
 type UDPForwarder struct {
-	conn net.Conn
+	conn  net.Conn
+	auth  *util.DataAuth    // seals every packet if not nil
+	batch *util.BatchWriter // sends packets in batches. nil if they go out one at a time
+
+	counters forwardCounters
 }
 
-// NewUDPForwarder creates a new UDP Forwarder
-func NewUDPForwarder(conn net.Conn) *UDPForwarder {
-	return &UDPForwarder{conn}
+// NewUDPForwarder creates a new UDP Forwarder. Packets are sealed with auth unless it is nil, and
+// sent in batches if batch asks for more than one per syscall
+func NewUDPForwarder(conn net.Conn, auth *util.DataAuth, batch util.BatchConfig) *UDPForwarder {
+	f := &UDPForwarder{conn: conn, auth: auth}
+	overhead := 0
+	if auth != nil {
+		overhead = util.AuthHeaderLen
+	}
+	f.batch = newBatchWriter(conn, batch, f.counters.flushed(overhead))
+	return f
 }
 
-// SendData sends the desired packet over UDP
+// newBatchWriter returns a writer batching packets on conn and reporting them to report, or nil
+// if batching is off or conn can't do it
+func newBatchWriter(conn net.Conn, batch util.BatchConfig, report util.FlushFunc) *util.BatchWriter {
+	if batch.Size < 2 {
+		return nil
+	}
+	writer, err := util.NewBatchWriter(conn, batch, report)
+	if err != nil {
+		return nil
+	}
+	return writer
+}
+
+// SendData sends the desired packet over UDP. Packets going out in a batch are counted once it
+// is sent
 func (f *UDPForwarder) SendData(data []byte) error {
-	_, err := f.conn.Write(data)
+	if f.batch != nil {
+		return f.send(data, true)
+	}
+	err := f.send(data, false)
+	if err == nil {
+		f.counters.sent(len(data))
+	}
+	return err
+}
+
+func (f *UDPForwarder) send(data []byte, batched bool) error {
+	if f.auth == nil {
+		if batched {
+			return f.batch.Write(data)
+		}
+		_, err := f.conn.Write(data)
+		return err
+	}
+
+	// sealers come from a pool, so the workers sharing the forwarder don't allocate a buffer or
+	// an hmac per packet
+	s := f.auth.Sealer()
+	defer f.auth.PutSealer(s)
+	if batched {
+		// the batch copies the parts into its own buffers, so the packet isn't copied to seal it
+		return f.batch.Write(s.Header(data), data)
+	}
+	_, err := f.conn.Write(s.Seal(data))
 	return err
 }
 
-// Close closes the underlying UDP connection
+// SendControl sends a control message over UDP. The client reads these straight
+// off its data socket, so no extra framing is needed. They skip the batch, so they
+// aren't held up or counted with the data
+func (f *UDPForwarder) SendControl(data []byte) error {
+	return f.send(data, false)
+}
+
+// Close sends what is left of the batch and closes the underlying UDP connection
 func (f *UDPForwarder) Close() error {
+	if f.batch != nil {
+		f.batch.Close()
+	}
 	err := f.conn.Close()
 	return err
 }
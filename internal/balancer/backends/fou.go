@@ -0,0 +1,134 @@
+package backends
+
+import (
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pwpon500/caplance/pkg/util"
+)
+
+// FOUForwarder is an implementation of PacketForwarder that frames packets for
+// decapsulation by the backend kernel's fou module, so no userspace daemon is
+// needed on the data path. In FOU mode the packet is the bare udp payload, in
+// GUE mode it is preceded by a 4 byte GUE header naming the inner protocol
+type FOUForwarder struct {
+	conn  net.Conn
+	gue   bool
+	guev4 []byte            // GUE header for ipv4 inner packets
+	guev6 []byte            // GUE header for ipv6 inner packets
+	batch *util.BatchWriter // sends packets in batches. nil if they go out one at a time
+
+	control  net.IP // inner destination of control messages. the backend's data ip if nil
+	counters forwardCounters
+}
+
+// NewFOUForwarder creates a new FOU Forwarder, adding GUE headers if gue is set. Packets are sent
+// in batches if batch asks for more than one per syscall
+func NewFOUForwarder(conn net.Conn, gue bool, batch util.BatchConfig) *FOUForwarder {
+	f := &FOUForwarder{
+		conn:  conn,
+		gue:   gue,
+		guev4: []byte{0, byte(layers.IPProtocolIPv4), 0, 0},
+		guev6: []byte{0, byte(layers.IPProtocolIPv6), 0, 0}}
+	overhead := 0
+	if gue {
+		overhead = len(f.guev4)
+	}
+	f.batch = newBatchWriter(conn, batch, f.counters.flushed(overhead))
+	return f
+}
+
+// SendData sends the desired packet to the backend's fou port. Packets going out in a batch are
+// counted once it is sent
+func (f *FOUForwarder) SendData(data []byte) error {
+	if f.batch != nil {
+		return f.send(data, true)
+	}
+	err := f.send(data, false)
+	if err == nil {
+		f.counters.sent(len(data))
+	}
+	return err
+}
+
+func (f *FOUForwarder) send(data []byte, batched bool) error {
+	if !f.gue {
+		if batched {
+			return f.batch.Write(data)
+		}
+		_, err := f.conn.Write(data)
+		return err
+	}
+
+	hdr := f.guev4
+	if len(data) > 0 && data[0]>>4 == 6 {
+		hdr = f.guev6
+	}
+	if batched {
+		return f.batch.Write(hdr, data)
+	}
+	// writev on a udp socket still produces a single datagram
+	bufs := net.Buffers{hdr, data}
+	_, err := bufs.WriteTo(f.conn)
+	return err
+}
+
+// SendControl wraps a control message in an inner ip/udp packet addressed to the
+// client's data port. Once the kernel strips the encapsulation, it lands on the
+// client's udp socket like it would have with plain udp encapsulation. They skip
+// the batch, so they aren't held up or counted with the data
+func (f *FOUForwarder) SendControl(data []byte) error {
+	packet, err := controlPacket(f.conn.LocalAddr().(*net.UDPAddr).IP, f.conn.RemoteAddr().(*net.UDPAddr).IP, f.control, data)
+	if err != nil {
+		return err
+	}
+	return f.send(packet, false)
+}
+
+// Close sends what is left of the batch and closes the underlying UDP connection
+func (f *FOUForwarder) Close() error {
+	if f.batch != nil {
+		f.batch.Close()
+	}
+	return f.conn.Close()
+}
+
+// controlPacket builds an ip/udp packet from src to dst's data port carrying payload. If control
+// is set, the packet goes to it instead, in its family. It is the source as well, since the backend
+// has no other address of that family to hand, and ipv6 doesn't filter by source
+func controlPacket(src, dst, control net.IP, payload []byte) ([]byte, error) {
+	if control != nil {
+		src, dst = control, control
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(DataPort), DstPort: layers.UDPPort(DataPort)}
+
+	var ip gopacket.NetworkLayer
+	if dst.To4() != nil {
+		ip = &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    src.To4(),
+			DstIP:    dst.To4()}
+	} else {
+		ip = &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      src,
+			DstIP:      dst}
+	}
+	err := udp.SetNetworkLayerForChecksum(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err = gopacket.SerializeLayers(buf, opts, ip.(gopacket.SerializableLayer), udp, gopacket.Payload(payload))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
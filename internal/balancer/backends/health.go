@@ -0,0 +1,134 @@
+package backends
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// CheckTCP passes if a tcp connection to the backend can be opened
+	CheckTCP = "tcp"
+	// CheckHTTP passes if an http GET to the backend returns the expected status
+	CheckHTTP = "http"
+	// CheckUDP passes if the backend answers a udp request with the expected response
+	CheckUDP = "udp"
+)
+
+// HealthCheck describes a probe the balancer runs against each backend of a pool at its data ip
+type HealthCheck struct {
+	Type     string // one of CheckTCP, CheckHTTP or CheckUDP
+	Port     int
+	Path     string // http only
+	Status   int    // expected http status. any 2xx if 0
+	Send     string // udp request payload
+	Expect   string // expected prefix of the udp response. any response if empty
+	Interval time.Duration
+	Timeout  time.Duration
+	Rise     int // consecutive passes before a failed backend is put back
+	Fall     int // consecutive failures before a backend is taken out
+}
+
+// StatusPolicy decides when the status codes backends report in their own health checks take
+// them out of their pool. 2xx is healthy, 429 and 503 mean overloaded and drain the backend, or
+// pause it without connection tracking, and anything else is unhealthy and pauses it
+type StatusPolicy struct {
+	Rise int // healthy reports in a row before a backend taken out by its reports is put back
+	Fall int // bad reports in a row before a backend is taken out
+}
+
+// statusVerdict is what a reported status code means for a backend
+type statusVerdict int
+
+const (
+	verdictHealthy statusVerdict = iota
+	verdictOverloaded
+	verdictUnhealthy
+)
+
+// classifyStatus reads a reported status code. Only 5xx codes mean the backend itself is broken,
+// anything else short of 429 and 503 is about the request and counts as healthy
+func classifyStatus(code int) statusVerdict {
+	switch {
+	case code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable:
+		return verdictOverloaded
+	case code/100 == 5:
+		return verdictUnhealthy
+	}
+	return verdictHealthy
+}
+
+func (hc *HealthCheck) validate() error {
+	switch hc.Type {
+	case CheckTCP, CheckHTTP, CheckUDP:
+	default:
+		return errors.New("unknown health check type " + hc.Type)
+	}
+	if hc.Port <= 0 || hc.Port > 65535 {
+		return errors.New("health check port " + strconv.Itoa(hc.Port) + " is not valid")
+	}
+	if hc.Interval <= 0 || hc.Timeout <= 0 {
+		return errors.New("health check interval and timeout must be positive")
+	}
+	if hc.Rise < 1 || hc.Fall < 1 {
+		return errors.New("health check rise and fall must be positive")
+	}
+	return nil
+}
+
+// probe runs the check once against ip. Throws error if the check fails
+func (hc *HealthCheck) probe(ip net.IP) error {
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(hc.Port))
+	switch hc.Type {
+	case CheckHTTP:
+		return hc.probeHTTP(addr)
+	case CheckUDP:
+		return hc.probeUDP(addr)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, hc.Timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (hc *HealthCheck) probeHTTP(addr string) error {
+	client := &http.Client{Timeout: hc.Timeout}
+	resp, err := client.Get("http://" + addr + hc.Path)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if hc.Status == 0 && resp.StatusCode/100 == 2 || resp.StatusCode == hc.Status {
+		return nil
+	}
+	return errors.New("unexpected http status " + resp.Status)
+}
+
+func (hc *HealthCheck) probeUDP(addr string) error {
+	conn, err := net.DialTimeout("udp", addr, hc.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(hc.Timeout))
+	_, err = conn.Write([]byte(hc.Send))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(buf[:n], []byte(hc.Expect)) {
+		return errors.New("unexpected udp response")
+	}
+	return nil
+}
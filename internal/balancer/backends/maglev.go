@@ -0,0 +1,199 @@
+package backends
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/dchest/siphash"
+)
+
+// maglev is a maglev lookup table where each backend owns a share of the slots
+// proportional to its weight. Backends take turns claiming their next preferred
+// slot as in the maglev paper, except that a backend only gets a turn once it has
+// built up enough credit relative to the heaviest backend.
+// The table only depends on the size and the set of backends with their weights,
+// never on the order they were added in, so balancers behind ecmp agree on it
+type maglev struct {
+	size    uint64         // size of the lookup table. must be prime
+	weights map[string]int // weight of each backend
+	nodes   []string       // sorted backend names, indexed by lookup
+	lookup  []int          // slot to index into nodes
+	lock    sync.RWMutex
+}
+
+func newMaglev(size uint64) (*maglev, error) {
+	if !big.NewInt(0).SetUint64(size).ProbablyPrime(1) {
+		return nil, errors.New("lookup table size is not a prime number")
+	}
+	return &maglev{size: size, weights: make(map[string]int)}, nil
+}
+
+// Add adds a backend with the given weight. Throws error if the backend already exists,
+// the weight isn't positive or the table is full
+func (m *maglev) Add(name string, weight int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.weights[name]; ok {
+		return errors.New("backend " + name + " already exists")
+	}
+	if weight < 1 {
+		return errors.New("weight must be positive")
+	}
+	if uint64(len(m.weights)) == m.size {
+		return errors.New("number of backends would be greater than lookup table")
+	}
+
+	m.weights[name] = weight
+	m.populate()
+	return nil
+}
+
+// Remove removes a backend. Throws error if the backend does not exist
+func (m *maglev) Remove(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.weights[name]; !ok {
+		return errors.New("backend " + name + " not found")
+	}
+
+	delete(m.weights, name)
+	m.populate()
+	return nil
+}
+
+// SetWeight changes the weight of an existing backend. Throws error if the backend does
+// not exist or the weight isn't positive
+func (m *maglev) SetWeight(name string, weight int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.weights[name]; !ok {
+		return errors.New("backend " + name + " not found")
+	}
+	if weight < 1 {
+		return errors.New("weight must be positive")
+	}
+
+	m.weights[name] = weight
+	m.populate()
+	return nil
+}
+
+// errNoBackends is made once so failed lookups on the data path don't allocate
+var errNoBackends = errors.New("no backends in lookup table")
+
+// Get gets the name of the backend owning key's slot
+func (m *maglev) Get(key string) (string, error) {
+	return m.Lookup([]byte(key))
+}
+
+// Lookup is Get for a key held in a byte slice, which it doesn't allocate for
+func (m *maglev) Lookup(key []byte) (string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if len(m.nodes) == 0 {
+		return "", errNoBackends
+	}
+	return m.nodes[m.lookup[hashKey(key)%m.size]], nil
+}
+
+// Fingerprint hashes the lookup table, so balancers can check they map flows the same way
+func (m *maglev) Fingerprint() string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	h := sha256.New()
+	for _, i := range m.lookup {
+		h.Write([]byte(m.nodes[i]))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// Slots returns the name of the backend owning each slot, in slot order. Empty if the table has
+// no backends
+func (m *maglev) Slots() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	slots := make([]string, len(m.lookup))
+	for i, node := range m.lookup {
+		slots[i] = m.nodes[node]
+	}
+	return slots
+}
+
+// KeySeed is the first half of the siphash key flows are hashed with to find their slot. The
+// second half is 0
+const KeySeed = 0xdeadbabe
+
+func hashKey(key []byte) uint64 {
+	return siphash.Hash(KeySeed, 0, key)
+}
+
+// populate rebuilds the lookup table. Must be called with the write lock held
+func (m *maglev) populate() {
+	m.nodes = make([]string, 0, len(m.weights))
+	for name := range m.weights {
+		m.nodes = append(m.nodes, name)
+	}
+	sort.Strings(m.nodes)
+
+	n := len(m.nodes)
+	if n == 0 {
+		m.lookup = nil
+		return
+	}
+
+	offset := make([]uint64, n)
+	skip := make([]uint64, n)
+	weight := make([]int, n)
+	maxWeight := 0
+	for i, name := range m.nodes {
+		offset[i] = siphash.Hash(0xdeadbabe, 0, []byte(name)) % m.size
+		skip[i] = siphash.Hash(0xdeadbeef, 0, []byte(name))%(m.size-1) + 1
+		weight[i] = m.weights[name]
+		if weight[i] > maxWeight {
+			maxWeight = weight[i]
+		}
+	}
+
+	entry := make([]int, m.size)
+	for j := range entry {
+		entry[j] = -1
+	}
+	next := make([]uint64, n)
+	credit := make([]int, n)
+
+	var filled uint64
+	for {
+		for i := 0; i < n; i++ {
+			credit[i] += weight[i]
+			if credit[i] < maxWeight {
+				continue
+			}
+			credit[i] -= maxWeight
+
+			c := (offset[i] + next[i]*skip[i]) % m.size
+			for entry[c] >= 0 {
+				next[i]++
+				c = (offset[i] + next[i]*skip[i]) % m.size
+			}
+			entry[c] = i
+			next[i]++
+			filled++
+
+			if filled == m.size {
+				m.lookup = entry
+				return
+			}
+		}
+	}
+}
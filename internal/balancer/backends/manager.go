@@ -1,21 +1,100 @@
 package backends
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"net"
+	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/pwpon500/caplance/internal/balancer/conntrack"
+	"github.com/pwpon500/caplance/internal/balancer/metrics"
+	"github.com/pwpon500/caplance/pkg/protocol"
 	"github.com/pwpon500/caplance/pkg/util"
 )
 
+// BackendState is the state of a registered backend as seen by the balancer
+type BackendState int
+
+const (
+	// StateActive represents a backend that new flows are hashed to
+	StateActive BackendState = iota
+	// StatePaused represents a backend that gets no new flows. Flows already pinned to it stay
+	// with it while it is registered, unless it was paused for failing or a drain timed out
+	StatePaused
+	// StateDraining represents a backend that gets no new flows but keeps its established ones
+	// until they close or the drain timeout runs out, after which it is paused
+	StateDraining
+)
+
+func (s BackendState) String() string {
+	switch s {
+	case StateActive:
+		return "Active"
+	case StatePaused:
+		return "Paused"
+	case StateDraining:
+		return "Draining"
+	}
+	return "Unknown"
+}
+
+// ParseBackendState parses the lowercase name of a state, as sent over the wire
+func ParseBackendState(s string) (BackendState, error) {
+	for _, state := range []BackendState{StateActive, StatePaused, StateDraining} {
+		if s == strings.ToLower(state.String()) {
+			return state, nil
+		}
+	}
+	return StateActive, errors.New("unknown state " + s)
+}
+
 type managedBackend struct {
-	name   string
-	dataIP net.IP
-	comm   util.Communicator
+	name       string
+	dataIP     net.IP
+	encap      Encap
+	weight     int
+	pool       *Pool
+	conn       *protocol.Conn
+	state      BackendState  // guarded by the manager's mux
+	since      time.Time     // when the backend registered
+	lastHealth time.Time     // when the backend last sent a health check
+	healthCode string        // status code of the last health check
+	healthNote string        // what the backend's probes found in the last health check
+	checkDown  bool          // paused by the pool's health check rather than by request
+	statusDown bool          // taken out by its own health reports rather than by request
+	passes     int           // healthy reports in a row
+	failures   int           // bad reports in a row
+	drainSeq   int           // bumped on every drain so stale drains don't pause the backend
+	stop       chan struct{} // closed on deregistration
+
+	labels       map[string]string // set by the backend when registering. version 2 only
+	capabilities []string          // advertised in the backend's HELLO. version 2 only
+}
+
+// BackendStatus describes a registered backend
+type BackendStatus struct {
+	Pool       string
+	Name       string
+	DataIP     net.IP
+	State      BackendState
+	Since      time.Time
+	LastHealth time.Time // zero if the backend never sent a health check
+	HealthCode string
+	HealthNote string // what the backend's probes found, if it said
+	CheckDown  bool   // paused by the pool's health check
+	StatusDown bool   // taken out by its own health reports
+	Protocol   int    // protocol version the backend speaks
+	Labels     map[string]string
 }
 
 // Manager contains the info needed to manage the backends
@@ -23,37 +102,124 @@ type Manager struct {
 	listener        net.Listener               // listener for new backends
 	listenIP        net.IP                     // ip to listen on
 	listenPort      int                        // port to listen on
-	handler         *Handler                   // handler for backends
-	managedBackends map[string]*managedBackend // map of backend name to its communicator
+	pools           map[string]*Pool           // map of pool name to pool
+	managedBackends map[string]*managedBackend // map of backend id to its communicator
+	registering     map[string]bool            // ids of backends in the middle of registering
+	mux             sync.Mutex                 // guards pools, managedBackends and registering
+	conns           *conntrack.Table           // flows pinned to backends. nil if not tracked
+	drainTimeout    time.Duration              // longest a backend stays draining before it is paused
+	tls             *tls.Config                // tls for the management protocol. plaintext if nil
+	batch           util.BatchConfig           // how packets to udp encapsulated backends are batched
 	readTimeout     int
 	writeTimeout    int
 }
 
-// NewManager instantiates a new instance of the Manager object
-func NewManager(ip net.IP, port, capacity, readTimeout, writeTimeout int) (*Manager, error) {
-	handler, err := NewHandler(capacity)
-
-	if err != nil {
-		return nil, err
-	}
-
+// NewManager instantiates a new instance of the Manager object. Draining backends are paused once
+// conns has no more flows pinned to them, or after drainTimeout. Backends connect over tls if
+// tlsConf is not nil. Packets to backends taking them over udp are sent in batches as batch says
+func NewManager(ip net.IP, port, readTimeout, writeTimeout int, drainTimeout time.Duration, conns *conntrack.Table, tlsConf *tls.Config, batch util.BatchConfig) *Manager {
 	return &Manager{
 		listenIP:        ip,
 		listenPort:      port,
-		handler:         handler,
+		pools:           make(map[string]*Pool),
 		managedBackends: make(map[string]*managedBackend),
+		registering:     make(map[string]bool),
+		conns:           conns,
+		drainTimeout:    drainTimeout,
+		tls:             tlsConf,
+		batch:           batch,
 		readTimeout:     readTimeout,
-		writeTimeout:    writeTimeout}, nil
+		writeTimeout:    writeTimeout}
+}
+
+// AddPool adds a pool that backends can register into by naming it or one of its VIPs. Throws
+// error if the name is already taken
+func (m *Manager) AddPool(pool *Pool) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if _, ok := m.pools[pool.name]; ok {
+		return errors.New("pool " + pool.name + " already exists")
+	}
+	m.pools[pool.name] = pool
+	m.reportBackendsLocked(pool)
+	return nil
+}
+
+// GetPools gets all the pools
+func (m *Manager) GetPools() []*Pool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	toReturn := make([]*Pool, 0, len(m.pools))
+	for _, pool := range m.pools {
+		toReturn = append(toReturn, pool)
+	}
+	return toReturn
+}
+
+// poolFor finds the pool a registering backend is joining, by name if given and by VIP otherwise.
+// Backends that name neither can only join when there is a single pool, and backends naming a VIP
+// shared by several pools have to name the pool
+func (m *Manager) poolFor(name, vip string) (*Pool, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if name != "" {
+		pool, ok := m.pools[name]
+		if !ok {
+			return nil, errors.New("pool " + name + " does not exist")
+		}
+		if vip != "" && !pool.serves(net.ParseIP(vip)) {
+			return nil, errors.New("pool " + name + " does not serve vip " + vip)
+		}
+		return pool, nil
+	}
+
+	if vip == "" {
+		if len(m.pools) != 1 {
+			return nil, errors.New("vip must be given when the balancer serves multiple vips")
+		}
+		for _, pool := range m.pools {
+			return pool, nil
+		}
+	}
+
+	ip := net.ParseIP(vip)
+	if ip == nil {
+		return nil, errors.New("vip not parseable")
+	}
+	var found *Pool
+	for _, pool := range m.pools {
+		if pool.serves(ip) {
+			if found != nil {
+				return nil, errors.New("vip " + vip + " is shared by several pools, pool must be given")
+			}
+			found = pool
+		}
+	}
+	if found == nil {
+		return nil, errors.New("vip " + vip + " is not served by this balancer")
+	}
+	return found, nil
+}
+
+// backendID identifies a backend across pools
+func backendID(pool, name string) string {
+	return pool + "/" + name
 }
 
 // Listen listens for new connections, registering them if needed
 func (m *Manager) Listen() {
 	// gonna have to gracefully close this bitch somehow
 	var err error
-	m.listener, err = net.Listen("tcp", m.listenIP.String()+":"+strconv.Itoa(m.listenPort))
+	m.listener, err = net.Listen("tcp", net.JoinHostPort(m.listenIP.String(), strconv.Itoa(m.listenPort)))
 	if err != nil {
 		log.Panicln(err)
 	}
+	if m.tls != nil {
+		m.listener = tls.NewListener(m.listener, m.tls)
+	}
 	for {
 		conn, err := m.listener.Accept()
 		if err != nil {
@@ -63,34 +229,93 @@ func (m *Manager) Listen() {
 	}
 }
 
-// Get gets the backend associated with a key
-func (m *Manager) Get(key string) (*Backend, error) {
-	return m.handler.Get(key)
+// GetBackends gets all the current backends of every pool
+func (m *Manager) GetBackends() []*Backend {
+	var toReturn []*Backend
+	for _, pool := range m.GetPools() {
+		toReturn = append(toReturn, pool.GetBackends()...)
+	}
+	return toReturn
 }
 
-// GetBackends gets all the current backends
-func (m *Manager) GetBackends() []*Backend {
-	return m.handler.GetBackends()
+// SetWeight changes the weight of a registered backend at runtime, resizing its share of
+// the maglev table if it is active. Throws error if the backend is not registered or the
+// weight is not positive
+func (m *Manager) SetWeight(pool, name string, weight int) error {
+	if weight < 1 {
+		return errors.New("weight must be positive")
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	back, ok := m.managedBackends[backendID(pool, name)]
+	if !ok {
+		return errors.New("backend " + name + " is not registered in pool " + pool)
+	}
+	handler := back.pool.handler
+	if back.state == StateActive {
+		err := handler.SetWeight(name, weight)
+		if err != nil {
+			return err
+		}
+	}
+	back.weight = weight
+	log.Infof("Set weight of %v in %v to %v\n", name, pool, weight)
+	return nil
 }
 
-// registration message should be in the following format:
-// REGISTER <desired_name> <ip>
-func (m *Manager) attemptRegister(conn net.Conn) {
-	comm := util.NewTCPCommunicator(conn, m.readTimeout, m.writeTimeout)
+// attemptRegister registers the backend connecting over netConn. It has to send a REGISTER, in
+// either protocol version, and answer the sanity check sent over its data path. With a key, udp
+// packets to the backend are authenticated with it. Keys are only taken as they are over tls.
+// Plaintext connections offer a key exchange in the HELLO instead
+func (m *Manager) attemptRegister(netConn net.Conn) {
+	var comm util.Communicator
+	var tlsComm *util.TLSCommunicator
+	tlsConn, secure := netConn.(*tls.Conn)
+	if secure {
+		tlsComm = util.NewTLSCommunicator(tlsConn, m.readTimeout, m.writeTimeout)
+		comm = tlsComm
+	} else {
+		comm = util.NewTCPCommunicator(netConn, m.readTimeout, m.writeTimeout)
+	}
 
-	response, err := comm.ReadLine()
+	var exchange *util.KeyExchange
+	offer := ""
+	if !secure {
+		var err error
+		exchange, err = util.NewKeyExchange()
+		if err != nil {
+			log.Errorln(err)
+			comm.Close()
+			return
+		}
+		offer = hex.EncodeToString(exchange.Public())
+	}
+	conn, hello, err := protocol.Accept(comm, protocol.Capabilities, offer)
 	if err != nil {
 		log.Debugln(err)
-		conn.Close()
+		comm.Close()
 		return
 	}
+	reject := func(req *protocol.Message, reason, detail string) {
+		metrics.RegistrationFailures.WithLabelValues(reason).Inc()
+		conn.Invalid(req, detail)
+		conn.Close()
+	}
 
-	response = strings.Trim(response, " \n\r\t\f")
-	tokens := strings.Split(response, " ")
-
-	if len(tokens) < 3 || tokens[0] != "REGISTER" {
-		comm.WriteLine("INVALID registration failed")
-		comm.Close()
+	req, err := conn.ReadMessage()
+	if _, ok := err.(*protocol.MalformedError); ok {
+		reject(nil, "invalid", err.Error())
+		return
+	}
+	if err != nil {
+		log.Debugln(err)
+		conn.Close()
+		return
+	}
+	if req.Type != protocol.Register || req.Name == "" {
+		reject(req, "invalid", "registration failed")
 		return
 	}
 
@@ -98,124 +323,764 @@ func (m *Manager) attemptRegister(conn net.Conn) {
 	if err != nil {
 		log.Panicln(err)
 	}
-	cleanedName := cleaner.ReplaceAllString(tokens[1], "")
+	cleanedName := cleaner.ReplaceAllString(req.Name, "")
 
-	ip := net.ParseIP(tokens[2])
+	// with a client ca every backend has a certificate, and can only register under a name it
+	// was issued to
+	if secure && m.tls.ClientCAs != nil {
+		err = tlsComm.VerifyName(cleanedName)
+		if err != nil {
+			reject(req, "identity", err.Error())
+			return
+		}
+	}
+
+	ip := net.ParseIP(req.DataIP)
 	if ip == nil {
-		comm.WriteLine("INVALID ip not parseable")
-		comm.Close()
+		reject(req, "invalid", "ip not parseable")
+		return
+	}
+
+	pool, err := m.poolFor(req.Pool, req.VIP)
+	if err != nil {
+		reject(req, "unknown_pool", err.Error())
+		return
+	}
+	handler := pool.handler
+
+	encap := Encap{Type: EncapUDP, Port: DataPort, Batch: m.batch}
+	if req.Encap != "" {
+		encap.Type = req.Encap
+	}
+	if req.Port != 0 {
+		if req.Port < 0 || req.Port > 65535 {
+			reject(req, "invalid", "port not parseable")
+			return
+		}
+		encap.Port = req.Port
+	}
+
+	// tunnels into backends of ipv6-only pools are only set up to carry ipv6, so control
+	// messages have to be too
+	if encap.Type != EncapUDP && len(pool.vips) > 0 && !util.HasIPv4(pool.vips) {
+		encap.Control = pool.vips[0]
+	}
+
+	if encap.Type == EncapUDP {
+		switch {
+		case req.Key != "" && !secure:
+			// the key was readable on the way here, so it authenticates nothing
+			reject(req, "invalid", "data key sent in plaintext. use tls or protocol version 2")
+			return
+		case req.Key != "":
+			encap.Auth, err = parseDataAuth(req.KeyID, req.Key)
+		case req.Exchange != "" && exchange != nil:
+			encap.Auth, err = exchangeDataAuth(exchange, req.KeyID, req.Exchange)
+		case req.Exchange != "":
+			err = errors.New("no key exchange offered")
+		}
+		if err != nil {
+			reject(req, "invalid", err.Error())
+			return
+		}
+	}
+
+	weight := 1
+	if req.Weight != 0 {
+		if req.Weight < 1 {
+			reject(req, "invalid", "weight must be a positive integer")
+			return
+		}
+		weight = req.Weight
+	}
+	if override, ok := pool.pinnedWeight(cleanedName); ok {
+		weight = override
+	}
+
+	// backends coming back after losing their connection ask for the state they were in
+	state := StateActive
+	if req.State != "" {
+		state, err = ParseBackendState(req.State)
+		if err != nil {
+			reject(req, "invalid", err.Error())
+			return
+		}
+	}
+
+	// the id stays reserved until the registration is done either way, so a second registration
+	// of the same name can't slip in between the check and the insert
+	id := backendID(pool.name, cleanedName)
+	m.mux.Lock()
+	_, exists := m.managedBackends[id]
+	if !exists && !m.registering[id] {
+		m.registering[id] = true
+	} else {
+		exists = true
+	}
+	m.mux.Unlock()
+	if exists {
+		reject(req, "duplicate", "backend "+cleanedName+" is already registered")
 		return
 	}
+	registered := false
+	defer func() {
+		if !registered {
+			m.mux.Lock()
+			delete(m.registering, id)
+			m.mux.Unlock()
+		}
+	}()
 
-	err = m.handler.Add(cleanedName, ip)
+	err = handler.Add(cleanedName, ip, encap, weight)
 	if err != nil {
+		metrics.RegistrationFailures.WithLabelValues("forwarder").Inc()
 		log.Infoln(err)
 		conn.Close()
 		return
 	}
+	if state != StateActive {
+		err = handler.Drain(cleanedName)
+		if err != nil {
+			log.Infoln(err)
+			conn.Close()
+			handler.Remove(cleanedName)
+			return
+		}
+	}
 
-	randString := randomString(16)
-	backHandle, _ := m.handler.Get(cleanedName)
-	backHandle.Writer.SendData([]byte("SANITY " + randString))
+	randString, err := newNonce()
+	if err != nil {
+		log.Errorln(err)
+		conn.Close()
+		handler.Remove(cleanedName)
+		return
+	}
+	backHandle := handler.GetByName(cleanedName)
+	backHandle.Writer.SendControl([]byte("SANITY " + randString))
 
-	sanityResponse, err := comm.ReadLine()
+	sanity, err := conn.ReadMessage()
 	if err != nil {
-		comm.WriteLine("INVALID error while trying to read sanity check")
+		metrics.RegistrationFailures.WithLabelValues("sanity").Inc()
+		conn.Invalid(nil, "error while trying to read sanity check")
 		conn.Close()
-		m.handler.Remove(cleanedName)
+		handler.Remove(cleanedName)
 		log.Infoln("Error while trying to sanity check: " + err.Error())
+		return
 	}
 
-	sanityTokens := strings.Split(sanityResponse, " ")
-	if len(sanityTokens) < 2 || sanityTokens[0] != "SANE" || sanityTokens[1] != randString {
-		comm.WriteLine("INVALID bad sanity check url")
+	if sanity.Type != protocol.Sane || sanity.Nonce != randString {
+		metrics.RegistrationFailures.WithLabelValues("sanity").Inc()
+		conn.Invalid(sanity, "bad sanity check url")
 		conn.Close()
-		m.handler.Remove(cleanedName)
+		handler.Remove(cleanedName)
 		log.Infoln("Client udp sanity check failed")
 		return
 	}
 
-	comm.WriteLine("REGISTERED " + cleanedName + " " + ip.String())
+	conn.Reply(req, &protocol.Message{Type: protocol.Registered, Name: cleanedName, DataIP: ip.String()})
 	back := &managedBackend{
 		name:   cleanedName,
 		dataIP: ip,
-		comm:   comm,
+		encap:  encap,
+		weight: weight,
+		pool:   pool,
+		conn:   conn,
+		labels: req.Labels,
+		state:  state,
+		since:  time.Now(),
+		stop:   make(chan struct{}),
+	}
+	if hello != nil {
+		back.capabilities = hello.Capabilities
 	}
 
-	m.managedBackends[cleanedName] = back
+	m.mux.Lock()
+	m.managedBackends[id] = back
+	delete(m.registering, id)
+	registered = true
+	if state == StateDraining {
+		back.drainSeq++
+		go m.finishDrain(back, back.drainSeq)
+	}
+	m.reportBackendsLocked(pool)
+	m.mux.Unlock()
+	log.Infof("Registered %v in pool %v over protocol version %v\n", cleanedName, pool.name, conn.Version())
 
-	m.monitor(cleanedName)
+	if pool.check != nil {
+		go m.runHealthCheck(back)
+	}
+
+	m.monitor(back)
 }
 
-func (m *Manager) monitor(name string) {
-	back := m.managedBackends[name]
-	comm := back.comm
+func (m *Manager) monitor(back *managedBackend) {
+	name := back.name
+	conn := back.conn
 	for {
-		message, err := comm.ReadLine()
+		req, err := conn.ReadMessage()
+		if _, ok := err.(*protocol.MalformedError); ok {
+			conn.Invalid(nil, err.Error())
+			continue
+		}
 		if err != nil {
+			if !m.isRegistered(back) {
+				// evicted from the balancer side
+				return
+			}
 			if errChk, ok := err.(net.Error); ok && errChk.Timeout() {
+				metrics.HealthTimeouts.Inc()
 				log.Warnln(err)
-				m.deregisterClient(name, "health check timeout ran out")
+				m.deregisterClient(back, "health check timeout ran out")
 			} else {
 				log.Warnln(err)
-				m.deregisterClient(name, "error reading from tcp connection: "+err.Error())
+				m.deregisterClient(back, "error reading from tcp connection: "+err.Error())
 			}
 			return
 		}
 
-		tokens := strings.Split(message, " ")
-		if len(tokens) < 1 {
-			comm.WriteLine("INVALID empty message")
-			continue
-		}
-
-		switch tokens[0] {
-		case "DEREGISTER":
-			m.deregisterClient(name, "client requested deregistration")
+		switch req.Type {
+		case protocol.Deregister:
+			m.deregisterClient(back, "client requested deregistration")
 			return
 
-		case "PAUSE":
-			err := m.handler.Remove(name)
+		case protocol.Pause:
+			err := m.pause(back)
 			if err != nil {
-				comm.WriteLine("INVALID backend already paused")
+				conn.Invalid(req, err.Error())
 			} else {
-				comm.WriteLine("PAUSED " + name)
+				conn.Reply(req, &protocol.Message{Type: protocol.Paused, Name: name})
 			}
 
-		case "RESUME":
-			err := m.handler.Add(name, back.dataIP)
+		case protocol.Resume:
+			err := m.resume(back)
 			if err != nil {
-				comm.WriteLine("INVALID backend already active")
+				conn.Invalid(req, err.Error())
 			} else {
-				comm.WriteLine("RESUMED " + name)
+				conn.Reply(req, &protocol.Message{Type: protocol.Resumed, Name: name})
 			}
 
-		case "HEALTH":
-			if len(tokens) < 2 {
-				comm.WriteLine("INVALID no status code in health check")
+		case protocol.Drain:
+			err := m.drain(back)
+			if err != nil {
+				conn.Invalid(req, err.Error())
+			} else {
+				conn.Reply(req, &protocol.Message{Type: protocol.Draining, Name: name})
+			}
+
+		case protocol.Weight:
+			if _, ok := back.pool.pinnedWeight(name); ok {
+				conn.Invalid(req, "weight is pinned by balancer config")
+				continue
+			}
+			err = m.SetWeight(back.pool.name, name, req.Weight)
+			if err != nil {
+				conn.Invalid(req, err.Error())
 			} else {
-				comm.WriteLine("HEALTHACK 200")
+				conn.Reply(req, &protocol.Message{Type: protocol.Weighted, Name: name, Weight: req.Weight})
+			}
+
+		case protocol.Health:
+			state := m.reportStatus(back, req.Code, req.Detail)
+			ack := http.StatusOK
+			if state != StateActive {
+				ack = http.StatusServiceUnavailable
 			}
+			conn.Reply(req, &protocol.Message{Type: protocol.HealthAck, Code: ack, State: strings.ToLower(state.String())})
 
 		default:
-			comm.WriteLine("INVALID first token of message (" + tokens[0] + ") is not an option")
+			conn.Invalid(req, "first token of message ("+req.Type+") is not an option")
 		}
 	}
 }
 
-func randomString(len int) string {
-	bytes := make([]byte, len)
-	for i := 0; i < len; i++ {
-		bytes[i] = byte(65 + rand.Intn(25)) //A=65 and Z = 65+25
+// pause stops new flows from going to a backend, leaving the flows pinned to it be. Throws error
+// if it is already paused
+func (m *Manager) pause(back *managedBackend) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
 
+	if back.state == StatePaused {
+		return errors.New("backend already paused")
+	}
+	err := m.pauseLocked(back, false)
+	if err != nil {
+		return err
 	}
-	return string(bytes)
+	back.checkDown = false
+	back.statusDown = false
+	m.reportBackendsLocked(back.pool)
+	return nil
 }
 
-func (m *Manager) deregisterClient(name, reason string) {
-	m.handler.Remove(name)
-	comm := m.managedBackends[name].comm
-	comm.WriteLine("DEREGISTERED " + name + " " + reason)
-	comm.Close()
-	log.Infoln("Deregistered " + name)
+// pauseLocked takes a backend out of its pool's maglev table but keeps it reachable by name, so
+// flows pinned to it keep going to it unless evict is set. m.mux must be held
+func (m *Manager) pauseLocked(back *managedBackend, evict bool) error {
+	// draining backends are already out of the maglev table
+	if back.state == StateActive {
+		err := back.pool.handler.Drain(back.name)
+		if err != nil {
+			return err
+		}
+	}
+	if evict && m.conns != nil {
+		m.conns.Evict(backendID(back.pool.name, back.name))
+	}
+	back.state = StatePaused
+	return nil
+}
+
+// resume puts a paused or draining backend back into its pool. Throws error if it is already active
+func (m *Manager) resume(back *managedBackend) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if back.state == StateActive {
+		return errors.New("backend already active")
+	}
+	err := back.pool.handler.Undrain(back.name, back.weight)
+	if err != nil {
+		return err
+	}
+	back.state = StateActive
+	back.checkDown = false
+	back.statusDown = false
+	m.reportBackendsLocked(back.pool)
+	return nil
+}
+
+// drain stops new flows from being hashed to a backend, leaving its established flows be.
+// Throws error if the backend is not active, or there is no flow table to keep its flows in
+func (m *Manager) drain(back *managedBackend) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if back.state != StateActive {
+		return errors.New("backend is " + strings.ToLower(back.state.String()) + ", not active")
+	}
+	err := m.startDrainLocked(back)
+	if err != nil {
+		return err
+	}
+	back.checkDown = false
+	back.statusDown = false
+	return nil
+}
+
+// startDrainLocked drains an active backend and pauses it once it is done. Without a flow table
+// the maglev table is all that keeps flows with a backend, so there is nothing to drain and it
+// throws error. m.mux must be held
+func (m *Manager) startDrainLocked(back *managedBackend) error {
+	if m.conns == nil {
+		return errors.New("draining needs connection tracking, which is off. pause the backend instead")
+	}
+	err := back.pool.handler.Drain(back.name)
+	if err != nil {
+		return err
+	}
+	back.state = StateDraining
+	back.drainSeq++
+	m.reportBackendsLocked(back.pool)
+	go m.finishDrain(back, back.drainSeq)
+	return nil
+}
+
+// finishDrain waits for a draining backend's flows to close or the drain timeout to run out, then
+// pauses it and tells it so. Flows still open at the timeout are hashed to other backends. Gives
+// up if the backend leaves the draining state in the meantime. Without a flow table, which only
+// backends registering as draining get here with, there are no flows to wait for
+func (m *Manager) finishDrain(back *managedBackend, seq int) {
+	deadline := time.Now().Add(m.drainTimeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for m.conns != nil && m.conns.Count(backendID(back.pool.name, back.name)) > 0 && time.Now().Before(deadline) {
+		select {
+		case <-back.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+
+	m.mux.Lock()
+	if back.state != StateDraining || back.drainSeq != seq || !m.isRegisteredLocked(back) {
+		m.mux.Unlock()
+		return
+	}
+	m.pauseLocked(back, true)
+	m.reportBackendsLocked(back.pool)
+	m.mux.Unlock()
+
+	log.Infof("Drained %v in %v\n", back.name, back.pool.name)
+	back.conn.WriteMessage(&protocol.Message{Type: protocol.Paused, Name: back.name})
+}
+
+// reportStatus records a status code a backend reported about itself and acts on it: after
+// enough bad reports in a row, overloaded backends are drained and unhealthy ones are paused, and
+// after enough healthy reports in a row backends taken out this way are put back. Only active
+// backends and ones taken out by their reports are acted on. Returns the resulting state of the
+// backend
+func (m *Manager) reportStatus(back *managedBackend, code int, note string) BackendState {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	back.lastHealth = time.Now()
+	back.healthCode = strconv.Itoa(code)
+	back.healthNote = note
+	policy := back.pool.status
+
+	verdict := classifyStatus(code)
+	if verdict == verdictHealthy {
+		back.failures = 0
+		back.passes++
+		// backends also failing the pool's health check stay out until that passes
+		if !back.statusDown || back.checkDown || back.passes < policy.Rise {
+			return back.state
+		}
+		if back.state == StateActive {
+			back.statusDown = false
+			return back.state
+		}
+		err := back.pool.handler.Undrain(back.name, back.weight)
+		if err != nil {
+			log.Warnln(err)
+			return back.state
+		}
+		log.Infof("Put %v in %v back after healthy reports\n", back.name, back.pool.name)
+		back.state = StateActive
+		back.statusDown = false
+		m.reportBackendsLocked(back.pool)
+		return back.state
+	}
+
+	back.passes = 0
+	back.failures++
+	// backends paused or drained by request or by the health check are left to whoever took
+	// them out
+	if back.failures < policy.Fall || (back.state != StateActive && !back.statusDown) {
+		return back.state
+	}
+	var err error
+	switch {
+	case verdict == verdictOverloaded && back.state == StateActive && m.conns != nil:
+		err = m.startDrainLocked(back)
+	// without connection tracking there is no draining, so overloaded backends are paused too
+	case (verdict == verdictUnhealthy || m.conns == nil) && back.state != StatePaused:
+		err = m.pauseLocked(back, true)
+	default:
+		return back.state
+	}
+	if err != nil {
+		log.Warnln(err)
+		return back.state
+	}
+	log.Warnf("%v %v in %v after reporting status %v\n", back.state, back.name, back.pool.name, code)
+	back.statusDown = true
+	m.reportBackendsLocked(back.pool)
+	return back.state
+}
+
+// runHealthCheck probes a backend with its pool's health check until it deregisters. Backends
+// are paused after Fall failures in a row and resumed after Rise passes in a row, unless they
+// were paused by request in the meantime
+func (m *Manager) runHealthCheck(back *managedBackend) {
+	check := back.pool.check
+	ticker := time.NewTicker(check.Interval)
+	defer ticker.Stop()
+
+	passes, failures := 0, 0
+	for {
+		select {
+		case <-back.stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := check.probe(back.dataIP)
+		if err != nil {
+			log.Debugf("Health check of %v in %v failed: %v\n", back.name, back.pool.name, err)
+			metrics.HealthCheckFailures.WithLabelValues(back.pool.name).Inc()
+			passes = 0
+			failures++
+			if failures >= check.Fall {
+				m.checkFailed(back, err)
+			}
+		} else {
+			failures = 0
+			passes++
+			if passes >= check.Rise {
+				m.checkPassed(back)
+			}
+		}
+	}
+}
+
+// checkFailed pauses a backend that is failing its health check and tells it so. Its pinned flows
+// are hashed to other backends
+func (m *Manager) checkFailed(back *managedBackend, reason error) {
+	m.mux.Lock()
+	if back.state == StatePaused || !m.isRegisteredLocked(back) {
+		m.mux.Unlock()
+		return
+	}
+	err := m.pauseLocked(back, true)
+	if err != nil {
+		m.mux.Unlock()
+		log.Warnln(err)
+		return
+	}
+	back.checkDown = true
+	m.reportBackendsLocked(back.pool)
+	m.mux.Unlock()
+
+	log.Warnf("Paused %v in %v after failing health checks: %v\n", back.name, back.pool.name, reason)
+	back.conn.WriteMessage(&protocol.Message{Type: protocol.Paused, Name: back.name})
+}
+
+// checkPassed resumes a backend paused by its health check once it passes again and tells it so
+func (m *Manager) checkPassed(back *managedBackend) {
+	m.mux.Lock()
+	if !back.checkDown || back.state != StatePaused || !m.isRegisteredLocked(back) {
+		m.mux.Unlock()
+		return
+	}
+	err := back.pool.handler.Undrain(back.name, back.weight)
+	if err != nil {
+		m.mux.Unlock()
+		log.Warnln(err)
+		return
+	}
+	back.state = StateActive
+	back.checkDown = false
+	m.reportBackendsLocked(back.pool)
+	m.mux.Unlock()
+
+	log.Infof("Resumed %v in %v after passing health checks\n", back.name, back.pool.name)
+	back.conn.WriteMessage(&protocol.Message{Type: protocol.Resumed, Name: back.name})
+}
+
+// isRegistered returns whether back is still the registered backend for its id
+func (m *Manager) isRegistered(back *managedBackend) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.isRegisteredLocked(back)
+}
+
+// isRegisteredLocked is isRegistered for callers already holding m.mux
+func (m *Manager) isRegisteredLocked(back *managedBackend) bool {
+	return m.managedBackends[backendID(back.pool.name, back.name)] == back
+}
+
+// find finds a registered backend by its id, or by its name alone if only one pool has a
+// backend by that name
+func (m *Manager) find(id string) (*managedBackend, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if back, ok := m.managedBackends[id]; ok {
+		return back, nil
+	}
+	var found *managedBackend
+	for _, back := range m.managedBackends {
+		if back.name != id {
+			continue
+		}
+		if found != nil {
+			return nil, errors.New("backend " + id + " is registered in several pools, use <pool>/<name>")
+		}
+		found = back
+	}
+	if found == nil {
+		return nil, errors.New("backend " + id + " is not registered")
+	}
+	return found, nil
+}
+
+// Statuses describes every registered backend, sorted by pool and name
+func (m *Manager) Statuses() []BackendStatus {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	ids := make([]string, 0, len(m.managedBackends))
+	for id := range m.managedBackends {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	statuses := make([]BackendStatus, 0, len(ids))
+	for _, id := range ids {
+		back := m.managedBackends[id]
+		statuses = append(statuses, BackendStatus{
+			Pool:       back.pool.name,
+			Name:       back.name,
+			DataIP:     back.dataIP,
+			State:      back.state,
+			Since:      back.since,
+			LastHealth: back.lastHealth,
+			HealthCode: back.healthCode,
+			HealthNote: back.healthNote,
+			CheckDown:  back.checkDown,
+			StatusDown: back.statusDown,
+			Protocol:   back.conn.Version(),
+			Labels:     back.labels,
+		})
+	}
+	return statuses
+}
+
+// PauseBackend pauses the backend with the given id from the balancer side and tells it so
+func (m *Manager) PauseBackend(id string) error {
+	back, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	err = m.pause(back)
+	if err != nil {
+		return err
+	}
+	log.Infoln("Paused " + back.name + " in pool " + back.pool.name)
+	return back.conn.WriteMessage(&protocol.Message{Type: protocol.Paused, Name: back.name})
+}
+
+// ResumeBackend resumes the backend with the given id from the balancer side and tells it so
+func (m *Manager) ResumeBackend(id string) error {
+	back, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	err = m.resume(back)
+	if err != nil {
+		return err
+	}
+	log.Infoln("Resumed " + back.name + " in pool " + back.pool.name)
+	return back.conn.WriteMessage(&protocol.Message{Type: protocol.Resumed, Name: back.name})
+}
+
+// DrainBackend drains the backend with the given id from the balancer side and tells it so
+func (m *Manager) DrainBackend(id string) error {
+	back, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	err = m.drain(back)
+	if err != nil {
+		return err
+	}
+	log.Infoln("Draining " + back.name + " in pool " + back.pool.name)
+	return back.conn.WriteMessage(&protocol.Message{Type: protocol.Draining, Name: back.name})
+}
+
+// EvictBackend deregisters the backend with the given id from the balancer side
+func (m *Manager) EvictBackend(id string) error {
+	back, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	m.deregisterClient(back, "evicted by balancer")
+	return nil
+}
+
+// Replicate puts the backend with the given id in the state the leader of a pair has it in, so
+// the standby takes over with the same pools. The backend isn't told, the leader already did.
+// Backends taken out by failing health have their flows evicted like on the leader
+func (m *Manager) Replicate(id string, state BackendState, checkDown, statusDown bool) error {
+	back, err := m.find(id)
+	if err != nil {
+		return err
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if back.state != state {
+		switch state {
+		case StateActive:
+			err = back.pool.handler.Undrain(back.name, back.weight)
+			if err != nil {
+				return err
+			}
+			back.state = StateActive
+		case StatePaused:
+			err = m.pauseLocked(back, checkDown || statusDown)
+			if err != nil {
+				return err
+			}
+		case StateDraining:
+			// paused backends are already out of the maglev table
+			if back.state == StateActive {
+				err = back.pool.handler.Drain(back.name)
+				if err != nil {
+					return err
+				}
+			}
+			back.state = StateDraining
+			back.drainSeq++
+			go m.finishDrain(back, back.drainSeq)
+		}
+	}
+	back.checkDown = checkDown
+	back.statusDown = statusDown
+	m.reportBackendsLocked(back.pool)
+	return nil
+}
+
+// reportBackendsLocked updates the backend gauges of a pool. m.mux must be held
+func (m *Manager) reportBackendsLocked(pool *Pool) {
+	counts := make(map[BackendState]int)
+	for _, back := range m.managedBackends {
+		if back.pool == pool {
+			counts[back.state]++
+		}
+	}
+	for _, state := range []BackendState{StateActive, StatePaused, StateDraining} {
+		metrics.Backends.WithLabelValues(pool.name, strings.ToLower(state.String())).Set(float64(counts[state]))
+	}
+}
+
+// newNonce returns an unguessable hex string for sanity checks
+func newNonce() (string, error) {
+	raw := make([]byte, 16)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// parseDataAuth parses the key a backend registered with
+func parseDataAuth(id uint32, rawKey string) (*util.DataAuth, error) {
+	key, err := hex.DecodeString(rawKey)
+	if err != nil {
+		return nil, errors.New("key not parseable")
+	}
+	return util.NewDataAuth(id, key)
+}
+
+// exchangeDataAuth derives the key a backend registered with from the public key it answered our
+// exchange with
+func exchangeDataAuth(exchange *util.KeyExchange, id uint32, rawPublic string) (*util.DataAuth, error) {
+	public, err := hex.DecodeString(rawPublic)
+	if err != nil {
+		return nil, errors.New("exchange key not parseable")
+	}
+	return exchange.DataAuth(id, public)
+}
+
+func (m *Manager) deregisterClient(back *managedBackend, reason string) {
+	id := backendID(back.pool.name, back.name)
+	m.mux.Lock()
+	if m.managedBackends[id] != back {
+		// already deregistered
+		m.mux.Unlock()
+		return
+	}
+	back.pool.handler.Remove(back.name)
+	if m.conns != nil {
+		m.conns.Evict(backendID(back.pool.name, back.name))
+	}
+	delete(m.managedBackends, id)
+	close(back.stop)
+	m.reportBackendsLocked(back.pool)
+	m.mux.Unlock()
+	metrics.ForgetBackend(back.pool.name, back.name)
+	back.conn.WriteMessage(&protocol.Message{Type: protocol.Deregistered, Name: back.name, Detail: reason})
+	back.conn.Close()
+	log.Infoln("Deregistered " + back.name + " from pool " + back.pool.name)
 }
@@ -0,0 +1,131 @@
+package backends
+
+import (
+	"net"
+	"strings"
+)
+
+// Pool is a set of backends serving the same VIPs, with its own maglev table
+type Pool struct {
+	name    string
+	vips    []net.IP
+	handler *Handler
+	weights map[string]int // weights from config, overriding what backends advertise
+	check   *HealthCheck   // probe run against every backend. nil if none
+	status  StatusPolicy   // how backends' own health reports are acted on
+}
+
+// NewPool creates a new Pool serving vips. weights maps backend names to weights that take
+// precedence over the ones backends advertise when registering. Backends failing check are
+// taken out of the pool if it is not nil, and backends reporting bad health are taken out as
+// status says. Throws error if capacity is not prime or check is invalid
+func NewPool(name string, vips []net.IP, capacity int, weights map[string]int, check *HealthCheck, status StatusPolicy) (*Pool, error) {
+	if check != nil {
+		err := check.validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	handler, err := NewHandler(capacity)
+	if err != nil {
+		return nil, err
+	}
+	handler.pool = name
+
+	if status.Rise < 1 {
+		status.Rise = 1
+	}
+	if status.Fall < 1 {
+		status.Fall = 1
+	}
+
+	// config keys come in lowercased, so match names case insensitively
+	lowered := make(map[string]int)
+	for backend, weight := range weights {
+		lowered[strings.ToLower(backend)] = weight
+	}
+
+	return &Pool{
+		name:    name,
+		vips:    vips,
+		handler: handler,
+		weights: lowered,
+		check:   check,
+		status:  status}, nil
+}
+
+// Name returns the name of the pool
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// VIPs returns the VIPs the pool serves
+func (p *Pool) VIPs() []net.IP {
+	return p.vips
+}
+
+// Get gets the backend associated with a key
+func (p *Pool) Get(key string) (*Backend, error) {
+	return p.handler.Get(key)
+}
+
+// Lookup gets the backend associated with a key held in a byte slice. It doesn't allocate
+func (p *Pool) Lookup(key []byte) (*Backend, error) {
+	return p.handler.Lookup(key)
+}
+
+// GetByName gets the active backend registered under name. Returns nil if there is none
+func (p *Pool) GetByName(name string) *Backend {
+	return p.handler.GetByName(name)
+}
+
+// GetByID gets the backend of the pool with the given id. Returns nil if there is no such backend.
+// It doesn't allocate
+func (p *Pool) GetByID(id string) *Backend {
+	n := len(p.name)
+	if len(id) <= n || id[:n] != p.name || id[n] != '/' {
+		return nil
+	}
+	return p.handler.GetByName(id[n+1:])
+}
+
+// Fingerprint identifies the pool's maglev table
+func (p *Pool) Fingerprint() string {
+	return p.handler.Fingerprint()
+}
+
+// Slots returns the name of the backend owning each slot of the pool's maglev table
+func (p *Pool) Slots() []string {
+	return p.handler.Slots()
+}
+
+// Capacity returns the size of the pool's maglev table
+func (p *Pool) Capacity() int {
+	return p.handler.Capacity()
+}
+
+// OnChange sets f to be called whenever the pool's maglev table changes
+func (p *Pool) OnChange(f func()) {
+	p.handler.OnChange(f)
+}
+
+// GetBackends gets all the active backends in the pool
+func (p *Pool) GetBackends() []*Backend {
+	return p.handler.GetBackends()
+}
+
+// serves returns whether vip is one of the pool's VIPs
+func (p *Pool) serves(vip net.IP) bool {
+	for _, ip := range p.vips {
+		if ip.Equal(vip) {
+			return true
+		}
+	}
+	return false
+}
+
+// pinnedWeight returns the weight config pins the named backend to, if any
+func (p *Pool) pinnedWeight(name string) (int, bool) {
+	weight, ok := p.weights[strings.ToLower(name)]
+	return weight, ok
+}
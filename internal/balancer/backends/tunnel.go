@@ -0,0 +1,164 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// TunnelForwarder is an implementation of PacketForwarder that hands packets to
+// a kernel ipip or gre tunnel device pointed at the backend. The backend only
+// needs standard kernel tunnel decapsulation to receive them
+type TunnelForwarder struct {
+	links []netlink.Link // tunnel devices owned by this forwarder
+	fd    int            // packet socket for writing straight into the tunnel devices
+	addr4 *syscall.SockaddrLinklayer
+	addr6 *syscall.SockaddrLinklayer
+	local net.IP // balancer side of the tunnel
+	ip    net.IP // backend side of the tunnel
+
+	control  net.IP // inner destination of control messages. ip if nil
+	counters forwardCounters
+}
+
+// NewTunnelForwarder creates the tunnel devices for a backend named name at ip and a
+// forwarder writing into them. encapType must be EncapIPIP or EncapGRE. An ipip tunnel
+// only carries ipv4, so ipv6 packets go through a sit tunnel next to it, which is what
+// the client decapsulates them with. name must be unique across pools
+func NewTunnelForwarder(name string, ip net.IP, encapType string) (*TunnelForwarder, error) {
+	local, err := localAddrFor(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	var link4, link6 netlink.Link
+	switch encapType {
+	case EncapIPIP:
+		if ip.To4() == nil {
+			return nil, errors.New("ipip needs an ipv4 backend ip")
+		}
+		link4 = &netlink.Iptun{LinkAttrs: netlink.LinkAttrs{Name: tunnelName(name, EncapIPIP)}, Local: local, Remote: ip}
+		link6 = &netlink.Sittun{LinkAttrs: netlink.LinkAttrs{Name: tunnelName(name, "sit")}, Local: local, Remote: ip}
+	case EncapGRE:
+		// gre carries either family
+		link4 = &netlink.Gretun{LinkAttrs: netlink.LinkAttrs{Name: tunnelName(name, EncapGRE)}, Local: local, Remote: ip}
+		link6 = link4
+	default:
+		return nil, errors.New("encapsulation " + encapType + " is not a tunnel")
+	}
+
+	f := &TunnelForwarder{fd: -1, local: local, ip: ip}
+	index4, err := f.addLink(link4)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	index6 := index4
+	if link6 != link4 {
+		index6, err = f.addLink(link6)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	f.fd, err = syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.addr4 = &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_IP), Ifindex: index4}
+	f.addr6 = &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_IPV6), Ifindex: index6}
+
+	return f, nil
+}
+
+// addLink creates a tunnel device for f and brings it up. Returns its index
+func (f *TunnelForwarder) addLink(link netlink.Link) (int, error) {
+	err := netlink.LinkAdd(link)
+	if err != nil {
+		return 0, err
+	}
+	f.links = append(f.links, link)
+
+	err = netlink.LinkSetUp(link)
+	if err != nil {
+		return 0, err
+	}
+	// LinkAdd doesn't fill in the index, so look the device back up
+	created, err := netlink.LinkByName(link.Attrs().Name)
+	if err != nil {
+		return 0, err
+	}
+	return created.Attrs().Index, nil
+}
+
+// SendData writes the packet into the tunnel device, which encapsulates it
+func (f *TunnelForwarder) SendData(data []byte) error {
+	err := f.send(data)
+	if err == nil {
+		f.counters.sent(len(data))
+	}
+	return err
+}
+
+func (f *TunnelForwarder) send(data []byte) error {
+	addr := f.addr4
+	if len(data) > 0 && data[0]>>4 == 6 {
+		addr = f.addr6
+	}
+	return syscall.Sendto(f.fd, data, 0, addr)
+}
+
+// SendControl wraps a control message in an inner ip/udp packet addressed to the
+// client's data port and sends it through the tunnel
+func (f *TunnelForwarder) SendControl(data []byte) error {
+	packet, err := controlPacket(f.local, f.ip, f.control, data)
+	if err != nil {
+		return err
+	}
+	return f.send(packet)
+}
+
+// Close closes the packet socket and destroys the tunnel devices
+func (f *TunnelForwarder) Close() error {
+	if f.fd >= 0 {
+		syscall.Close(f.fd)
+		f.fd = -1
+	}
+	var err error
+	for _, link := range f.links {
+		if delErr := netlink.LinkDel(link); delErr != nil {
+			err = delErr
+		}
+	}
+	f.links = nil
+	return err
+}
+
+// tunnelName derives a device name for a backend's tunnel that fits in IFNAMSIZ
+func tunnelName(name, encapType string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("cpl%s%08x", encapType, h.Sum32())
+}
+
+// localAddrFor finds the source address the kernel would use to reach ip.
+// dialing udp doesn't send anything, it only resolves the route
+func localAddrFor(ip net.IP) (net.IP, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(ip.String(), strconv.Itoa(DataPort)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func htons(i uint16) uint16 {
+	return (i<<8)&0xff00 | i>>8
+}
@@ -0,0 +1,275 @@
+package conntrack
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const numShards = 64
+
+// Key identifies a flow by its 5-tuple. IPv4 addresses are stored in their
+// IPv4-in-IPv6 form so both families fit in the same fixed-size key
+type Key struct {
+	Proto   uint8
+	SrcIP   [16]byte
+	DstIP   [16]byte
+	SrcPort uint16
+	DstPort uint16
+}
+
+// NewKey creates a Key from the parts of a 5-tuple
+func NewKey(proto uint8, srcIP, dstIP net.IP, srcPort, dstPort uint16) Key {
+	k := Key{Proto: proto, SrcPort: srcPort, DstPort: dstPort}
+	copy(k.SrcIP[:], srcIP.To16())
+	copy(k.DstIP[:], dstIP.To16())
+	return k
+}
+
+// Hash is a cheap hash of the flow, for spreading flows over shards and workers. It covers the
+// whole 5-tuple, so flows that only differ in an ipv6 prefix, or in where they go, spread as well
+func (k *Key) Hash() uint32 {
+	// fnv-1a
+	h := uint32(2166136261)
+	for _, b := range k.SrcIP {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	for _, b := range k.DstIP {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	for _, b := range [5]byte{k.Proto, byte(k.SrcPort >> 8), byte(k.SrcPort), byte(k.DstPort >> 8), byte(k.DstPort)} {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	return h
+}
+
+func (k *Key) shard() int {
+	return int(k.Hash() % numShards)
+}
+
+type entry struct {
+	backend  string // id of the backend the flow is pinned to
+	count    *int64 // flows pinned to backend, shared with the other entries of backend
+	lastSeen int64  // unix nanos of the last packet in the flow
+	closing  bool   // set once a FIN has been seen
+}
+
+type shard struct {
+	entries map[Key]*entry
+	mux     sync.Mutex
+}
+
+// Table is a bounded, concurrent connection tracking table pinning flows to the
+// backend they were first sent to
+type Table struct {
+	shards         [numShards]shard
+	maxPerShard    int
+	tcpTimeout     int64 // idle timeout for open tcp flows in nanos
+	udpTimeout     int64 // idle timeout for udp flows in nanos
+	closingTimeout int64 // idle timeout for tcp flows after a FIN in nanos
+
+	counts   map[string]*int64 // number of flows pinned to each backend, updated atomically
+	countMux sync.RWMutex      // guards the counts map, not the counts themselves
+}
+
+// New creates a new Table holding at most maxEntries flows. Flows that go idle
+// for longer than their timeout are forgotten
+func New(maxEntries int, tcpTimeout, udpTimeout, closingTimeout time.Duration) *Table {
+	perShard := maxEntries / numShards
+	if perShard < 1 {
+		perShard = 1
+	}
+	t := &Table{
+		maxPerShard:    perShard,
+		tcpTimeout:     int64(tcpTimeout),
+		udpTimeout:     int64(udpTimeout),
+		closingTimeout: int64(closingTimeout),
+		counts:         make(map[string]*int64)}
+	for i := range t.shards {
+		t.shards[i].entries = make(map[Key]*entry)
+	}
+	return t
+}
+
+// counter returns the count of flows pinned to backend, creating it on first use
+func (t *Table) counter(backend string) *int64 {
+	t.countMux.RLock()
+	c, ok := t.counts[backend]
+	t.countMux.RUnlock()
+	if ok {
+		return c
+	}
+	t.countMux.Lock()
+	defer t.countMux.Unlock()
+	c, ok = t.counts[backend]
+	if !ok {
+		c = new(int64)
+		t.counts[backend] = c
+	}
+	return c
+}
+
+// remove forgets the flow k. The shard's lock must be held
+func (t *Table) remove(s *shard, k Key, e *entry) {
+	delete(s.entries, k)
+	atomic.AddInt64(e.count, -1)
+}
+
+func (t *Table) timeout(k *Key, e *entry) int64 {
+	if k.Proto != protoTCP {
+		return t.udpTimeout
+	}
+	if e.closing {
+		return t.closingTimeout
+	}
+	return t.tcpTimeout
+}
+
+// Get returns the backend a flow is pinned to and refreshes the flow. Returns false
+// if the flow is not tracked or has gone idle
+func (t *Table) Get(k Key) (string, bool) {
+	s := &t.shards[k.shard()]
+	now := time.Now().UnixNano()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	e, ok := s.entries[k]
+	if !ok {
+		return "", false
+	}
+	if now-e.lastSeen > t.timeout(&k, e) {
+		t.remove(s, k, e)
+		return "", false
+	}
+	e.lastSeen = now
+	return e.backend, true
+}
+
+// Put pins a flow to a backend. Returns false if the table is full, in which case
+// the flow is left to consistent hashing
+func (t *Table) Put(k Key, backend string) bool {
+	s := &t.shards[k.shard()]
+	now := time.Now().UnixNano()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if e, ok := s.entries[k]; ok {
+		if e.backend != backend {
+			atomic.AddInt64(e.count, -1)
+			e.backend, e.count = backend, t.counter(backend)
+			atomic.AddInt64(e.count, 1)
+		}
+		e.lastSeen = now
+		e.closing = false
+		return true
+	}
+	if len(s.entries) >= t.maxPerShard {
+		t.expireShard(s, now)
+		if len(s.entries) >= t.maxPerShard {
+			return false
+		}
+	}
+	e := &entry{backend: backend, count: t.counter(backend), lastSeen: now}
+	s.entries[k] = e
+	atomic.AddInt64(e.count, 1)
+	return true
+}
+
+// Closing marks a tcp flow as shutting down after a FIN, shortening its timeout
+func (t *Table) Closing(k Key) {
+	s := &t.shards[k.shard()]
+	s.mux.Lock()
+	if e, ok := s.entries[k]; ok {
+		e.closing = true
+	}
+	s.mux.Unlock()
+}
+
+// Delete forgets a flow, e.g. after a RST
+func (t *Table) Delete(k Key) {
+	s := &t.shards[k.shard()]
+	s.mux.Lock()
+	if e, ok := s.entries[k]; ok {
+		t.remove(s, k, e)
+	}
+	s.mux.Unlock()
+}
+
+// Len returns the number of tracked flows, including ones that have gone idle
+// but haven't been expired yet
+func (t *Table) Len() int {
+	total := 0
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mux.Lock()
+		total += len(s.entries)
+		s.mux.Unlock()
+	}
+	return total
+}
+
+// Count returns the number of flows pinned to backend, including ones that have gone idle but
+// haven't been expired yet. It is kept up to date as flows come and go, so it is cheap to poll
+func (t *Table) Count(backend string) int {
+	t.countMux.RLock()
+	c, ok := t.counts[backend]
+	t.countMux.RUnlock()
+	if !ok {
+		return 0
+	}
+	return int(atomic.LoadInt64(c))
+}
+
+// Evict forgets every flow pinned to backend, so they get hashed again
+func (t *Table) Evict(backend string) {
+	if t.Count(backend) == 0 {
+		return
+	}
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mux.Lock()
+		for k, e := range s.entries {
+			if e.backend == backend {
+				t.remove(s, k, e)
+			}
+		}
+		s.mux.Unlock()
+	}
+}
+
+// Expire drops every flow that has gone idle
+func (t *Table) Expire() {
+	now := time.Now().UnixNano()
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mux.Lock()
+		t.expireShard(s, now)
+		s.mux.Unlock()
+	}
+}
+
+// Run expires idle flows every interval until stop is closed
+func (t *Table) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.Expire()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// expireShard must be called with the shard's lock held
+func (t *Table) expireShard(s *shard, now int64) {
+	for k, e := range s.entries {
+		if now-e.lastSeen > t.timeout(&k, e) {
+			t.remove(s, k, e)
+		}
+	}
+}
+
+const protoTCP = 6
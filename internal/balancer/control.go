@@ -1,56 +1,167 @@
 package balancer
 
 import (
+	"crypto/tls"
 	"errors"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/AkihiroSuda/go-netfilter-queue"
-	"github.com/coreos/go-iptables/iptables"
 	"github.com/pwpon500/caplance/internal/balancer/backends"
+	"github.com/pwpon500/caplance/internal/balancer/conntrack"
+	"github.com/pwpon500/caplance/internal/balancer/ha"
+	"github.com/pwpon500/caplance/internal/balancer/metrics"
+	"github.com/pwpon500/caplance/internal/balancer/source"
+	"github.com/pwpon500/caplance/internal/balancer/xdp"
+	"github.com/pwpon500/caplance/pkg/util"
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 )
 
 // Balancer is the main data struct for the load balancer
 type Balancer struct {
-	backendManager *backends.Manager  // manager for backends
-	vip            net.IP             // VIP the balancer is operating off of
-	connectIP      net.IP             // IP for the RPC between backends and balancer
-	packets        chan []byte        // channel of queued up packets
-	stopChan       chan os.Signal     // channel to listen for graceful stop
-	testFlag       bool               // flag to check if we're in test mode
-	mux            sync.Mutex         // lock to ensure we don't start and stop at the same time
-	nfq            *netfilter.NFQueue // queue to grab packets from the iptables nfqueue
+	backendManager *backends.Manager     // manager for backends
+	services       map[vipKey][]*service // services by the VIPs they serve
+	vips           []net.IP              // VIPs of every service, either family
+	rules          []queueRule           // iptables rules sending served ports to the packet source
+	connectIP      net.IP                // IP for the RPC between backends and balancer
+	stopChan       chan os.Signal        // channel to listen for graceful stop
+	testFlag       bool                  // flag to check if we're in test mode
+	mux            sync.Mutex            // lock to ensure we don't start and stop at the same time
+	source         source.Config         // where packets to the VIPs are read from
+	src            source.Source         // open packet source. nil until listening
+	conns          *conntrack.Table      // table pinning live flows to their backend. nil if disabled
+	done           chan struct{}         // closed when the balancer shuts down
+	sockaddr       string                // unix socket for caplancectl. not served if empty
+	unixSock       net.Listener          // listener on sockaddr
 	readTimeout    int
 	writeTimeout   int
+
+	ha      *ha.Config     // election with a standby balancer. standalone if nil
+	ecmp    bool           // VIPs are routed to every balancer, so they go on loopback unannounced
+	elector *ha.Elector    // runs the election. nil if standalone
+	active  bool           // whether the VIPs and iptables rules are in place
+	links   []netlink.Link // device each attached VIP is on
+	showARP func()         // puts back the arp settings changed to keep the VIPs on loopback quiet. nil if none were
+
+	xdpConf  xdp.Config    // where the xdp fast path is attached
+	datapath *xdp.Datapath // forwards packets in the kernel ahead of the packet source. nil if disabled
 }
 
-// New creates new Balancer. Throws error if capacity is not prime
-func New(startVIP, toConnect net.IP, capacity, readTimeout, writeTimeout int) (*Balancer, error) {
-	manager, err := backends.NewManager(toConnect, 1338, capacity, readTimeout, writeTimeout)
-	if err != nil {
-		return nil, err
+// Config configures a Balancer
+type Config struct {
+	Services     []ServiceConfig  // services served, each with its own pool of backends
+	ConnectIP    net.IP           // IP backends register with the balancer on
+	Port         int              // port backends register with the balancer on. 1338 if 0
+	ReadTimeout  int              // seconds to wait on a read from a backend
+	WriteTimeout int              // seconds to wait on a write to a backend
+	DrainTimeout int              // seconds after which draining backends are paused at the latest
+	Sockaddr     string           // unix socket for caplancectl. not served if empty
+	Conns        *conntrack.Table // pins established flows to their backend across backend changes. disabled if nil
+	TLS          *tls.Config      // backends register over tls if not nil
+	HA           *ha.Config       // only take the VIPs while leading the pair. standalone if nil
+	ECMP         bool             // one of several active balancers a router spreads the VIPs' traffic over
+	Source       source.Config    // where packets to the VIPs are read from. the nfqueue if its type is empty
+	XDP          *xdp.Config      // forwards what it can in the kernel ahead of the packet source if not nil
+	Batch        util.BatchConfig // how packets to backends taking them over udp are batched
+}
+
+// New creates new Balancer serving each of the configured services with its own pool of backends.
+// Throws error if a capacity is not prime, if no services are given, if services on the same
+// VIP serve the same port, if both HA and ECMP are given, if an afpacket source or the xdp
+// fast path behind ecmp has no interfaces, if XDP is combined with Conns or if the xdp program
+// can't be loaded
+func New(conf Config) (*Balancer, error) {
+	services, conns, fast := conf.Services, conf.Conns, conf.XDP
+	if len(services) == 0 {
+		return nil, errors.New("balancer needs at least one service")
+	}
+	if conf.HA != nil && conf.ECMP {
+		return nil, errors.New("balancer cannot run both as an active/standby pair and behind ecmp")
+	}
+	srcConf := conf.Source
+	if srcConf.Type == "" {
+		srcConf.Type = source.NFQueue
+	}
+	// behind ecmp the VIPs are on loopback, which is not where their packets come in
+	if conf.ECMP && srcConf.Type == source.AFPacket && len(srcConf.Interfaces) == 0 {
+		return nil, errors.New("afpacket source behind ecmp needs its interfaces configured")
+	}
+	if fast != nil && conf.ECMP && len(fast.Interfaces) == 0 {
+		return nil, errors.New("xdp fast path behind ecmp needs its interfaces configured")
+	}
+	// flows forwarded in the kernel never make it into the table
+	if fast != nil && conns != nil {
+		return nil, errors.New("xdp fast path cannot be combined with connection tracking. set its max entries to 0")
+	}
+
+	port := conf.Port
+	if port == 0 {
+		port = 1338
+	}
+	manager := backends.NewManager(conf.ConnectIP, port, conf.ReadTimeout, conf.WriteTimeout, time.Duration(conf.DrainTimeout)*time.Second, conns, conf.TLS, conf.Batch)
+	byVIP := make(map[vipKey][]*service)
+	var vips []net.IP
+	var rules []queueRule
+	for _, conf := range services {
+		svc, err := newService(conf, manager)
+		if err != nil {
+			return nil, err
+		}
+		for _, vip := range conf.VIPs {
+			key := toVIPKey(vip)
+			err = checkOverlap(svc, byVIP[key])
+			if err != nil {
+				return nil, err
+			}
+			if len(byVIP[key]) == 0 {
+				vips = append(vips, vip)
+			}
+			byVIP[key] = append(byVIP[key], svc)
+			for _, r := range svc.ports {
+				rules = append(rules, queueRule{vip, r.iptablesArgs(vip), ruleTarget(srcConf)})
+			}
+		}
+	}
+
+	var xdpConf xdp.Config
+	var datapath *xdp.Datapath
+	if fast != nil {
+		xdpConf = *fast
+		var err error
+		datapath, err = openFastPath(xdpConf, byVIP, vips)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &Balancer{
 		backendManager: manager,
-		vip:            startVIP,
-		connectIP:      toConnect,
-		packets:        make(chan []byte, 100),
+		services:       byVIP,
+		vips:           vips,
+		rules:          rules,
+		connectIP:      conf.ConnectIP,
 		stopChan:       make(chan os.Signal, 5),
 		testFlag:       false,
-		readTimeout:    readTimeout,
-		writeTimeout:   writeTimeout}, nil
+		conns:          conns,
+		done:           make(chan struct{}),
+		sockaddr:       conf.Sockaddr,
+		readTimeout:    conf.ReadTimeout,
+		writeTimeout:   conf.WriteTimeout,
+		source:         srcConf,
+		ha:             conf.HA,
+		ecmp:           conf.ECMP,
+		xdpConf:        xdpConf,
+		datapath:       datapath}, nil
 }
 
 // NewTest creates new Balancer with the testing flag on
-func NewTest(startVIP, toConnect net.IP, capacity, readTimeout, writeTimeout int) (*Balancer, error) {
-	back, err := New(startVIP, toConnect, capacity, readTimeout, writeTimeout)
+func NewTest(conf Config) (*Balancer, error) {
+	back, err := New(conf)
 	if err != nil {
 		return nil, err
 	}
@@ -60,6 +171,11 @@ func NewTest(startVIP, toConnect net.IP, capacity, readTimeout, writeTimeout int
 	return back, nil
 }
 
+// Manager returns the manager registering the balancer's backends
+func (b *Balancer) Manager() *backends.Manager {
+	return b.backendManager
+}
+
 /*
 	Add is currently deprecated in favor of a connect-based approach
 
@@ -69,16 +185,23 @@ func (b *Balancer) Add(name string, ip net.IP) error {
 }
 */
 
-// Start attaches the VIP and starts the load balancer
+// Start attaches the VIPs and starts the load balancer. In a pair, the VIPs are only attached
+// once the balancer is elected leader
 func (b *Balancer) Start() error {
 	b.mux.Lock()
-	dev, err := attachVIP(b.vip)
-	if err != nil {
-		return err
-	}
-	link, err := netlink.LinkByName(dev)
-	if err != nil {
-		return err
+	if b.ha == nil {
+		err := b.activate()
+		if err != nil {
+			b.mux.Unlock()
+			return err
+		}
+	} else {
+		var err error
+		b.elector, err = ha.NewElector(*b.ha, b.connectIP, b.takeOver, b.standBy, b.applyUpdate)
+		if err != nil {
+			b.mux.Unlock()
+			return err
+		}
 	}
 
 	signal.Notify(b.stopChan, syscall.SIGTERM)
@@ -87,10 +210,15 @@ func (b *Balancer) Start() error {
 		graceful := false
 		defer func() {
 			b.mux.Lock()
+			close(b.done)
 
-			if b.nfq != nil {
-				go b.nfq.Close()                   // need to multithread because sometimes b.nfq.Close() blocks indefinitely
-				time.Sleep(500 * time.Millisecond) // give nfq some time to close
+			if b.src != nil {
+				go b.src.Close()                   // need to multithread because sometimes closing the nfqueue blocks indefinitely
+				time.Sleep(500 * time.Millisecond) // give the source some time to close
+			}
+
+			if b.unixSock != nil {
+				b.unixSock.Close()
 			}
 
 			allBackends := b.backendManager.GetBackends()
@@ -98,15 +226,10 @@ func (b *Balancer) Start() error {
 				back.Writer.Close()
 			}
 
-			vipNet := &net.IPNet{IP: b.vip, Mask: net.CIDRMask(32, 32)}
-			netlink.AddrDel(link, &netlink.Addr{IPNet: vipNet})
-
-			ipt, err := iptables.New()
-			if err != nil {
-				log.Errorln(err)
+			b.deactivate()
+			if b.datapath != nil {
+				b.datapath.Close()
 			}
-			ipt.Delete("filter", "INPUT", "-j", "NFQUEUE", "--queue-num", "0", "-d", b.vip.String(), "-p", "tcp")
-			ipt.Delete("filter", "INPUT", "-j", "NFQUEUE", "--queue-num", "0", "-d", b.vip.String(), "-p", "udp")
 
 			if graceful && !b.testFlag {
 				log.Infoln("Exiting")
@@ -118,7 +241,6 @@ func (b *Balancer) Start() error {
 		sig := <-b.stopChan
 		graceful = true
 		log.Warnf("caught sig: %+v \n", sig)
-		b.stopChan <- sig
 	}()
 
 	b.mux.Unlock()
@@ -126,13 +248,215 @@ func (b *Balancer) Start() error {
 	wg.Add(2)
 	go b.backendManager.Listen()
 	go b.listen()
+	if b.sockaddr != "" {
+		go b.listenUnix()
+	}
+	if b.conns != nil {
+		go b.conns.Run(10*time.Second, b.done)
+	}
+	if b.elector != nil {
+		go func() {
+			err := b.elector.Run(b.done)
+			if err != nil {
+				log.Errorln("Failed to run leader election: " + err.Error())
+			}
+		}()
+		go b.replicate()
+	}
 	wg.Wait()
 	return nil
 }
 
+// activate attaches the VIPs and inserts the iptables rules sending their ports to the packet source,
+// attaches the xdp fast path if there is one, then announces the VIPs to the neighbors. Behind ecmp,
+// the router already sends the VIPs' traffic here, so they go on loopback. Announcements skip it,
+// and the host is kept from answering arp for them, or every balancer would claim the VIPs on the
+// router's segment. Must hold b.mux
+func (b *Balancer) activate() error {
+	b.active = true
+	b.links = nil
+	if b.ecmp && util.HasIPv4(b.vips) {
+		var err error
+		b.showARP, err = util.HideLoopbackAddrs()
+		if err != nil {
+			b.deactivate()
+			return err
+		}
+	}
+	for _, vip := range b.vips {
+		dev := "lo"
+		var err error
+		if b.ecmp {
+			err = attachTo(dev, vip)
+		} else {
+			dev, err = attachVIP(vip)
+		}
+		if err != nil {
+			b.deactivate()
+			return err
+		}
+		link, err := netlink.LinkByName(dev)
+		if err != nil {
+			b.deactivate()
+			return err
+		}
+		b.links = append(b.links, link)
+	}
+	for _, rule := range b.rules {
+		ipt, err := util.IPTablesFor(rule.vip)
+		if err == nil {
+			err = ipt.Insert("filter", "INPUT", 1, rule.spec()...)
+		}
+		if err != nil {
+			b.deactivate()
+			return err
+		}
+	}
+	if b.datapath != nil {
+		err := b.attachFastPath()
+		if err != nil {
+			b.deactivate()
+			return err
+		}
+	}
+	metrics.Leader.Set(1)
+	go b.announce()
+	return nil
+}
+
+// deactivate detaches the xdp fast path and removes the VIPs and their iptables rules. Must hold
+// b.mux
+func (b *Balancer) deactivate() {
+	if !b.active {
+		return
+	}
+	b.active = false
+	metrics.Leader.Set(0)
+	if b.datapath != nil {
+		b.datapath.Detach()
+	}
+	for i, link := range b.links {
+		netlink.AddrDel(link, &netlink.Addr{IPNet: util.HostNet(b.vips[i])})
+	}
+	for _, rule := range b.rules {
+		ipt, err := util.IPTablesFor(rule.vip)
+		if err != nil {
+			log.Errorln(err)
+			continue
+		}
+		// rules that never got inserted are simply not found
+		ipt.Delete("filter", "INPUT", rule.spec()...)
+	}
+	b.links = nil
+	if b.showARP != nil {
+		b.showARP()
+		b.showARP = nil
+	}
+}
+
+// announce sends a few rounds of gratuitous arps and neighbor advertisements for the VIPs, in
+// case the first ones get lost
+func (b *Balancer) announce() {
+	for round := 0; round < 3; round++ {
+		b.mux.Lock()
+		if !b.active {
+			b.mux.Unlock()
+			return
+		}
+		for i, link := range b.links {
+			err := ha.Announce(b.vips[i], link)
+			if err != nil {
+				log.Warnln("Failed to announce " + b.vips[i].String() + ": " + err.Error())
+			}
+		}
+		b.mux.Unlock()
+		time.Sleep(time.Second)
+	}
+}
+
+// takeOver makes this balancer the one holding the VIPs when it is elected leader
+func (b *Balancer) takeOver() error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	select {
+	case <-b.done:
+		return errors.New("balancer is shutting down")
+	default:
+	}
+	return b.activate()
+}
+
+// standBy gives up the VIPs when the peer balancer takes over
+func (b *Balancer) standBy() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.deactivate()
+}
+
+// updates between resending the state of every backend to the standby, in case some got lost
+const resyncRounds = 10
+
+// replicate sends the standby the state of the backends while this balancer leads, every change
+// as it is seen and everything every resyncRounds heartbeat intervals
+func (b *Balancer) replicate() {
+	ticker := time.NewTicker(b.ha.Interval)
+	defer ticker.Stop()
+	sent := make(map[string]ha.Update)
+	for round := 0; ; round++ {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		}
+		if !b.elector.Leader() {
+			// the peer may have changed anything while it led
+			sent = make(map[string]ha.Update)
+			continue
+		}
+		for _, status := range b.backendManager.Statuses() {
+			u := ha.Update{
+				Backend:    status.Pool + "/" + status.Name,
+				State:      strings.ToLower(status.State.String()),
+				CheckDown:  status.CheckDown,
+				StatusDown: status.StatusDown,
+			}
+			if round%resyncRounds != 0 && sent[u.Backend] == u {
+				continue
+			}
+			err := b.elector.Send(u)
+			if err != nil {
+				log.Debugln("Failed to send update to the standby: " + err.Error())
+				continue
+			}
+			sent[u.Backend] = u
+		}
+	}
+}
+
+// applyUpdate puts a backend in the state the leader has it in. Backends that haven't registered
+// here yet are caught up by a later update
+func (b *Balancer) applyUpdate(u ha.Update) {
+	var err error
+	if u.State == ha.Evicted {
+		err = b.backendManager.EvictBackend(u.Backend)
+	} else {
+		var state backends.BackendState
+		state, err = backends.ParseBackendState(u.State)
+		if err == nil {
+			err = b.backendManager.Replicate(u.Backend, state, u.CheckDown, u.StatusDown)
+		}
+	}
+	if err != nil {
+		log.Debugln("Failed to apply update from the leader for " + u.Backend + ": " + err.Error())
+	}
+}
+
 // Stop stops the currently running lb by appending onto `stop`
 func (b *Balancer) Stop() error {
-	if b.nfq == nil {
+	b.mux.Lock()
+	started := b.src != nil
+	b.mux.Unlock()
+	if !started {
 		return errors.New("unstarted balancer cannot be stopped")
 	}
 
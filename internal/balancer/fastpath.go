@@ -0,0 +1,88 @@
+package balancer
+
+import (
+	"net"
+
+	"github.com/pwpon500/caplance/internal/balancer/backends"
+	"github.com/pwpon500/caplance/internal/balancer/xdp"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+// openFastPath loads the xdp program for the services on vips and keeps its maps in sync with
+// their pools from then on
+func openFastPath(conf xdp.Config, services map[vipKey][]*service, vips []net.IP) (*xdp.Datapath, error) {
+	var pools []*backends.Pool
+	seen := make(map[*backends.Pool]bool)
+	for _, vip := range vips {
+		for _, svc := range services[toVIPKey(vip)] {
+			if !seen[svc.pool] {
+				seen[svc.pool] = true
+				pools = append(pools, svc.pool)
+			}
+		}
+	}
+
+	dp, err := xdp.New(pools, conf.Generic)
+	if err != nil {
+		return nil, err
+	}
+	for _, vip := range vips {
+		var ranges []xdp.Range
+		for _, svc := range services[toVIPKey(vip)] {
+			for _, r := range svc.ports {
+				ranges = append(ranges, xdp.Range{
+					Proto:  r.Proto,
+					From:   r.From,
+					To:     r.To,
+					Policy: svc.hashing.xdpPolicy(),
+					Pool:   svc.pool,
+				})
+			}
+		}
+		err = dp.SetVIP(vip, ranges)
+		if err != nil {
+			dp.Close()
+			return nil, err
+		}
+	}
+
+	for _, pool := range pools {
+		pool := pool
+		pool.OnChange(func() {
+			err := dp.Sync(pool)
+			if err != nil {
+				log.Errorln("Failed to sync the xdp maps of pool " + pool.Name() + ": " + err.Error())
+			}
+		})
+		err = dp.Sync(pool)
+		if err != nil {
+			dp.Close()
+			return nil, err
+		}
+	}
+	return dp, nil
+}
+
+// attachFastPath attaches the xdp program to the configured interfaces, or to the devices the
+// VIPs went on. Must hold b.mux
+func (b *Balancer) attachFastPath() error {
+	var links []netlink.Link
+	if len(b.xdpConf.Interfaces) == 0 {
+		attached := make(map[int]bool)
+		for _, link := range b.links {
+			if !attached[link.Attrs().Index] {
+				attached[link.Attrs().Index] = true
+				links = append(links, link)
+			}
+		}
+	}
+	for _, name := range b.xdpConf.Interfaces {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return err
+		}
+		links = append(links, link)
+	}
+	return b.datapath.Attach(links)
+}
@@ -0,0 +1,104 @@
+package balancer
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/pwpon500/caplance/internal/balancer/conntrack"
+)
+
+// errors of ParseFlow. They are only made once, so dropping a packet doesn't allocate either
+var (
+	errTruncated = errors.New("packet too short for its headers")
+	errNotIP     = errors.New("couldn't find ip layer in packet")
+	errFragment  = errors.New("packet is a fragment without the transport header")
+	errNotTCPUDP = errors.New("couldn't find tcp or udp layer in packet")
+)
+
+// ipv6 extension headers that can come before the transport header
+const (
+	ip6HopByHop = 0
+	ip6Routing  = 43
+	ip6Fragment = 44
+	ip6DestOpts = 60
+)
+
+// Flow holds what the balancer needs to know about the flow a packet belongs to
+type Flow struct {
+	Key conntrack.Key // 5-tuple of the packet
+	FIN bool          // packet is a tcp FIN
+	RST bool          // packet is a tcp RST
+}
+
+// ParseFlow reads the flow of a raw ipv4 or ipv6 packet straight out of its headers into f.
+// It doesn't allocate, so it can run on every packet
+func ParseFlow(packet []byte, f *Flow) error {
+	*f = Flow{}
+	if len(packet) == 0 {
+		return errTruncated
+	}
+
+	var l4 []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return errTruncated
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl < 20 || len(packet) < ihl {
+			return errTruncated
+		}
+		// only the first fragment carries the ports
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			return errFragment
+		}
+		f.Key.Proto = packet[9]
+		// ipv4 addresses go in their ipv4-in-ipv6 form, like net.IP.To16 has them
+		f.Key.SrcIP[10], f.Key.SrcIP[11] = 0xff, 0xff
+		f.Key.DstIP[10], f.Key.DstIP[11] = 0xff, 0xff
+		copy(f.Key.SrcIP[12:], packet[12:16])
+		copy(f.Key.DstIP[12:], packet[16:20])
+		l4 = packet[ihl:]
+	case 6:
+		if len(packet) < 40 {
+			return errTruncated
+		}
+		copy(f.Key.SrcIP[:], packet[8:24])
+		copy(f.Key.DstIP[:], packet[24:40])
+		next, offset := packet[6], 40
+		for next == ip6HopByHop || next == ip6Routing || next == ip6DestOpts {
+			if len(packet) < offset+8 {
+				return errTruncated
+			}
+			next, offset = packet[offset], offset+(int(packet[offset+1])+1)*8
+		}
+		if next == ip6Fragment {
+			return errFragment
+		}
+		if len(packet) < offset {
+			return errTruncated
+		}
+		f.Key.Proto = next
+		l4 = packet[offset:]
+	default:
+		return errNotIP
+	}
+
+	switch f.Key.Proto {
+	case protoTCP:
+		if len(l4) < 20 {
+			return errTruncated
+		}
+		f.FIN = l4[13]&0x01 != 0
+		f.RST = l4[13]&0x04 != 0
+	case protoUDP:
+		if len(l4) < 8 {
+			return errTruncated
+		}
+	default:
+		return errNotTCPUDP
+	}
+	f.Key.SrcPort = binary.BigEndian.Uint16(l4[0:2])
+	f.Key.DstPort = binary.BigEndian.Uint16(l4[2:4])
+	return nil
+}
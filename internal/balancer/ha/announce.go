@@ -0,0 +1,102 @@
+package ha
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/vishvananda/netlink"
+)
+
+// override flag of a neighbor advertisement, telling neighbors to replace their cached address
+const naOverride = 0x20
+
+// Announce tells the neighbors on link that ip now lives at link's hardware address, with a
+// gratuitous arp for ipv4 and an unsolicited neighbor advertisement for ipv6. Links without a
+// hardware address, like loopback, are skipped
+func Announce(ip net.IP, link netlink.Link) error {
+	mac := link.Attrs().HardwareAddr
+	if len(mac) != 6 {
+		return nil
+	}
+
+	var frame []byte
+	var err error
+	if ip4 := ip.To4(); ip4 != nil {
+		frame, err = gratuitousARP(ip4, mac)
+	} else {
+		frame, err = unsolicitedNA(ip, mac)
+	}
+	if err != nil {
+		return err
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	addr := &syscall.SockaddrLinklayer{Ifindex: link.Attrs().Index, Halen: 6}
+	copy(addr.Addr[:], frame[:6])
+	return syscall.Sendto(fd, frame, 0, addr)
+}
+
+// gratuitousARP builds a broadcast arp request for ip from mac
+func gratuitousARP(ip net.IP, mac net.HardwareAddr) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       mac,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   mac,
+		SourceProtAddress: ip,
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    ip,
+	}
+	return serialize(eth, arp)
+}
+
+// unsolicitedNA builds a neighbor advertisement for ip from mac to all nodes
+func unsolicitedNA(ip net.IP, mac net.HardwareAddr) ([]byte, error) {
+	allNodes := net.ParseIP("ff02::1")
+	eth := &layers.Ethernet{
+		SrcMAC:       mac,
+		DstMAC:       net.HardwareAddr{0x33, 0x33, 0, 0, 0, 1},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip6 := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255,
+		SrcIP:      ip,
+		DstIP:      allNodes,
+	}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0)}
+	err := icmp.SetNetworkLayerForChecksum(ip6)
+	if err != nil {
+		return nil, err
+	}
+	na := &layers.ICMPv6NeighborAdvertisement{
+		Flags:         naOverride,
+		TargetAddress: ip,
+		Options:       layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: mac}},
+	}
+	return serialize(eth, ip6, icmp, na)
+}
+
+func serialize(l ...gopacket.SerializableLayer) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, l...)
+	if err != nil {
+		return nil, errors.New("failed to build announcement: " + err.Error())
+	}
+	return buf.Bytes(), nil
+}
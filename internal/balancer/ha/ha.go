@@ -0,0 +1,298 @@
+// Package ha elects which balancer of an active/standby pair holds the VIPs. It works like VRRP:
+// each balancer sends a heartbeat with its priority to its peer every interval, and a standby
+// takes over once it has not heard from the leader for the dead interval. There is no
+// preemption, so a balancer that comes back up stays standby while its peer leads, as it may not
+// know every backend yet. The leader also sends the standby the state of its backends.
+// Every message is signed with a key the pair shares and numbered, so they can't be forged or
+// replayed
+package ha
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Config configures the election between a pair of balancers
+type Config struct {
+	Peer      net.IP        // management ip of the other balancer
+	Port      int           // udp port heartbeats are sent to and received on
+	Priority  int           // the higher priority leads when both come up. ties go to the higher ip
+	Interval  time.Duration // time between heartbeats
+	DeadAfter time.Duration // time without heartbeats before the peer counts as dead
+	Key       []byte        // shared by the pair to sign their messages with
+}
+
+// MinKeyLen is the shortest key the pair may share
+const MinKeyLen = 16
+
+// Update is the leader's view of a backend, sent to the standby so it takes over with the same
+// pools
+type Update struct {
+	Backend    string // backend as <pool>/<name>
+	State      string // active, paused or draining. Evicted if it was evicted by request
+	CheckDown  bool   // paused by the pool's health check
+	StatusDown bool   // taken out by its own health reports
+}
+
+// Evicted is the state of an Update for a backend evicted by request
+const Evicted = "evicted"
+
+// Elector runs the election for one balancer of the pair
+type Elector struct {
+	conf      Config
+	local     net.IP
+	onLeader  func() error // takes over the VIPs. the balancer stays standby if it fails
+	onStandby func()       // gives up the VIPs
+	onUpdate  func(Update) // applies the leader's view of a backend while standing by
+	started   time.Time
+
+	mux          sync.Mutex // guards everything below
+	conn         *net.UDPConn
+	leader       bool
+	seq          uint64 // number of the last message sent
+	peerSeq      uint64 // number of the last message heard from the peer
+	peerPriority int
+	peerLeader   bool
+	lastHeard    time.Time // zero until the peer is first heard from
+}
+
+// NewElector creates an Elector for the balancer at local. onLeader is called when the balancer
+// becomes the leader, onStandby when it stops being it and onUpdate for every update sent by the
+// leader while the balancer stands by
+func NewElector(conf Config, local net.IP, onLeader func() error, onStandby func(), onUpdate func(Update)) (*Elector, error) {
+	if conf.Peer == nil {
+		return nil, errors.New("ha needs the ip of the peer balancer")
+	}
+	if conf.Interval <= 0 || conf.DeadAfter <= conf.Interval {
+		return nil, errors.New("ha dead interval must be longer than the heartbeat interval")
+	}
+	if len(conf.Key) < MinKeyLen {
+		return nil, errors.New("ha needs a shared key of at least " + strconv.Itoa(MinKeyLen) + " bytes")
+	}
+	return &Elector{
+		conf:      conf,
+		local:     local,
+		onLeader:  onLeader,
+		onStandby: onStandby,
+		onUpdate:  onUpdate,
+		// numbering from the clock keeps going up across restarts, so the peer takes the
+		// messages of a restarted balancer
+		seq: uint64(time.Now().UnixNano())}, nil
+}
+
+// Run sends heartbeats to the peer and holds elections until done is closed. It does not give up
+// the VIPs on return, that is left to the balancer's shutdown
+func (e *Elector) Run(done <-chan struct{}) error {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: e.local, Port: e.conf.Port})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	e.mux.Lock()
+	e.conn = conn
+	e.mux.Unlock()
+	go e.receive(conn)
+
+	e.started = time.Now()
+	ticker := time.NewTicker(e.conf.Interval)
+	defer ticker.Stop()
+	for {
+		e.elect(time.Now())
+		err = e.send(e.heartbeat())
+		if err != nil {
+			log.Debugln("Failed to send heartbeat: " + err.Error())
+		}
+
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Leader returns whether this balancer currently holds the VIPs
+func (e *Elector) Leader() bool {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.leader
+}
+
+// Send sends the standby the leader's view of a backend. Throws error if the election isn't
+// running
+func (e *Elector) Send(u Update) error {
+	return e.send([]string{"UPDATE", u.Backend, u.State, strconv.FormatBool(u.CheckDown), strconv.FormatBool(u.StatusDown)})
+}
+
+// heartbeat builds the HEARTBEAT message for the current state
+func (e *Elector) heartbeat() []string {
+	state := "STANDBY"
+	if e.Leader() {
+		state = "LEADER"
+	}
+	return []string{"HEARTBEAT", strconv.Itoa(e.conf.Priority), state}
+}
+
+// send numbers and signs a message made of tokens, then sends it to the peer. The number goes
+// right after the type: <type> <seq> <args...> <hex hmac of everything before it>
+func (e *Elector) send(tokens []string) error {
+	e.mux.Lock()
+	conn := e.conn
+	e.seq++
+	seq := e.seq
+	e.mux.Unlock()
+	if conn == nil {
+		return errors.New("election is not running")
+	}
+
+	msg := tokens[0] + " " + strconv.FormatUint(seq, 10)
+	if len(tokens) > 1 {
+		msg += " " + strings.Join(tokens[1:], " ")
+	}
+	msg += " " + hex.EncodeToString(e.sign(msg))
+	_, err := conn.WriteToUDP([]byte(msg), &net.UDPAddr{IP: e.conf.Peer, Port: e.conf.Port})
+	return err
+}
+
+func (e *Elector) sign(msg string) []byte {
+	mac := hmac.New(sha256.New, e.conf.Key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// open checks the signature and number of a message from the peer, returning its type and
+// arguments. Returns false for messages that are forged, replayed or malformed
+func (e *Elector) open(msg string) (string, []string, bool) {
+	i := strings.LastIndexByte(msg, ' ')
+	if i < 0 {
+		return "", nil, false
+	}
+	sum, err := hex.DecodeString(msg[i+1:])
+	if err != nil || !hmac.Equal(sum, e.sign(msg[:i])) {
+		return "", nil, false
+	}
+	tokens := strings.Split(msg[:i], " ")
+	if len(tokens) < 2 {
+		return "", nil, false
+	}
+	seq, err := strconv.ParseUint(tokens[1], 10, 64)
+	if err != nil {
+		return "", nil, false
+	}
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if seq <= e.peerSeq {
+		return "", nil, false
+	}
+	e.peerSeq = seq
+	return tokens[0], tokens[2:], true
+}
+
+// receive records the heartbeats of the peer and applies its updates until conn is closed
+func (e *Elector) receive(conn *net.UDPConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !addr.IP.Equal(e.conf.Peer) {
+			log.Debugln("Message from unknown peer " + addr.IP.String() + " ignored")
+			continue
+		}
+		kind, args, valid := e.open(string(buf[:n]))
+		if !valid {
+			log.Warnln("Message from " + addr.IP.String() + " failed authentication or was replayed")
+			continue
+		}
+
+		switch {
+		case kind == "HEARTBEAT" && len(args) == 2:
+			priority, err := strconv.Atoi(args[0])
+			if err != nil {
+				log.Debugln("Malformed heartbeat: " + string(buf[:n]))
+				continue
+			}
+			e.mux.Lock()
+			e.peerPriority = priority
+			e.peerLeader = args[1] == "LEADER"
+			e.lastHeard = time.Now()
+			e.mux.Unlock()
+
+		case kind == "UPDATE" && len(args) == 4:
+			checkDown, err1 := strconv.ParseBool(args[2])
+			statusDown, err2 := strconv.ParseBool(args[3])
+			if err1 != nil || err2 != nil {
+				log.Debugln("Malformed update: " + string(buf[:n]))
+				continue
+			}
+			// a leader takes no orders from its peer
+			if e.onUpdate != nil && !e.Leader() {
+				e.onUpdate(Update{Backend: args[0], State: args[1], CheckDown: checkDown, StatusDown: statusDown})
+			}
+
+		default:
+			log.Debugln("Malformed message: " + string(buf[:n]))
+		}
+	}
+}
+
+// elect takes over or stands by if the outcome of the election changed
+func (e *Elector) elect(now time.Time) {
+	e.mux.Lock()
+	leader := e.leader
+	lead := e.shouldLead(now)
+	e.mux.Unlock()
+
+	if lead && !leader {
+		log.Warnln("Taking over as leader")
+		err := e.onLeader()
+		if err != nil {
+			log.Errorln("Failed to take over: " + err.Error())
+			return
+		}
+	} else if !lead && leader {
+		log.Warnln("Standing by for " + e.conf.Peer.String())
+		e.onStandby()
+	} else {
+		return
+	}
+
+	e.mux.Lock()
+	e.leader = lead
+	e.mux.Unlock()
+}
+
+// shouldLead decides whether this balancer should hold the VIPs. Must hold e.mux
+func (e *Elector) shouldLead(now time.Time) bool {
+	if e.lastHeard.IsZero() {
+		// give a peer that is already up the chance to be heard before claiming the vips
+		return now.Sub(e.started) >= e.conf.DeadAfter
+	}
+	if now.Sub(e.lastHeard) >= e.conf.DeadAfter {
+		return true
+	}
+
+	switch {
+	case e.peerLeader && !e.leader:
+		return false
+	case !e.peerLeader && e.leader:
+		return true
+	}
+	// both or neither lead, so priority breaks the tie
+	if e.conf.Priority != e.peerPriority {
+		return e.conf.Priority > e.peerPriority
+	}
+	return bytes.Compare(e.local.To16(), e.conf.Peer.To16()) > 0
+}
@@ -0,0 +1,102 @@
+package balancer
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/pwpon500/caplance/internal/balancer/conntrack"
+	"github.com/pwpon500/caplance/internal/balancer/xdp"
+)
+
+// HashPolicy picks which parts of a flow's 5-tuple are maglev hashed
+type HashPolicy int
+
+const (
+	// HashSrcIPPort hashes the source ip and port
+	HashSrcIPPort HashPolicy = 0
+	// HashFiveTuple hashes the protocol and the source and destination ips and ports
+	HashFiveTuple HashPolicy = 1
+	// HashSrcIP hashes only the source ip, so every connection from a client goes to
+	// the same backend
+	HashSrcIP HashPolicy = 2
+)
+
+// ParseHashPolicy parses the config name of a HashPolicy
+func ParseHashPolicy(name string) (HashPolicy, error) {
+	switch name {
+	case "src-ip-port", "":
+		return HashSrcIPPort, nil
+	case "5-tuple":
+		return HashFiveTuple, nil
+	case "src-ip":
+		return HashSrcIP, nil
+	}
+	return 0, errors.New("unknown hash policy " + name)
+}
+
+// HashConfig configures how a flow is turned into a maglev key
+type HashConfig struct {
+	Policy HashPolicy
+	// Symmetric hashes both endpoints of the flow in a fixed order, so packets going
+	// either way between two hosts land on the same backend
+	Symmetric bool
+}
+
+// KeyLen is the length of the longest maglev key, that of a symmetric 5-tuple
+const KeyLen = 37
+
+// Key builds the maglev key of a flow. The key is raw bytes rather than something
+// printable since it only ever gets hashed
+func (h HashConfig) Key(k *conntrack.Key) string {
+	var buf [KeyLen]byte
+	return string(h.AppendKey(buf[:0], k))
+}
+
+// AppendKey appends the maglev key of a flow to dst. It doesn't allocate if dst has room for
+// KeyLen more bytes
+func (h HashConfig) AppendKey(dst []byte, k *conntrack.Key) []byte {
+	start := len(dst)
+	dst = endpoint(dst, k.SrcIP[:], k.SrcPort, h.Policy != HashSrcIP)
+	if !h.Symmetric && h.Policy != HashFiveTuple {
+		return dst
+	}
+
+	mid := len(dst)
+	dst = endpoint(dst, k.DstIP[:], k.DstPort, h.Policy != HashSrcIP)
+	if h.Symmetric && bytes.Compare(dst[start:mid], dst[mid:]) > 0 {
+		// swap the endpoints in place so the lower one comes first
+		var tmp [18]byte
+		n := copy(tmp[:], dst[start:mid])
+		copy(dst[start:], dst[mid:])
+		copy(dst[len(dst)-n:], tmp[:n])
+	}
+
+	if h.Policy == HashFiveTuple {
+		dst = append(dst, k.Proto)
+	}
+	return dst
+}
+
+// endpoint appends an ip and optionally a port to buf
+func endpoint(buf, ip []byte, port uint16, withPort bool) []byte {
+	buf = append(buf, ip...)
+	if withPort {
+		buf = append(buf, byte(port>>8), byte(port))
+	}
+	return buf
+}
+
+// xdpPolicy returns how the xdp program has to hash flows to agree with h. The program doesn't
+// order endpoints, so symmetric hashing stays in userspace
+func (h HashConfig) xdpPolicy() uint8 {
+	if h.Symmetric {
+		return xdp.PolicyUserspace
+	}
+	switch h.Policy {
+	case HashFiveTuple:
+		return xdp.PolicyFiveTuple
+	case HashSrcIP:
+		return xdp.PolicySrcIP
+	}
+	return xdp.PolicySrcIPPort
+}
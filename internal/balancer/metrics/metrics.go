@@ -0,0 +1,104 @@
+// Package metrics holds the prometheus metrics exported by the balancer
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// reasons packets get dropped for
+const (
+	DropParseFailure = "parse_failure" // packet could not be decoded
+	DropNoService    = "no_service"    // no service serves the packet's vip and port
+	DropNoBackends   = "no_backends"   // the service has no active backends
+	DropSendError    = "send_error"    // forwarding to the backend failed
+)
+
+var (
+	// ReceivedPackets counts packets read from the packet source
+	ReceivedPackets = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "caplance",
+		Name:      "received_packets_total",
+		Help:      "Packets received from the packet source.",
+	})
+	// ReceivedBytes counts bytes read from the packet source
+	ReceivedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "caplance",
+		Name:      "received_bytes_total",
+		Help:      "Bytes received from the packet source.",
+	})
+	// ForwardedPackets counts packets sent to each backend
+	ForwardedPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caplance",
+		Name:      "forwarded_packets_total",
+		Help:      "Packets forwarded to a backend.",
+	}, []string{"pool", "backend"})
+	// ForwardedBytes counts bytes sent to each backend
+	ForwardedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caplance",
+		Name:      "forwarded_bytes_total",
+		Help:      "Bytes forwarded to a backend.",
+	}, []string{"pool", "backend"})
+	// DroppedPackets counts packets dropped by the balancer by reason
+	DroppedPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caplance",
+		Name:      "dropped_packets_total",
+		Help:      "Packets dropped by the balancer.",
+	}, []string{"reason"})
+	// QueueDepth is the number of packets waiting to be handled
+	QueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "caplance",
+		Name:      "packet_queue_depth",
+		Help:      "Packets waiting for the balancer's packet workers.",
+	})
+	// Backends is the number of registered backends per pool by whether they are active or paused
+	Backends = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caplance",
+		Name:      "backends",
+		Help:      "Registered backends.",
+	}, []string{"pool", "state"})
+	// RegistrationFailures counts rejected registrations by reason
+	RegistrationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caplance",
+		Name:      "registration_failures_total",
+		Help:      "Backend registrations that failed.",
+	}, []string{"reason"})
+	// HealthCheckFailures counts failed active health checks per pool
+	HealthCheckFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caplance",
+		Name:      "health_check_failures_total",
+		Help:      "Active health checks of backends that failed.",
+	}, []string{"pool"})
+	// HealthTimeouts counts backends deregistered because they stopped health checking
+	HealthTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "caplance",
+		Name:      "health_check_timeouts_total",
+		Help:      "Backends deregistered after their health checks timed out.",
+	})
+	// Leader is 1 while this balancer holds the VIPs, which a standby does not
+	Leader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "caplance",
+		Name:      "leader",
+		Help:      "1 while this balancer holds the VIPs.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(ReceivedPackets, ReceivedBytes, ForwardedPackets, ForwardedBytes,
+		DroppedPackets, QueueDepth, Backends, RegistrationFailures, HealthCheckFailures, HealthTimeouts, Leader)
+}
+
+// Serve serves the metrics on /metrics at addr. Only returns on error
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+// ForgetBackend drops the series of a backend that left its pool
+func ForgetBackend(pool, backend string) {
+	ForwardedPackets.DeleteLabelValues(pool, backend)
+	ForwardedBytes.DeleteLabelValues(pool, backend)
+}
@@ -4,14 +4,14 @@ import (
 	"errors"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 
-	"github.com/AkihiroSuda/go-netfilter-queue"
-	"github.com/coreos/go-iptables/iptables"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
+	"github.com/pwpon500/caplance/internal/balancer/backends"
+	"github.com/pwpon500/caplance/internal/balancer/metrics"
+	"github.com/pwpon500/caplance/internal/balancer/source"
+	"github.com/pwpon500/caplance/pkg/util"
 	"github.com/vishvananda/netlink"
 )
 
@@ -29,136 +29,254 @@ func linkExists(name string) bool {
 	return false
 }
 
-func initBufPool(size int) *sync.Pool {
-	return &sync.Pool{
-		New: func() interface{} {
-			return make([]byte, size)
-		},
-	}
-}
-
 // I could be convinced to listen on more than tcp and udp, but it would have
 // to be a very convincing argument. As it sits, I don't see any reason for
 // listening on more than tcp and udp. AFAIK, almost all applications that could
 // benefit from load balancing are over tcp or udp.
+// Only the ports a service serves are queued, everything else to a VIP falls through to the host.
+// The rules doing the queueing are inserted by activate, so a standby reads an empty queue.
 func (b *Balancer) listen() error {
-	ipt, err := iptables.New()
+	src, err := b.openSource()
 	if err != nil {
 		log.Panicln(err)
 	}
-	err = ipt.Insert("filter", "INPUT", 1, "-j", "NFQUEUE", "--queue-num", "0", "-d", b.vip.String(), "-p", "tcp")
-	if err != nil {
-		log.Panicln(err)
-	}
-	err = ipt.Insert("filter", "INPUT", 1, "-j", "NFQUEUE", "--queue-num", "0", "-d", b.vip.String(), "-p", "udp")
-	if err != nil {
-		log.Panicln(err)
+	b.mux.Lock()
+	b.src = src
+	b.mux.Unlock()
+	b.Serve(src, b.done)
+	return nil
+}
+
+// Serve forwards the packets src delivers until done is closed. Each of its queues gets a
+// goroutine of its own parsing the queue's packets and handing them straight to the workers, so
+// the queues don't wait on each other. Called by the balancer on the source it opens, and by
+// tests on sources of their own
+func (b *Balancer) Serve(src source.Source, done <-chan struct{}) {
+	workers := make([]*worker, packetWorkers)
+	for i := range workers {
+		workers[i] = newWorker()
+		go b.handlePackets(workers[i], src, done)
 	}
 
-	for i := 0; i < 20; i++ {
-		go b.handlePacket()
+	var wg sync.WaitGroup
+	for _, queue := range src.Queues() {
+		wg.Add(1)
+		go func(queue <-chan []byte) {
+			defer wg.Done()
+			dispatch(queue, workers, src, done)
+		}(queue)
 	}
+	wg.Wait()
+}
 
-	b.nfq, err = netfilter.NewNFQueue(0, 100, netfilter.NF_DEFAULT_PACKET_SIZE)
-	if err != nil {
-		log.Panicln(err)
+// dispatch parses the packets of one of src's queues and hands each to the worker of its flow. A
+// flow only ever arrives on one queue and always goes to the same worker, so its packets are
+// forwarded in the order they came in
+func dispatch(queue <-chan []byte, workers []*worker, src source.Source, done <-chan struct{}) {
+	var f Flow
+	for {
+		select {
+		case data := <-queue:
+			metrics.ReceivedPackets.Inc()
+			metrics.ReceivedBytes.Add(float64(len(data)))
+			err := ParseFlow(data, &f)
+			if err != nil {
+				metrics.DroppedPackets.WithLabelValues(metrics.DropParseFailure).Inc()
+				log.Println(err)
+				src.Release(data)
+				continue
+			}
+			select {
+			case workers[f.Key.Hash()%packetWorkers].packets <- queuedPacket{data, f}:
+			case <-done:
+				src.Release(data)
+				return
+			}
+		case <-done:
+			return
+		}
 	}
-	packetChan := b.nfq.GetPackets()
-	stopped := false
-	for !stopped {
+}
+
+// goroutines forwarding packets, each handling its share of the flows
+const packetWorkers = 20
+
+// queuedPacket is a packet waiting for its worker, along with its already parsed flow
+type queuedPacket struct {
+	data []byte
+	flow Flow
+}
+
+// worker holds the state of a goroutine forwarding packets
+type worker struct {
+	packets chan queuedPacket
+	depth   int // packets waiting the last time the worker looked, as counted in QueueDepth
+}
+
+func newWorker() *worker {
+	return &worker{packets: make(chan queuedPacket, 100)}
+}
+
+// handlePackets forwards the packets queued for w one at a time until done is closed, handing
+// each back to src once it is sent
+func (b *Balancer) handlePackets(w *worker, src source.Source, done <-chan struct{}) {
+	for {
 		select {
-		case packet := <-packetChan:
-			b.packets <- packet.Packet.Data()
-			packet.SetVerdict(netfilter.NF_DROP)
-		case sig := <-b.stopChan:
-			b.stopChan <- sig
-			stopped = true
+		case p := <-w.packets:
+			w.reportDepth()
+			err := b.forward(p.data, &p.flow)
+			if err != nil {
+				log.Println(err)
+			}
+			src.Release(p.data)
+		case <-done:
+			metrics.QueueDepth.Sub(float64(w.depth))
+			return
 		}
 	}
+}
+
+// reportDepth adds the change in the packets waiting for w since it last looked to QueueDepth.
+// The gauge is shared by every worker, so each only touches it when its own backlog changes
+func (w *worker) reportDepth() {
+	depth := len(w.packets)
+	if depth != w.depth {
+		metrics.QueueDepth.Add(float64(depth - w.depth))
+		w.depth = depth
+	}
+}
+
+// errors of forward. They are only made once, so dropping a packet doesn't allocate either
+var (
+	errNoService  = errors.New("packet received for a port with no service, packet dropped")
+	errNoBackends = errors.New("packet received with no backends, packet dropped")
+)
+
+// Forward parses a packet and forwards it like one read from the packet source, on the calling
+// goroutine. Meant for tests, which don't run a packet source. Throws error if the packet is dropped
+func (b *Balancer) Forward(packet []byte) error {
+	var f Flow
+	err := ParseFlow(packet, &f)
+	if err != nil {
+		return err
+	}
+	return b.forward(packet, &f)
+}
+
+// forward sends a packet of flow f on to its backend, whose forwarder counts it. Doesn't allocate
+// unless the packet is dropped or its flow is new to the connection tracking table. Throws error
+// if the packet is dropped
+func (b *Balancer) forward(payload []byte, f *Flow) error {
+	svc := lookupService(b.services[vipKey(f.Key.DstIP)], f.Key.Proto, f.Key.DstPort)
+	if svc == nil {
+		metrics.DroppedPackets.WithLabelValues(metrics.DropNoService).Inc()
+		return errNoService
+	}
+	backend, err := b.pickBackend(svc, f)
+	if err != nil {
+		metrics.DroppedPackets.WithLabelValues(metrics.DropNoBackends).Inc()
+		return errNoBackends
+	}
+	err = backend.Writer.SendData(payload)
+	if err != nil {
+		metrics.DroppedPackets.WithLabelValues(metrics.DropSendError).Inc()
+		return err
+	}
 	return nil
 }
 
-func (b *Balancer) handlePacket() {
-	for {
-		payload := <-b.packets
-		packet := gopacket.NewPacket(payload, layers.LayerTypeIPv4, gopacket.Lazy)
+// pickBackend picks the backend in a service's pool for a packet's flow. Flows in the connection
+// tracking table stay with their backend for as long as it is registered, even while it is paused
+// or draining, everything else is maglev hashed
+func (b *Balancer) pickBackend(svc *service, f *Flow) (*backends.Backend, error) {
+	var buf [KeyLen]byte
+	key := svc.hashing.AppendKey(buf[:0], &f.Key)
+	if b.conns == nil {
+		return svc.pool.Lookup(key)
+	}
 
-		hostPort, err := getPacketDetails(packet)
+	var backend *backends.Backend
+	if id, ok := b.conns.Get(f.Key); ok {
+		backend = svc.pool.GetByID(id)
+	}
+	if backend == nil {
+		var err error
+		backend, err = svc.pool.Lookup(key)
 		if err != nil {
-			log.Println(err)
-			continue
+			return nil, err
 		}
-		backend, err := b.backendManager.Get(hostPort)
-		if err != nil {
-			log.Println("Packet received with no backends. Packet dropped.")
-			continue
+		if !f.RST {
+			b.conns.Put(f.Key, backend.ID())
 		}
-		backend.Writer.SendData(payload)
 	}
-}
 
-func getPacketDetails(packet gopacket.Packet) (string, error) {
-	ipLayer := packet.Layer(layers.LayerTypeIPv4)
-	if ipLayer == nil {
-		return "", errors.New("couldn't find ip layer in packet")
+	if f.RST {
+		b.conns.Delete(f.Key)
+	} else if f.FIN {
+		b.conns.Closing(f.Key)
 	}
-	ip, _ := ipLayer.(*layers.IPv4)
+	return backend, nil
+}
 
-	tcpLayer := packet.Layer(layers.LayerTypeTCP)
-	if tcpLayer == nil {
-		udpLayer := packet.Layer(layers.LayerTypeUDP)
-		if udpLayer == nil {
-			return "", errors.New("couldn't find tcp or udp layer in packet")
+// openSource opens the packet source the balancer was configured with. An afpacket source without
+// interfaces reads from the devices the VIPs go on
+func (b *Balancer) openSource() (source.Source, error) {
+	conf := b.source
+	if conf.Type == source.AFPacket && len(conf.Interfaces) == 0 {
+		seen := make(map[string]bool)
+		for _, vip := range b.vips {
+			dev, err := util.FindDevice(vip)
+			if err != nil {
+				return nil, err
+			}
+			if !seen[dev] {
+				seen[dev] = true
+				conf.Interfaces = append(conf.Interfaces, dev)
+			}
 		}
-		udp, _ := udpLayer.(*layers.UDP)
-
-		return ip.SrcIP.String() + ":" + udp.SrcPort.String(), nil
 	}
-	tcp, _ := tcpLayer.(*layers.TCP)
+	return source.Open(conf, b.vips)
+}
 
-	return ip.SrcIP.String() + ":" + tcp.SrcPort.String(), nil
+// queueRule is an iptables rule sending a service's packets to a VIP into the nfqueue. With an
+// afpacket source the packets are already read off the device, so the rule drops them instead
+type queueRule struct {
+	vip  net.IP
+	args []string // match arguments of the rule
+	jump []string // target of the rule
 }
 
-func genTunIPNet(ip net.IP) *net.IPNet {
-	return &net.IPNet{IP: ip, Mask: net.CIDRMask(30, 32)}
+func (r queueRule) spec() []string {
+	return append(append([]string{}, r.jump...), r.args...)
 }
 
-func attachVIP(vip net.IP) (string, error) {
-	foundDevice, err := findDevice(vip)
-	if err != nil {
-		return "", err
+// ruleTarget returns the target of the rules for a packet source
+func ruleTarget(conf source.Config) []string {
+	if conf.Type == source.AFPacket {
+		return []string{"-j", "DROP"}
 	}
-	dev, err := netlink.LinkByName(foundDevice)
-	if err != nil {
-		return "", err
+	if conf.Queues > 1 {
+		return []string{"-j", "NFQUEUE", "--queue-balance", "0:" + strconv.Itoa(conf.Queues-1)}
 	}
-	vipNet := &net.IPNet{IP: vip, Mask: net.CIDRMask(32, 32)}
-	netlink.AddrAdd(dev, &netlink.Addr{IPNet: vipNet})
-	return foundDevice, nil
+	return []string{"-j", "NFQUEUE", "--queue-num", "0"}
 }
 
-func findDevice(ip net.IP) (string, error) {
-	devices, err := pcap.FindAllDevs()
+func attachVIP(vip net.IP) (string, error) {
+	foundDevice, err := util.FindDevice(vip)
 	if err != nil {
 		return "", err
 	}
-	foundDevice := ""
-	for _, device := range devices {
-		for _, address := range device.Addresses {
-			ipNet := &net.IPNet{IP: address.IP, Mask: address.Netmask}
-			if ipNet.Contains(ip) {
-				if foundDevice == "" {
-					foundDevice = device.Name
-				} else if foundDevice != device.Name {
-					return "", errors.New("multiple devices on the same subnet. VIP cannot be assigned")
-				}
-			}
-		}
-	}
-	if foundDevice == "" {
-		return "", errors.New("no device on same subnet as VIP. VIP cannot be assigned")
+	return foundDevice, attachTo(foundDevice, vip)
+}
+
+// attachTo adds vip to the device named name
+func attachTo(name string, vip net.IP) error {
+	dev, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
 	}
-	return foundDevice, nil
+	netlink.AddrAdd(dev, &netlink.Addr{IPNet: util.HostNet(vip)})
+	return nil
 }
 
 func handleErr(err error) {
@@ -0,0 +1,156 @@
+package balancer
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pwpon500/caplance/internal/balancer/ha"
+	log "github.com/sirupsen/logrus"
+)
+
+func (b *Balancer) listenUnix() {
+	if err := os.RemoveAll(b.sockaddr); err != nil {
+		log.Panicln(err)
+	}
+
+	var err error
+	b.unixSock, err = net.Listen("unix", b.sockaddr)
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	// rpc.DefaultServer takes one receiver per type and only one mux path, so a balancer and a
+	// client, or two balancers, in one process would clash on it
+	server := rpc.NewServer()
+	if err := server.Register(b); err != nil {
+		log.Panicln(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+	http.Serve(b.unixSock, mux)
+}
+
+// ListBackends command from caplancectl
+func (b *Balancer) ListBackends(req *string, reply *string) error {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "POOL\tNAME\tDATA IP\tSTATE\tPROTOCOL\tREGISTERED\tLAST HEALTH\tLABELS")
+	now := time.Now()
+	for _, status := range b.backendManager.Statuses() {
+		health := "never"
+		if !status.LastHealth.IsZero() {
+			health = status.HealthCode + " " + now.Sub(status.LastHealth).Round(time.Second).String() + " ago"
+			if status.HealthNote != "" {
+				health += " (" + status.HealthNote + ")"
+			}
+		}
+		var labels []string
+		for key, val := range status.Labels {
+			labels = append(labels, key+"="+val)
+		}
+		sort.Strings(labels)
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\tv%v\t%v\t%v\t%v\n", status.Pool, status.Name, status.DataIP, status.State,
+			status.Protocol, status.Since.Format(time.RFC3339), health, strings.Join(labels, ","))
+	}
+	w.Flush()
+	*reply = buf.String()
+	return nil
+}
+
+// Fingerprints command from caplancectl. Lists the fingerprint of every service's maglev table,
+// which is the same on balancers that map flows the same way
+func (b *Balancer) Fingerprints(req *string, reply *string) error {
+	seen := make(map[*service]bool)
+	var services []*service
+	for _, svcs := range b.services {
+		for _, svc := range svcs {
+			if !seen[svc] {
+				seen[svc] = true
+				services = append(services, svc)
+			}
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].name < services[j].name })
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tBACKENDS\tFINGERPRINT")
+	for _, svc := range services {
+		fmt.Fprintf(w, "%v\t%v\t%v\n", svc.name, len(svc.pool.GetBackends()), svc.pool.Fingerprint())
+	}
+	w.Flush()
+	*reply = buf.String()
+	return nil
+}
+
+// GetRole command from caplancectl. Reports whether the balancer holds the VIPs
+func (b *Balancer) GetRole(req *string, reply *string) error {
+	b.mux.Lock()
+	active := b.active
+	b.mux.Unlock()
+	switch {
+	case b.ha == nil:
+		*reply = "standalone"
+	case active:
+		*reply = "leader (peer " + b.ha.Peer.String() + ")"
+	default:
+		*reply = "standby (peer " + b.ha.Peer.String() + ")"
+	}
+	return nil
+}
+
+// PauseBackend command from caplancectl. req is the backend as <pool>/<name> or just <name>
+func (b *Balancer) PauseBackend(req *string, reply *string) error {
+	err := b.backendManager.PauseBackend(*req)
+	if err == nil {
+		*reply = "Paused " + *req
+	} else {
+		*reply = "Pause encountered an error: " + err.Error()
+	}
+	return nil
+}
+
+// ResumeBackend command from caplancectl. req is the backend as <pool>/<name> or just <name>
+func (b *Balancer) ResumeBackend(req *string, reply *string) error {
+	err := b.backendManager.ResumeBackend(*req)
+	if err == nil {
+		*reply = "Resumed " + *req
+	} else {
+		*reply = "Resume encountered an error: " + err.Error()
+	}
+	return nil
+}
+
+// DrainBackend command from caplancectl. req is the backend as <pool>/<name> or just <name>
+func (b *Balancer) DrainBackend(req *string, reply *string) error {
+	err := b.backendManager.DrainBackend(*req)
+	if err == nil {
+		*reply = "Draining " + *req
+	} else {
+		*reply = "Drain encountered an error: " + err.Error()
+	}
+	return nil
+}
+
+// EvictBackend command from caplancectl. req is the backend as <pool>/<name> or just <name>
+func (b *Balancer) EvictBackend(req *string, reply *string) error {
+	err := b.backendManager.EvictBackend(*req)
+	if err == nil && b.elector != nil && b.elector.Leader() {
+		// the standby has no other way of knowing it was by request
+		b.elector.Send(ha.Update{Backend: *req, State: ha.Evicted})
+	}
+	if err == nil {
+		*reply = "Evicted " + *req
+	} else {
+		*reply = "Evict encountered an error: " + err.Error()
+	}
+	return nil
+}
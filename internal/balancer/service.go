@@ -0,0 +1,175 @@
+package balancer
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pwpon500/caplance/internal/balancer/backends"
+)
+
+const (
+	protoTCP uint8 = 6
+	protoUDP uint8 = 17
+)
+
+// PortRange is an inclusive range of ports of a single protocol
+type PortRange struct {
+	Proto uint8 // ip protocol number, tcp or udp
+	From  uint16
+	To    uint16
+}
+
+// AllPorts are the ranges a service without any configured ports serves
+var AllPorts = []PortRange{{protoTCP, 0, 65535}, {protoUDP, 0, 65535}}
+
+// ParsePortRange parses a range of the form <tcp|udp>/<port> or <tcp|udp>/<from>-<to>
+func ParsePortRange(raw string) (PortRange, error) {
+	parts := strings.SplitN(raw, "/", 2)
+	if len(parts) != 2 {
+		return PortRange{}, errors.New("port range " + raw + " is not of the form <tcp|udp>/<ports>")
+	}
+
+	var r PortRange
+	switch parts[0] {
+	case "tcp":
+		r.Proto = protoTCP
+	case "udp":
+		r.Proto = protoUDP
+	default:
+		return PortRange{}, errors.New("unknown protocol " + parts[0] + " in port range " + raw)
+	}
+
+	bounds := strings.SplitN(parts[1], "-", 2)
+	from, err := strconv.ParseUint(bounds[0], 10, 16)
+	if err != nil {
+		return PortRange{}, errors.New("port range " + raw + " is not parseable")
+	}
+	to := from
+	if len(bounds) == 2 {
+		to, err = strconv.ParseUint(bounds[1], 10, 16)
+		if err != nil || to < from {
+			return PortRange{}, errors.New("port range " + raw + " is not parseable")
+		}
+	}
+	r.From, r.To = uint16(from), uint16(to)
+	return r, nil
+}
+
+func (r PortRange) contains(proto uint8, port uint16) bool {
+	return r.Proto == proto && port >= r.From && port <= r.To
+}
+
+func (r PortRange) overlaps(other PortRange) bool {
+	return r.Proto == other.Proto && r.From <= other.To && other.From <= r.To
+}
+
+// protoName returns the iptables name of the range's protocol
+func (r PortRange) protoName() string {
+	if r.Proto == protoUDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// iptablesArgs returns the iptables match arguments for packets to vip within the range
+func (r PortRange) iptablesArgs(vip net.IP) []string {
+	args := []string{"-d", vip.String(), "-p", r.protoName()}
+	if r.From != 0 || r.To != 65535 {
+		args = append(args, "--dport", strconv.Itoa(int(r.From))+":"+strconv.Itoa(int(r.To)))
+	}
+	return args
+}
+
+// ServiceConfig describes a set of VIPs and ports load balanced over their own pool of backends
+type ServiceConfig struct {
+	Name     string
+	VIPs     []net.IP
+	Ports    []PortRange           // ports served on every VIP. all tcp and udp ports if empty
+	Capacity int                   // size of the pool's maglev table. must be prime
+	Hashing  HashConfig            // which parts of a flow get maglev hashed
+	Weights  map[string]int        // weights overriding the ones the named backends advertise
+	Check    *backends.HealthCheck // probe run against every backend. nil if none
+	Status   backends.StatusPolicy // how backends' own health reports are acted on
+}
+
+// service is a running ServiceConfig
+type service struct {
+	name    string
+	pool    *backends.Pool
+	ports   []PortRange
+	hashing HashConfig
+}
+
+// serves returns whether packets of proto to port belong to the service
+func (svc *service) serves(proto uint8, port uint16) bool {
+	for _, r := range svc.ports {
+		if r.contains(proto, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// newService creates the pool for a service and adds it to the manager
+func newService(conf ServiceConfig, manager *backends.Manager) (*service, error) {
+	if len(conf.VIPs) == 0 {
+		return nil, errors.New("service " + conf.Name + " needs at least one vip")
+	}
+
+	pool, err := backends.NewPool(conf.Name, conf.VIPs, conf.Capacity, conf.Weights, conf.Check, conf.Status)
+	if err != nil {
+		return nil, err
+	}
+	err = manager.AddPool(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	ports := conf.Ports
+	if len(ports) == 0 {
+		ports = AllPorts
+	}
+
+	return &service{
+		name:    conf.Name,
+		pool:    pool,
+		ports:   ports,
+		hashing: conf.Hashing}, nil
+}
+
+// lookupService finds which of the services on a VIP a packet of proto going to port belongs
+// to. Returns nil if there is none
+func lookupService(services []*service, proto uint8, port uint16) *service {
+	for _, svc := range services {
+		if svc.serves(proto, port) {
+			return svc
+		}
+	}
+	return nil
+}
+
+// checkOverlap makes sure svc doesn't serve any port another service on the same VIP serves
+func checkOverlap(svc *service, others []*service) error {
+	for _, other := range others {
+		for _, r := range svc.ports {
+			for _, o := range other.ports {
+				if r.overlaps(o) {
+					return errors.New("services " + svc.name + " and " + other.name + " both serve " + r.protoName() + " ports " +
+						strconv.Itoa(int(r.From)) + "-" + strconv.Itoa(int(r.To)) + " on the same vip")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// vipKey is the fixed-size form of a VIP used to look services up per packet
+type vipKey [16]byte
+
+func toVIPKey(ip net.IP) vipKey {
+	var k vipKey
+	copy(k[:], ip.To16())
+	return k
+}
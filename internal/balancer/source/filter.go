@@ -0,0 +1,84 @@
+package source
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	skfAdPktType = -0x1000 + 4 // SKF_AD_OFF + SKF_AD_PKTTYPE, loads the packet type
+
+	ethTypeOffset = 12
+	ip4DstOffset  = 14 + 16
+	ip6DstOffset  = 14 + 24
+)
+
+// vipFilter builds a classic bpf program for an ethernet device that accepts the ipv4 and ipv6
+// packets to one of vips sent to this host and drops everything else, including the packets the
+// balancer sends out
+func vipFilter(vips []net.IP) ([]unix.SockFilter, error) {
+	var v4, v6 []net.IP
+	for _, vip := range vips {
+		if ip4 := vip.To4(); ip4 != nil {
+			v4 = append(v4, ip4)
+		} else {
+			v6 = append(v6, vip.To16())
+		}
+	}
+
+	// layout: packet type and ethertype checks, the ipv4 block, the ipv6 block, drop, accept
+	v4Start := 4
+	v6Start := v4Start + 2 + len(v4)
+	drop := v6Start + 1 + 8*len(v6)
+	accept := drop + 1
+
+	var prog []unix.SockFilter
+	var err error
+	// jump adds a conditional jump, failing if a target is out of the 8 bit range
+	jump := func(k uint32, jt, jf int) {
+		pc := len(prog)
+		if jt-pc-1 > 0xff || jf-pc-1 > 0xff {
+			err = errors.New("too many vips for the packet filter")
+		}
+		prog = append(prog, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: k, Jt: uint8(jt - pc - 1), Jf: uint8(jf - pc - 1)})
+	}
+	load := func(size uint16, offset int) {
+		prog = append(prog, unix.SockFilter{Code: unix.BPF_LD | size | unix.BPF_ABS, K: uint32(offset)})
+	}
+	next := func() int { return len(prog) + 1 }
+
+	load(unix.BPF_W, skfAdPktType)
+	jump(unix.PACKET_HOST, next(), drop)
+	load(unix.BPF_H, ethTypeOffset)
+	jump(unix.ETH_P_IP, next(), v6Start)
+
+	load(unix.BPF_W, ip4DstOffset)
+	for _, vip := range v4 {
+		jump(binary.BigEndian.Uint32(vip), accept, next())
+	}
+	prog = append(prog, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JA, K: uint32(drop - len(prog) - 1)})
+
+	jump(unix.ETH_P_IPV6, next(), drop)
+	for i, vip := range v6 {
+		nextVIP := v6Start + 1 + 8*(i+1)
+		for word := 0; word < 4; word++ {
+			load(unix.BPF_W, ip6DstOffset+4*word)
+			match := next()
+			if word == 3 {
+				match = accept
+			}
+			jump(binary.BigEndian.Uint32(vip[4*word:]), match, nextVIP)
+		}
+	}
+
+	prog = append(prog,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: 0},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: 0xffffffff})
+	if err != nil {
+		return nil, err
+	}
+	return prog, nil
+}
@@ -0,0 +1,76 @@
+package source
+
+import (
+	"github.com/AkihiroSuda/go-netfilter-queue"
+)
+
+// Queue is a Source reading nfqueues, each with its own reader. Every packet is dropped once read,
+// so the local stack never sees it. Unlike the data path after it, the nfqueue library allocates
+// for every packet: it copies the packet out of C memory, wraps it in a gopacket and makes a
+// channel for its verdict. AFPacket sources don't, so they suit rates where that matters
+type Queue struct {
+	nfqs    []*netfilter.NFQueue
+	packets []chan []byte // packets of each nfqueue
+	done    chan struct{}
+}
+
+// NewQueue opens count nfqueues starting at nfqueue 0, each holding up to size packets
+func NewQueue(count uint16, size uint32) (*Queue, error) {
+	q := &Queue{done: make(chan struct{})}
+	for num := uint16(0); num < count; num++ {
+		nfq, err := netfilter.NewNFQueue(num, size, netfilter.NF_DEFAULT_PACKET_SIZE)
+		if err != nil {
+			q.Close()
+			return nil, err
+		}
+		q.nfqs = append(q.nfqs, nfq)
+		q.packets = append(q.packets, make(chan []byte, 100))
+	}
+	for i, nfq := range q.nfqs {
+		go q.read(nfq, q.packets[i])
+	}
+	return q, nil
+}
+
+// read hands the packets of nfq over to out in the order they were queued. The kernel keeps a
+// flow on a single queue, so that is the order of each flow
+func (q *Queue) read(nfq *netfilter.NFQueue, out chan<- []byte) {
+	queued := nfq.GetPackets()
+	for {
+		select {
+		case packet := <-queued:
+			data := packet.Packet.Data()
+			packet.SetVerdict(netfilter.NF_DROP)
+			select {
+			case out <- data:
+			case <-q.done:
+				return
+			}
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// Queues returns the channels packets are delivered on, one for each nfqueue
+func (q *Queue) Queues() []<-chan []byte {
+	queues := make([]<-chan []byte, len(q.packets))
+	for i, packets := range q.packets {
+		queues[i] = packets
+	}
+	return queues
+}
+
+// Release does nothing. Every packet is a copy the nfqueue library made for it alone, so there is
+// no buffer to reuse and the garbage collector takes it once it is no longer used
+func (q *Queue) Release(packet []byte) {}
+
+// Close closes the queues. Closing an nfqueue sometimes blocks indefinitely, so it is left to run
+// in the background
+func (q *Queue) Close() error {
+	close(q.done)
+	for _, nfq := range q.nfqs {
+		go nfq.Close()
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package source
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ringFrameSize = 2048 // nominal frame size. TPACKET_V3 packs packets into blocks back to back
+	ringRetireMs  = 10   // how long the kernel holds on to a block that is not full yet
+	ringPollMs    = 100  // how often readers check whether the ring was closed
+	blockDescLen  = 8    // version and private offset in front of a block's header
+	ringFreeLen   = 1024 // most packet buffers kept around for reuse
+)
+
+// Ring is a Source reading TPACKET_V3 rings of AF_PACKET sockets. The sockets of a device form a
+// fanout group, so the kernel spreads the device's flows over them by hash without any verdicts
+// to send back. Only ethernet devices are supported
+type Ring struct {
+	sockets []*ringSocket
+	free    chan []byte // released packet buffers, all ringFrameSize long
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// ringSocket is one AF_PACKET socket and the ring mapped from it
+type ringSocket struct {
+	fd        int
+	ring      []byte
+	blockSize int
+	blocks    int
+	packets   chan []byte // packets read off the ring
+}
+
+// NewRing opens fanout sockets on each of devices, each with a ring of blocks blocks of
+// blockSize bytes. Only packets to vips sent to this host are delivered
+func NewRing(devices []string, fanout, blockSize, blocks int, vips []net.IP) (*Ring, error) {
+	if blockSize%os.Getpagesize() != 0 || blockSize < ringFrameSize {
+		return nil, errors.New("ring block size must be a multiple of the page size")
+	}
+	filter, err := vipFilter(vips)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Ring{
+		free: make(chan []byte, ringFreeLen),
+		done: make(chan struct{}),
+	}
+	for i, name := range devices {
+		link, err := net.InterfaceByName(name)
+		if err != nil {
+			r.closeSockets()
+			return nil, err
+		}
+		// fanout groups are shared by the whole network namespace
+		group := (os.Getpid() + i) & 0xffff
+		for j := 0; j < fanout; j++ {
+			s, err := openRingSocket(link.Index, group, blockSize, blocks, filter)
+			if err != nil {
+				r.closeSockets()
+				return nil, errors.New("failed to open ring on " + name + ": " + err.Error())
+			}
+			r.sockets = append(r.sockets, s)
+		}
+	}
+
+	r.wg.Add(len(r.sockets))
+	for _, s := range r.sockets {
+		go s.read(r, &r.wg)
+	}
+	return r, nil
+}
+
+// openRingSocket opens an AF_PACKET socket on the device with index ifindex, filtered by filter,
+// maps its ring and joins it to fanout group
+func openRingSocket(ifindex, group, blockSize, blocks int, filter []unix.SockFilter) (*ringSocket, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, err
+	}
+	s := &ringSocket{fd: fd, blockSize: blockSize, blocks: blocks, packets: make(chan []byte, 100)}
+
+	// filter before binding, so no unwanted packet makes it into the ring
+	err = unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	})
+	if err == nil {
+		err = unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3)
+	}
+	if err == nil {
+		err = unix.SetsockoptTpacketReq3(fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &unix.TpacketReq3{
+			Block_size:     uint32(blockSize),
+			Block_nr:       uint32(blocks),
+			Frame_size:     ringFrameSize,
+			Frame_nr:       uint32(blockSize / ringFrameSize * blocks),
+			Retire_blk_tov: ringRetireMs,
+		})
+	}
+	if err == nil {
+		s.ring, err = unix.Mmap(fd, 0, blockSize*blocks, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	}
+	if err == nil {
+		err = unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifindex})
+	}
+	if err == nil {
+		// the defrag flag is the sign bit of the int the option takes
+		fanout := uint32(group) | (unix.PACKET_FANOUT_HASH|unix.PACKET_FANOUT_FLAG_DEFRAG)<<16
+		err = unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_FANOUT, int(int32(fanout)))
+	}
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// read hands the packets in each block the kernel passes over to the socket's packets, giving the
+// block back once done with it. The fanout keeps a flow on one socket, so that is its order
+func (s *ringSocket) read(r *Ring, wg *sync.WaitGroup) {
+	defer wg.Done()
+	fds := []unix.PollFd{{Fd: int32(s.fd), Events: unix.POLLIN | unix.POLLERR}}
+	for block := 0; ; block = (block + 1) % s.blocks {
+		data := s.ring[block*s.blockSize : (block+1)*s.blockSize]
+		hdr := (*unix.TpacketHdrV1)(unsafe.Pointer(&data[blockDescLen]))
+		for atomic.LoadUint32(&hdr.Block_status)&unix.TP_STATUS_USER == 0 {
+			select {
+			case <-r.done:
+				return
+			default:
+			}
+			_, err := unix.Poll(fds, ringPollMs)
+			if err != nil && err != unix.EINTR {
+				return
+			}
+		}
+
+		offset := hdr.Offset_to_first_pkt
+		for i := uint32(0); i < hdr.Num_pkts; i++ {
+			frame := (*unix.Tpacket3Hdr)(unsafe.Pointer(&data[offset]))
+			start := offset + uint32(frame.Net)
+			end := offset + uint32(frame.Mac) + frame.Snaplen
+			if start < end {
+				// the block is reused as soon as it's given back
+				packet := r.buffer(int(end - start))
+				copy(packet, data[start:end])
+				select {
+				case s.packets <- packet:
+				case <-r.done:
+					return
+				}
+			}
+			offset += frame.Next_offset
+		}
+		atomic.StoreUint32(&hdr.Block_status, unix.TP_STATUS_KERNEL)
+	}
+}
+
+func (s *ringSocket) close() {
+	if s.ring != nil {
+		unix.Munmap(s.ring)
+	}
+	unix.Close(s.fd)
+}
+
+func (r *Ring) closeSockets() {
+	for _, s := range r.sockets {
+		s.close()
+	}
+}
+
+// Queues returns the channels packets are delivered on, one for each socket
+func (r *Ring) Queues() []<-chan []byte {
+	queues := make([]<-chan []byte, len(r.sockets))
+	for i, s := range r.sockets {
+		queues[i] = s.packets
+	}
+	return queues
+}
+
+// buffer gets a buffer for a packet of size bytes, reusing a released one if it fits
+func (r *Ring) buffer(size int) []byte {
+	if size > ringFrameSize {
+		return make([]byte, size)
+	}
+	select {
+	case buf := <-r.free:
+		return buf[:size]
+	default:
+		return make([]byte, size, ringFrameSize)
+	}
+}
+
+// Release puts a packet's buffer up for reuse by the readers
+func (r *Ring) Release(packet []byte) {
+	if cap(packet) != ringFrameSize {
+		return
+	}
+	select {
+	case r.free <- packet:
+	default:
+	}
+}
+
+// Close stops the readers and unmaps the rings
+func (r *Ring) Close() error {
+	close(r.done)
+	r.wg.Wait()
+	r.closeSockets()
+	return nil
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,72 @@
+// Package source provides the ways the balancer can receive the packets sent to its VIPs
+package source
+
+import (
+	"errors"
+	"net"
+	"runtime"
+)
+
+// types of packet source
+const (
+	// NFQueue reads the packets iptables queues to nfqueues 0 and up, dropping each with a verdict.
+	// With more than one queue iptables balances flows over them
+	NFQueue = "nfqueue"
+	// AFPacket reads packets off memory mapped AF_PACKET rings, fanned out over several sockets.
+	// iptables drops the packets, as the rings only get a copy of them
+	AFPacket = "afpacket"
+)
+
+// Source delivers the ip packets sent to the VIPs
+type Source interface {
+	// Queues returns the channels packets are delivered on, starting at their ip header, one for
+	// each reader. A flow only ever arrives on one of them, in the order it was received
+	Queues() []<-chan []byte
+	// Release hands a delivered packet back once it is no longer used, so its buffer can be reused
+	Release(packet []byte)
+	// Close stops delivering packets
+	Close() error
+}
+
+// Config picks and configures a packet source
+type Config struct {
+	Type string // NFQueue or AFPacket
+
+	// only used by NFQueue
+	Queues int // nfqueues to read, each by its own reader. 1 if 0
+
+	// the rest is only used by AFPacket
+	Interfaces []string // ethernet devices to read from
+	Fanout     int      // sockets per device. one per cpu if 0
+	BlockSize  int      // bytes per ring block, a multiple of the page size. 1MiB if 0
+	Blocks     int      // blocks per ring. 64 if 0
+}
+
+// Open opens the source conf describes. Only packets to vips are delivered
+func Open(conf Config, vips []net.IP) (Source, error) {
+	switch conf.Type {
+	case NFQueue, "":
+		if conf.Queues == 0 {
+			conf.Queues = 1
+		}
+		if conf.Queues < 0 || conf.Queues > 65535 {
+			return nil, errors.New("nfqueue source needs between 1 and 65535 queues")
+		}
+		return NewQueue(uint16(conf.Queues), 100)
+	case AFPacket:
+		if len(conf.Interfaces) == 0 {
+			return nil, errors.New("afpacket source needs at least one interface")
+		}
+		if conf.Fanout == 0 {
+			conf.Fanout = runtime.NumCPU()
+		}
+		if conf.BlockSize == 0 {
+			conf.BlockSize = 1 << 20
+		}
+		if conf.Blocks == 0 {
+			conf.Blocks = 64
+		}
+		return NewRing(conf.Interfaces, conf.Fanout, conf.BlockSize, conf.Blocks, vips)
+	}
+	return nil, errors.New("unknown packet source " + conf.Type)
+}
@@ -0,0 +1,444 @@
+package xdp
+
+import (
+	"strconv"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/pwpon500/caplance/internal/balancer/backends"
+)
+
+// xdp verdicts
+const (
+	xdpDrop = 1
+	xdpPass = 2
+	xdpTX   = 3
+)
+
+// layout of the maps shared with the program. Multi byte fields the program only copies into
+// packets are kept in network byte order, everything else in host order, which has to be little
+// endian for the offsets below
+const (
+	// services: ipv4 vip -> the port ranges served on it
+	maxRanges = 8
+	rangeSize = 16 // proto u8, policy u8, from u16, to u16, pad u16, slot base u32, table size u32
+	// slots: slot -> backend id, 0 if the slot is empty
+	// backends: backend id -> how to encapsulate packets to it
+	backendSize = 20 // daddr, saddr, dport u16, outer proto u8, encap length u8, extra header, checksum base
+)
+
+// stack layout of the program, relative to the frame pointer
+const (
+	stackKey   = -4   // u32 map key
+	stackBuf   = -48  // 40 byte buffer the maglev key is built in
+	stackInner = -56  // length of the original packet without its ethernet header
+	stackFib   = -128 // struct bpf_fib_lookup
+	fibSize    = 64
+)
+
+// packet offsets, for an ethernet frame with an ipv4 header without options
+const (
+	ethLen     = 14
+	offEthType = 12
+	offVerIHL  = 14
+	offFrag    = 20
+	offProto   = 23
+	offSrc     = 26
+	offDst     = 30
+	offSrcPort = 34
+	offDstPort = 36
+)
+
+// encapsulation lengths the program knows how to build: ipip, gre, fou or plain udp, and gue
+var encapLens = []int32{20, 24, 28, 32}
+
+// registers. r0 holds return values, r1-r5 are arguments clobbered by calls, r6-r9 survive
+// calls and r10 is the read only frame pointer
+const (
+	r0  = asm.R0
+	r1  = asm.R1
+	r2  = asm.R2
+	r3  = asm.R3
+	r4  = asm.R4
+	r5  = asm.R5
+	r6  = asm.R6
+	r7  = asm.R7
+	r8  = asm.R8
+	r9  = asm.R9
+	r10 = asm.R10
+)
+
+// program collects the instructions of the fast path. Jumps go to labels, which may be placed
+// after the jump
+type program struct {
+	insns asm.Instructions
+	label string // name of the next instruction
+}
+
+func (p *program) emit(insns ...asm.Instruction) {
+	for _, ins := range insns {
+		if p.label != "" {
+			ins = ins.Sym(p.label)
+			p.label = ""
+		}
+		p.insns = append(p.insns, ins)
+	}
+}
+
+// mark names the next instruction, for jumps to go to
+func (p *program) mark(label string) {
+	if p.label != "" {
+		// two labels on one instruction, so the first one jumps to the second
+		p.emit(asm.Ja.Label(label))
+	}
+	p.label = label
+}
+
+// ret returns code from the program
+func (p *program) ret(code int32) {
+	p.emit(asm.Mov.Imm(r0, code), asm.Return())
+}
+
+// buildProgram generates the fast path. It hands packets to the stack unchanged unless they are
+// ipv4 tcp or udp to a port range of a vip in services, hashed by a policy the program knows.
+// Those get hashed into their pool's maglev table the same way the balancer does it in
+// userspace, encapsulated as their backend asks and sent out towards it
+func buildProgram(services, slots, backendMap *ebpf.Map) asm.Instructions {
+	p := &program{}
+	p.emit(asm.Mov.Reg(r6, r1))
+
+	// parse
+	p.emit(
+		asm.LoadMem(r7, r6, 0, asm.Word),
+		asm.LoadMem(r1, r6, 4, asm.Word),
+		asm.Mov.Reg(r2, r7),
+		asm.Add.Imm(r2, offDstPort+2),
+		asm.JGT.Reg(r2, r1, "pass"),
+		asm.LoadMem(r1, r7, offEthType, asm.Half),
+		asm.JNE.Imm(r1, 0x0008, "pass"),
+		asm.LoadMem(r1, r7, offVerIHL, asm.Byte),
+		asm.JNE.Imm(r1, 0x45, "pass"),
+		// fragments can't be hashed by port
+		asm.LoadMem(r1, r7, offFrag, asm.Half),
+		asm.And.Imm(r1, 0xff3f),
+		asm.JNE.Imm(r1, 0, "pass"),
+		asm.LoadMem(r9, r7, offProto, asm.Byte),
+	)
+
+	// find the range the destination port falls in
+	p.emit(
+		asm.LoadMem(r1, r7, offDst, asm.Word),
+		asm.StoreMem(r10, stackKey, r1, asm.Word),
+	)
+	p.lookup(services, "pass")
+	p.emit(
+		asm.Mov.Reg(r8, r0),
+		asm.LoadMem(r5, r7, offDstPort, asm.Half),
+		asm.HostTo(asm.BE, r5, asm.Half),
+	)
+	for i := 0; i < maxRanges; i++ {
+		next := "range" + strconv.Itoa(i+1)
+		off := int16(i * rangeSize)
+		p.emit(
+			asm.LoadMem(r1, r8, off, asm.Byte),
+			asm.JNE.Reg(r1, r9, next),
+			asm.LoadMem(r1, r8, off+2, asm.Half),
+			asm.JLT.Reg(r5, r1, next),
+			asm.LoadMem(r1, r8, off+4, asm.Half),
+			asm.JGT.Reg(r5, r1, next),
+			asm.Add.Imm(r8, int32(off)),
+			asm.Ja.Label("matched"),
+		)
+		p.mark(next)
+	}
+	p.emit(asm.Ja.Label("pass"))
+
+	// build the maglev key like HashConfig.Key does, with ips in their 16 byte form and the
+	// buffer laid out for siphash: zero padded to whole words with the length in the last byte
+	p.mark("matched")
+	for off := int16(stackBuf); off < stackBuf+40; off += 8 {
+		p.emit(asm.StoreImm(r10, off, 0, asm.DWord))
+	}
+	p.emit(
+		asm.StoreImm(r10, stackBuf+10, 0xffff, asm.Half),
+		asm.LoadMem(r2, r7, offSrc, asm.Word),
+		asm.StoreMem(r10, stackBuf+12, r2, asm.Word),
+		asm.LoadMem(r1, r8, 1, asm.Byte),
+		asm.JEq.Imm(r1, PolicySrcIP, "srcip"),
+		asm.JEq.Imm(r1, PolicyFiveTuple, "fivetuple"),
+		asm.JNE.Imm(r1, PolicySrcIPPort, "pass"),
+
+		asm.LoadMem(r2, r7, offSrcPort, asm.Half),
+		asm.StoreMem(r10, stackBuf+16, r2, asm.Half),
+		asm.StoreImm(r10, stackBuf+23, 18, asm.Byte),
+		asm.Ja.Label("hash3"),
+	)
+	p.mark("srcip")
+	p.emit(asm.StoreImm(r10, stackBuf+23, 16, asm.Byte))
+	p.mark("hash3")
+	p.siphash(stackBuf, 3)
+	p.emit(asm.Ja.Label("hashed"))
+
+	p.mark("fivetuple")
+	p.emit(
+		asm.LoadMem(r2, r7, offSrcPort, asm.Half),
+		asm.StoreMem(r10, stackBuf+16, r2, asm.Half),
+		asm.StoreImm(r10, stackBuf+28, 0xffff, asm.Half),
+		// the stack only takes aligned accesses
+		asm.LoadMem(r2, r7, offDst, asm.Half),
+		asm.StoreMem(r10, stackBuf+30, r2, asm.Half),
+		asm.LoadMem(r2, r7, offDst+2, asm.Half),
+		asm.StoreMem(r10, stackBuf+32, r2, asm.Half),
+		asm.LoadMem(r2, r7, offDstPort, asm.Half),
+		asm.StoreMem(r10, stackBuf+34, r2, asm.Half),
+		asm.StoreMem(r10, stackBuf+36, r9, asm.Byte),
+		asm.StoreImm(r10, stackBuf+39, 37, asm.Byte),
+	)
+	p.siphash(stackBuf, 5)
+
+	// slot, then backend
+	p.mark("hashed")
+	p.emit(
+		asm.Mov.Reg(r9, r0),
+		asm.LoadMem(r1, r8, 12, asm.Word),
+		asm.JEq.Imm(r1, 0, "pass"),
+		asm.Mov.Reg(r2, r9),
+		asm.Mod.Reg(r2, r1),
+		asm.LoadMem(r1, r8, 8, asm.Word),
+		asm.Add.Reg(r2, r1),
+		asm.StoreMem(r10, stackKey, r2, asm.Word),
+	)
+	p.lookup(slots, "pass")
+	p.emit(
+		asm.LoadMem(r1, r0, 0, asm.Word),
+		asm.JEq.Imm(r1, 0, "pass"),
+		asm.StoreMem(r10, stackKey, r1, asm.Word),
+	)
+	p.lookup(backendMap, "pass")
+	p.emit(
+		asm.Mov.Reg(r8, r0),
+		asm.LoadMem(r1, r8, 10, asm.Byte),
+		asm.JEq.Imm(r1, 0, "pass"),
+	)
+
+	// route the outer packet. Anything the fib can't resolve on its own, like a neighbor that
+	// was never looked up or a packet needing fragmentation, is left to the stack
+	p.emit(
+		asm.LoadMem(r1, r6, 4, asm.Word),
+		asm.LoadMem(r2, r6, 0, asm.Word),
+		asm.Sub.Reg(r1, r2),
+		asm.Sub.Imm(r1, ethLen),
+		asm.StoreMem(r10, stackInner, r1, asm.DWord),
+	)
+	for off := int16(stackFib); off < stackFib+fibSize; off += 8 {
+		p.emit(asm.StoreImm(r10, off, 0, asm.DWord))
+	}
+	p.emit(
+		asm.StoreImm(r10, stackFib, 2, asm.Byte), // AF_INET
+		asm.LoadMem(r2, r8, 11, asm.Byte),
+		asm.Add.Reg(r2, r1),
+		asm.StoreMem(r10, stackFib+6, r2, asm.Half),
+		asm.LoadMem(r1, r6, 12, asm.Word),
+		asm.StoreMem(r10, stackFib+8, r1, asm.Word),
+		asm.LoadMem(r1, r8, 4, asm.Word),
+		asm.StoreMem(r10, stackFib+16, r1, asm.Word),
+		asm.LoadMem(r1, r8, 0, asm.Word),
+		asm.StoreMem(r10, stackFib+32, r1, asm.Word),
+		asm.Mov.Reg(r1, r6),
+		asm.Mov.Reg(r2, r10),
+		asm.Add.Imm(r2, stackFib),
+		asm.Mov.Imm(r3, fibSize),
+		asm.Mov.Imm(r4, 0),
+		asm.FnFibLookup.Call(),
+		asm.JNE.Imm(r0, 0, "pass"),
+	)
+
+	p.emit(asm.LoadMem(r1, r8, 11, asm.Byte))
+	for _, n := range encapLens {
+		p.emit(asm.JEq.Imm(r1, n, "encap"+strconv.Itoa(int(n))))
+	}
+	p.emit(asm.Ja.Label("pass"))
+	for _, n := range encapLens {
+		p.mark("encap" + strconv.Itoa(int(n)))
+		p.encapsulate(n)
+		p.emit(asm.Ja.Label("send"))
+	}
+
+	// out the device the fib picked, which is usually the one the packet came in on
+	p.mark("send")
+	p.emit(
+		asm.LoadMem(r1, r10, stackFib+8, asm.Word),
+		asm.LoadMem(r2, r6, 12, asm.Word),
+		asm.JEq.Reg(r1, r2, "tx"),
+		asm.Mov.Imm(r2, 0),
+		asm.FnRedirect.Call(),
+		asm.Return(),
+	)
+	p.mark("tx")
+	p.ret(xdpTX)
+	p.mark("pass")
+	p.ret(xdpPass)
+	p.mark("drop")
+	p.ret(xdpDrop)
+
+	return p.insns
+}
+
+// lookup looks up the u32 key on the stack in m, jumping to miss if it's not there. The value
+// ends up in r0
+func (p *program) lookup(m *ebpf.Map, miss string) {
+	p.emit(
+		asm.LoadMapPtr(r1, m.FD()),
+		asm.Mov.Reg(r2, r10),
+		asm.Add.Imm(r2, stackKey),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(r0, 0, miss),
+	)
+}
+
+// encapsulate puts n bytes of outer headers in front of the packet as the backend in r8
+// describes, with the ethernet header the fib lookup resolved. The flow hash is in r9
+func (p *program) encapsulate(n int32) {
+	p.emit(
+		asm.Mov.Reg(r1, r6),
+		asm.Mov.Imm(r2, -n),
+		asm.FnXdpAdjustHead.Call(),
+		asm.JNE.Imm(r0, 0, "pass"),
+		asm.LoadMem(r7, r6, 0, asm.Word),
+		asm.LoadMem(r1, r6, 4, asm.Word),
+		asm.Mov.Reg(r2, r7),
+		asm.Add.Imm(r2, ethLen+n),
+		// can't happen as the packet only grew, but the verifier wants to know
+		asm.JGT.Reg(r2, r1, "drop"),
+
+		// ethernet
+		asm.LoadMem(r1, r10, stackFib+58, asm.Half),
+		asm.StoreMem(r7, 0, r1, asm.Half),
+		asm.LoadMem(r1, r10, stackFib+60, asm.Word),
+		asm.StoreMem(r7, 2, r1, asm.Word),
+		asm.LoadMem(r1, r10, stackFib+52, asm.Word),
+		asm.StoreMem(r7, 6, r1, asm.Word),
+		asm.LoadMem(r1, r10, stackFib+56, asm.Half),
+		asm.StoreMem(r7, 10, r1, asm.Half),
+		asm.StoreImm(r7, offEthType, 0x0008, asm.Half),
+
+		// ipv4, with the checksum finished from the base the map holds
+		asm.StoreImm(r7, offVerIHL, 0x45, asm.Byte),
+		asm.StoreImm(r7, offVerIHL+1, 0, asm.Byte),
+		asm.LoadMem(r2, r10, stackInner, asm.DWord),
+		asm.Add.Imm(r2, n),
+		asm.Mov.Reg(r3, r2),
+		asm.HostTo(asm.BE, r3, asm.Half),
+		asm.StoreMem(r7, 16, r3, asm.Half),
+		asm.StoreImm(r7, 18, 0, asm.Half),
+		asm.StoreImm(r7, offFrag, 0, asm.Half),
+		asm.StoreImm(r7, 22, ttl, asm.Byte),
+		asm.LoadMem(r1, r8, 10, asm.Byte),
+		asm.StoreMem(r7, offProto, r1, asm.Byte),
+		asm.LoadMem(r1, r8, 16, asm.Word),
+		asm.Add.Reg(r1, r2),
+	)
+	for i := 0; i < 2; i++ {
+		p.emit(
+			asm.Mov.Reg(r3, r1),
+			asm.RSh.Imm(r3, 16),
+			asm.And.Imm(r1, 0xffff),
+			asm.Add.Reg(r1, r3),
+		)
+	}
+	p.emit(
+		asm.Xor.Imm(r1, 0xffff),
+		asm.HostTo(asm.BE, r1, asm.Half),
+		asm.StoreMem(r7, 24, r1, asm.Half),
+		asm.LoadMem(r1, r8, 4, asm.Word),
+		asm.StoreMem(r7, offSrc, r1, asm.Word),
+		asm.LoadMem(r1, r8, 0, asm.Word),
+		asm.StoreMem(r7, offDst, r1, asm.Word),
+	)
+
+	switch n {
+	case 24:
+		// gre
+		p.emit(
+			asm.LoadMem(r1, r8, 12, asm.Word),
+			asm.StoreMem(r7, offSrcPort, r1, asm.Word),
+		)
+	case 28, 32:
+		// udp, with the source port taken from the flow hash so flows spread over the
+		// backend's receive queues. The checksum is optional over ipv4
+		p.emit(
+			asm.Mov.Reg(r1, r9),
+			asm.And.Imm(r1, 0x3fff),
+			asm.Or.Imm(r1, 0xc000),
+			asm.HostTo(asm.BE, r1, asm.Half),
+			asm.StoreMem(r7, offSrcPort, r1, asm.Half),
+			asm.LoadMem(r1, r8, 8, asm.Half),
+			asm.StoreMem(r7, offDstPort, r1, asm.Half),
+			asm.Sub.Imm(r2, 20),
+			asm.HostTo(asm.BE, r2, asm.Half),
+			asm.StoreMem(r7, 38, r2, asm.Half),
+			asm.StoreImm(r7, 40, 0, asm.Half),
+		)
+		if n == 32 {
+			p.emit(
+				asm.LoadMem(r1, r8, 12, asm.Word),
+				asm.StoreMem(r7, 42, r1, asm.Word),
+			)
+		}
+	}
+}
+
+// siphash computes siphash-2-4 of the words at buf on the stack under the maglev key into r0.
+// Clobbers r1-r5
+func (p *program) siphash(buf int16, words int) {
+	v0, v1, v2, v3, m, tmp := r0, r1, r2, r3, r4, r5
+	var k0, k1 uint64 = backends.KeySeed, 0
+	p.emit(
+		asm.LoadImm(v0, int64(k0^0x736f6d6570736575), asm.DWord),
+		asm.LoadImm(v1, int64(k1^0x646f72616e646f6d), asm.DWord),
+		asm.LoadImm(v2, int64(k0^0x6c7967656e657261), asm.DWord),
+		asm.LoadImm(v3, int64(k1^0x7465646279746573), asm.DWord),
+	)
+
+	rotl := func(x asm.Register, b int32) {
+		p.emit(
+			asm.Mov.Reg(tmp, x),
+			asm.LSh.Imm(x, b),
+			asm.RSh.Imm(tmp, 64-b),
+			asm.Or.Reg(x, tmp),
+		)
+	}
+	round := func() {
+		p.emit(asm.Add.Reg(v0, v1))
+		rotl(v1, 13)
+		p.emit(asm.Xor.Reg(v1, v0))
+		rotl(v0, 32)
+		p.emit(asm.Add.Reg(v2, v3))
+		rotl(v3, 16)
+		p.emit(asm.Xor.Reg(v3, v2), asm.Add.Reg(v0, v3))
+		rotl(v3, 21)
+		p.emit(asm.Xor.Reg(v3, v0), asm.Add.Reg(v2, v1))
+		rotl(v1, 17)
+		p.emit(asm.Xor.Reg(v1, v2))
+		rotl(v2, 32)
+	}
+
+	for w := 0; w < words; w++ {
+		p.emit(
+			asm.LoadMem(m, r10, buf+int16(8*w), asm.DWord),
+			asm.Xor.Reg(v3, m),
+		)
+		round()
+		round()
+		p.emit(asm.Xor.Reg(v0, m))
+	}
+	p.emit(asm.Xor.Imm(v2, 0xff))
+	for i := 0; i < 4; i++ {
+		round()
+	}
+	p.emit(
+		asm.Xor.Reg(v0, v1),
+		asm.Xor.Reg(v0, v2),
+		asm.Xor.Reg(v0, v3),
+	)
+}
@@ -0,0 +1,363 @@
+// Package xdp forwards packets to the VIPs in the kernel. An xdp program attached to the devices
+// the VIPs' traffic comes in on hashes each flow into the maglev table of its service, kept in a
+// bpf map in sync with the backends.Pool, and encapsulates the packet to its backend straight
+// from the driver. Whatever the program can't handle goes on to the stack and the userspace path.
+// That includes every flow to a backend that authenticates its packets: the program has no way to
+// compute their hmac, so those backends keep the userspace path's latency whatever is configured.
+// The program is assembled here rather than compiled, so building needs no clang
+package xdp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/pwpon500/caplance/internal/balancer/backends"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// policies the program hashes flows by
+const (
+	// PolicySrcIPPort hashes the source ip and port
+	PolicySrcIPPort = 0
+	// PolicyFiveTuple hashes the protocol and the source and destination ips and ports
+	PolicyFiveTuple = 1
+	// PolicySrcIP hashes only the source ip
+	PolicySrcIP = 2
+	// PolicyUserspace leaves the range's flows to userspace
+	PolicyUserspace = 3
+
+	maxVIPs     = 1024
+	maxBackends = 4096
+	ttl         = 64
+)
+
+// littleEndian is whether the host puts the low byte of a value first, as the program and the
+// layout of its maps assume
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// Config configures the xdp fast path. Flows to backends authenticating their packets, which
+// udp backends decapsulating in userspace do, are always left to the userspace path
+type Config struct {
+	Interfaces []string // devices to attach the program to. the VIPs' devices if empty
+	Generic    bool     // attach in generic mode, which works on any device but is slower
+}
+
+// Range is a port range of a VIP and the pool its flows are forwarded to
+type Range struct {
+	Proto  uint8 // ip protocol number, tcp or udp
+	From   uint16
+	To     uint16
+	Policy uint8 // one of the Policy constants
+	Pool   *backends.Pool
+}
+
+// poolState is what of a pool's maglev table the maps currently hold
+type poolState struct {
+	base  uint32            // first slot of the pool in the slots map
+	slots []uint32          // backend id in each slot
+	ids   map[string]uint32 // id of each of the pool's backends
+}
+
+// Datapath is a loaded xdp program with its maps
+type Datapath struct {
+	services  *ebpf.Map
+	slots     *ebpf.Map
+	backends  *ebpf.Map
+	prog      *ebpf.Program
+	generic   bool
+	pools     map[*backends.Pool]*poolState
+	free      []uint32        // backend ids to hand out
+	links     []netlink.Link  // devices the program is attached to
+	userspace map[string]bool // backends left to userspace, so each is only logged once
+	mux       sync.Mutex      // guards the maps, pools, free, links and userspace
+}
+
+// New creates the maps for pools and loads the program. Each pool gets a share of the slots map
+// the size of its maglev table. Throws error if the kernel rejects the maps or the program, or
+// the host is big endian
+func New(pools []*backends.Pool, generic bool) (*Datapath, error) {
+	if !littleEndian {
+		return nil, errors.New("the xdp fast path only runs on little endian hosts")
+	}
+	d := &Datapath{
+		generic:   generic,
+		pools:     make(map[*backends.Pool]*poolState),
+		userspace: make(map[string]bool),
+	}
+	var total uint32
+	for _, pool := range pools {
+		d.pools[pool] = &poolState{
+			base:  total,
+			slots: make([]uint32, pool.Capacity()),
+			ids:   make(map[string]uint32),
+		}
+		total += uint32(pool.Capacity())
+	}
+	// id 0 marks an empty slot
+	for id := uint32(maxBackends - 1); id > 0; id-- {
+		d.free = append(d.free, id)
+	}
+
+	var err error
+	d.services, err = newMap(ebpf.Hash, 4, maxRanges*rangeSize, maxVIPs)
+	if err == nil {
+		d.slots, err = newMap(ebpf.Array, 4, 4, total)
+	}
+	if err == nil {
+		d.backends, err = newMap(ebpf.Array, 4, backendSize, maxBackends)
+	}
+	if err == nil {
+		d.prog, err = ebpf.NewProgram(&ebpf.ProgramSpec{
+			Name:         "caplance",
+			Type:         ebpf.XDP,
+			Instructions: buildProgram(d.services, d.slots, d.backends),
+			License:      "GPL",
+		})
+		if err != nil {
+			err = errors.New("failed to load xdp program: " + err.Error())
+		}
+	}
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func newMap(mapType ebpf.MapType, keySize, valueSize, maxEntries uint32) (*ebpf.Map, error) {
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       mapType,
+		KeySize:    keySize,
+		ValueSize:  valueSize,
+		MaxEntries: maxEntries,
+	})
+	if err != nil {
+		return nil, errors.New("failed to create bpf map: " + err.Error())
+	}
+	return m, nil
+}
+
+// SetVIP sets the port ranges forwarded in the kernel for vip. Only the first few ranges are, the
+// rest and ipv6 VIPs are left to userspace
+func (d *Datapath) SetVIP(vip net.IP, ranges []Range) error {
+	ip4 := vip.To4()
+	if ip4 == nil {
+		return nil
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	value := make([]byte, maxRanges*rangeSize)
+	for i, r := range ranges {
+		if i == maxRanges {
+			break
+		}
+		state, ok := d.pools[r.Pool]
+		if !ok {
+			return errors.New("pool " + r.Pool.Name() + " is not in the xdp datapath")
+		}
+		entry := value[i*rangeSize:]
+		entry[0] = r.Proto
+		entry[1] = r.Policy
+		binary.LittleEndian.PutUint16(entry[2:], r.From)
+		binary.LittleEndian.PutUint16(entry[4:], r.To)
+		binary.LittleEndian.PutUint32(entry[8:], state.base)
+		binary.LittleEndian.PutUint32(entry[12:], uint32(len(state.slots)))
+	}
+	return d.services.Put(ip4, value)
+}
+
+// Sync copies the current maglev table of pool into the maps. Backends are written before the
+// slots pointing to them and removed after, so the program never sees a slot without its backend.
+// Does nothing once the datapath is closed
+func (d *Datapath) Sync(pool *backends.Pool) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.prog == nil {
+		return nil
+	}
+	state, ok := d.pools[pool]
+	if !ok {
+		return errors.New("pool " + pool.Name() + " is not in the xdp datapath")
+	}
+
+	live := make(map[string]uint32)
+	for _, back := range pool.GetBackends() {
+		id, ok := state.ids[back.Name()]
+		if !ok {
+			if len(d.free) == 0 {
+				return errors.New("too many backends for the xdp datapath")
+			}
+			id = d.free[len(d.free)-1]
+			d.free = d.free[:len(d.free)-1]
+			state.ids[back.Name()] = id
+		}
+		// re-registered backends keep their name but may have moved
+		entry, reason := backendEntry(back)
+		if reason != "" && !d.userspace[back.Name()] {
+			log.Infoln("Forwarding flows to backend " + back.Name() + " in userspace: " + reason)
+		}
+		d.userspace[back.Name()] = reason != ""
+		err := d.backends.Put(idKey(id), entry)
+		if err != nil {
+			return errors.New("failed to update backend " + back.Name() + ": " + err.Error())
+		}
+		live[back.Name()] = id
+	}
+
+	names := pool.Slots()
+	for i := range state.slots {
+		var id uint32
+		if i < len(names) {
+			id = live[names[i]]
+		}
+		if state.slots[i] == id {
+			continue
+		}
+		err := d.slots.Put(idKey(state.base+uint32(i)), idKey(id))
+		if err != nil {
+			return errors.New("failed to update slot: " + err.Error())
+		}
+		state.slots[i] = id
+	}
+
+	for name, id := range state.ids {
+		if _, ok := live[name]; ok {
+			continue
+		}
+		err := d.backends.Put(idKey(id), make([]byte, backendSize))
+		if err != nil {
+			return errors.New("failed to remove backend " + name + ": " + err.Error())
+		}
+		delete(state.ids, name)
+		delete(d.userspace, name)
+		d.free = append(d.free, id)
+	}
+	return nil
+}
+
+// Attach attaches the program to links, replacing what was attached before
+func (d *Datapath) Attach(links []netlink.Link) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.detach()
+	for _, link := range links {
+		err := netlink.LinkSetXdpFdWithFlags(link, d.prog.FD(), d.flags())
+		if err != nil {
+			d.detach()
+			return errors.New("failed to attach xdp program to " + link.Attrs().Name + ": " + err.Error())
+		}
+		d.links = append(d.links, link)
+	}
+	return nil
+}
+
+// Detach takes the program off every device it is attached to
+func (d *Datapath) Detach() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.detach()
+}
+
+// detach takes the program off its devices. Must hold d.mux
+func (d *Datapath) detach() {
+	for _, link := range d.links {
+		netlink.LinkSetXdpFdWithFlags(link, -1, d.flags())
+	}
+	d.links = nil
+}
+
+func (d *Datapath) flags() int {
+	if d.generic {
+		return nl.XDP_FLAGS_SKB_MODE
+	}
+	return 0
+}
+
+// Close detaches the program and frees it and its maps
+func (d *Datapath) Close() {
+	d.Detach()
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.prog != nil {
+		d.prog.Close()
+		d.prog = nil
+	}
+	for _, m := range []*ebpf.Map{d.services, d.slots, d.backends} {
+		if m != nil {
+			m.Close()
+		}
+	}
+	d.services, d.slots, d.backends = nil, nil, nil
+}
+
+func idKey(id uint32) []byte {
+	key := make([]byte, 4)
+	binary.LittleEndian.PutUint32(key, id)
+	return key
+}
+
+// backendEntry describes how the program encapsulates packets to back. Backends it can't
+// encapsulate for, ipv6 ones and those authenticating their packets, get an empty entry, which
+// leaves them to userspace, along with the reason why
+func backendEntry(back *backends.Backend) ([]byte, string) {
+	entry := make([]byte, backendSize)
+	daddr := back.IP().To4()
+	if daddr == nil {
+		return entry, "it is reached over ipv6"
+	}
+	routes, err := netlink.RouteGet(daddr)
+	if err != nil || len(routes) == 0 || routes[0].Src.To4() == nil {
+		return entry, "it has no ipv4 route"
+	}
+	saddr := routes[0].Src.To4()
+
+	encap := back.Encap()
+	port := encap.Port
+	if port == 0 {
+		port = backends.DataPort
+	}
+	var proto uint8
+	var hlen uint8
+	switch encap.Type {
+	case backends.EncapIPIP:
+		proto, hlen = 4, 20
+	case backends.EncapGRE:
+		proto, hlen = 47, 24
+		copy(entry[12:], []byte{0, 0, 0x08, 0x00})
+	case backends.EncapUDP, "":
+		if encap.Auth != nil {
+			return entry, "it authenticates its packets"
+		}
+		proto, hlen = 17, 28
+	case backends.EncapFOU:
+		proto, hlen = 17, 28
+	case backends.EncapGUE:
+		proto, hlen = 17, 32
+		copy(entry[12:], []byte{0, 4, 0, 0})
+	default:
+		return entry, "its encapsulation is unknown to the program"
+	}
+
+	copy(entry[0:], daddr)
+	copy(entry[4:], saddr)
+	binary.BigEndian.PutUint16(entry[8:], uint16(port))
+	entry[10] = proto
+	entry[11] = hlen
+	// the header checksum without the total length, which the program adds per packet
+	sum := uint32(0x4500) + (uint32(ttl)<<8 | uint32(proto))
+	for i := 0; i < 8; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(entry[i:]))
+	}
+	binary.LittleEndian.PutUint32(entry[16:], sum)
+	return entry, ""
+}
@@ -1,18 +1,24 @@
 package client
 
 import (
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
+	"math/rand"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
 
+	"github.com/pwpon500/caplance/pkg/protocol"
 	"github.com/pwpon500/caplance/pkg/util"
 )
 
@@ -30,23 +36,78 @@ const (
 	Paused HealthState = 3
 	// Deregistering represents state when client is deregistering
 	Deregistering HealthState = 4
+	// Draining represents state when only established flows are being forwarded to the client.
+	// The balancer pauses the client once they are done
+	Draining HealthState = 5
+	// Reconnecting represents state when the connection to the balancer was lost and the client
+	// is trying to register again
+	Reconnecting HealthState = 6
+)
+
+const (
+	reconnectBase = time.Second      // wait before the first reconnect attempt
+	reconnectMax  = 60 * time.Second // longest wait between reconnect attempts
 )
 
 // Client holds the current state and configuration for a backend
 type Client struct {
-	dataIP       net.IP            // ip for the lb to forward packets to
-	vip          net.IP            // vip for the cluster
-	state        HealthState       // state of backend as described by the above consts
-	comm         util.Communicator // communicator between backend and lb
-	dataListener net.PacketConn    // listener for packets forwarded from lb
-	name         string            // name of backend
-	packets      chan *rawPacket   // channel of packets to process
-	stopChan     chan os.Signal    // channel to capture SIGTERM and SIGINT for graceful stop
-	unixSock     net.Listener      // unix sock for communicating with caplancectl
+	dataIP       net.IP          // ip for the lb to forward packets to
+	vips         []net.IP        // vips for the cluster, either family
+	state        HealthState     // state of backend as described by the above consts. guarded by stateMux
+	balancers    []*balancerConn // balancers the client registers with
+	dataListener net.PacketConn  // listener for packets forwarded from lb
+	name         string          // name of backend
+	packets      chan *rawPacket // channel of packets to process
+	stopChan     chan os.Signal  // channel to capture SIGTERM and SIGINT for graceful stop
+	unixSock     net.Listener    // unix sock for communicating with caplancectl
 	readTimeout  int
 	writeTimeout int
 	healthRate   int
 	sockaddr     string
+	encap        string            // how the balancer encapsulates packets for us
+	encapPort    int               // port the kernel receives fou/gue packets on
+	weight       int               // share of traffic relative to other backends, guarded by stateMux
+	service      string            // pool to join when the vip is shared by several. empty if not
+	labels       map[string]string // sent to the balancer when registering. version 2 only
+	protocol     int               // newest protocol version to speak with the balancers
+	batch        util.BatchConfig  // how udp encapsulated packets are batched into syscalls
+	fou          *netlink.Fou      // fou port opened for kernel decapsulation
+	tunnels      []netlink.Link    // tunnel devices created for kernel decapsulation
+
+	health       HealthConfig  // probes deciding the status sent in health checks
+	probeResults []probeResult // last result of each probe, guarded by probeMux
+	probeMux     sync.Mutex
+	streak       ProbeStreak // health checks passed and failed in a row, guarded by stateMux
+	stateMux     sync.Mutex  // guards the state, shared by the health loop, the balancer connections and rpc
+
+	sanity       chan string // sanity checks picked off the data socket by listen
+	listening    uint32      // whether listen owns the data socket. atomic
+	registerMux  sync.Mutex  // one registration at a time, as sanity checks share the data socket
+	restoreState HealthState // state to go back to once a lost balancer connection is restored. guarded by stateMux
+	tls          *tls.Config // tls for the connections to the balancers. plaintext if nil
+
+	dataKeys        map[uint32]*dataKey // keys udp packets from the balancers are sealed with, by id
+	keyMux          sync.Mutex          // guards dataKeys
+	unauthenticated uint64              // packets dropped for failing authentication. atomic
+	replayed        uint64              // packets dropped as replays. atomic
+}
+
+// balancerConn is the client's registration with one balancer
+type balancerConn struct {
+	ip      net.IP
+	conn    *protocol.Conn // nil while the connection is lost, guarded by connMux
+	connMux sync.Mutex
+	auth    *util.DataAuth // key the balancer seals our packets with. nil with kernel decap
+	view    string         // state the balancer last acked our health check with, guarded by the client's stateMux
+
+	pending    map[uint64]string // type of each request still waiting for a reply, by id
+	pendingMux sync.Mutex
+}
+
+// dataKey is a key a balancer seals packets with and the sequence numbers seen under it
+type dataKey struct {
+	auth   *util.DataAuth
+	window util.ReplayWindow
 }
 
 // struct to hold an individual data packet recieved from lb
@@ -55,88 +116,117 @@ type rawPacket struct {
 	size    int
 }
 
-// NewClient creates a new Client object
-func NewClient(name string, vip, dataIP net.IP, readTimeout, writeTimeout, healthRate int, sockaddr string) *Client {
+// Config configures a Client
+type Config struct {
+	Name         string            // name to register under
+	VIPs         []net.IP          // vips for the cluster, either family
+	DataIP       net.IP            // ip for the balancers to forward packets to
+	ReadTimeout  int               // seconds to wait on a read from a balancer
+	WriteTimeout int               // seconds to wait on a write to a balancer
+	HealthRate   int               // seconds between health checks
+	Sockaddr     string            // unix socket for caplancectl
+	Encap        string            // one of EncapUDP, EncapFOU, EncapGUE, EncapIPIP or EncapGRE
+	EncapPort    int               // port the kernel receives fou/gue packets on. only used for fou and gue
+	Weight       int               // share of traffic relative to other backends
+	Service      string            // pool to join. may be empty unless the vip is shared by several services
+	Health       HealthConfig      // probes deciding the status reported in health checks
+	TLS          *tls.Config       // tls for the connections to the balancers. plaintext if nil
+	Labels       map[string]string // sent to the balancers when registering. version 2 only
+	Protocol     int               // newest protocol version to speak with the balancers
+	Batch        util.BatchConfig  // how udp encapsulated packets are batched into syscalls
+}
+
+// NewClient creates a new Client object from conf
+func NewClient(conf Config) *Client {
 	return &Client{
-		dataIP:       dataIP,
-		vip:          vip,
+		dataIP:       conf.DataIP,
+		vips:         conf.VIPs,
 		state:        Unregistered,
-		name:         name,
+		name:         conf.Name,
 		packets:      make(chan *rawPacket, 100),
 		stopChan:     make(chan os.Signal, 5),
-		readTimeout:  readTimeout,
-		writeTimeout: writeTimeout,
-		healthRate:   healthRate,
-		sockaddr:     sockaddr}
+		readTimeout:  conf.ReadTimeout,
+		writeTimeout: conf.WriteTimeout,
+		healthRate:   conf.HealthRate,
+		sockaddr:     conf.Sockaddr,
+		encap:        conf.Encap,
+		encapPort:    conf.EncapPort,
+		weight:       conf.Weight,
+		service:      conf.Service,
+		health:       conf.Health,
+		probeResults: make([]probeResult, len(conf.Health.Probes)),
+		streak:       ProbeStreak{Rise: conf.Health.Rise, Fall: conf.Health.Fall},
+		sanity:       make(chan string, 1),
+		tls:          conf.TLS,
+		labels:       conf.Labels,
+		protocol:     conf.Protocol,
+		batch:        conf.Batch,
+		dataKeys:     make(map[uint32]*dataKey)}
 }
 
-// Start attempts to register and listen for connections
-func (c *Client) Start(connectIP net.IP) error {
-	c.state = Registering
-	conn, err := net.Dial("tcp", connectIP.String()+":1338")
-	if err != nil {
-		return err
+// Start attempts to register with every balancer in connectIPs and listen for connections. It
+// only needs one of them to accept the registration and keeps retrying the others in the
+// background
+func (c *Client) Start(connectIPs []net.IP) error {
+	c.setState(Registering)
+	for _, ip := range connectIPs {
+		c.balancers = append(c.balancers, &balancerConn{ip: ip})
 	}
-	c.comm = util.NewTCPCommunicator(conn, c.readTimeout, c.writeTimeout)
 
-	ender := func() { c.comm.Close() }
-
-	err = c.comm.WriteLine("REGISTER " + c.name + " " + c.dataIP.String())
-	if err != nil {
-		ender()
-		return err
+	// the balancer's control messages come through the tunnel addressed to the data ip, or to a vip
+	// if the tunnel only carries ipv6. either has to be local by the time the sanity check arrives
+	controlAddr := net.JoinHostPort(c.dataIP.String(), "1337")
+	if c.kernelDecap() {
+		err := c.setupKernelDecap()
+		if err != nil {
+			return err
+		}
+		err = c.attachVIP()
+		if err != nil {
+			c.teardownKernelDecap()
+			return err
+		}
+		if !util.HasIPv4(c.vips) {
+			controlAddr = "[::]:1337"
+		}
 	}
 
-	c.dataListener, err = net.ListenPacket("udp", c.dataIP.String()+":1337")
+	var err error
+	c.dataListener, err = net.ListenPacket("udp", controlAddr)
 	if err != nil {
-		ender()
+		if c.kernelDecap() {
+			c.detachVIP()
+		}
+		c.teardownKernelDecap()
 		return err
 	}
 
-	ender = func() {
-		c.comm.Close()
+	ender := func() {
 		c.dataListener.Close()
+		if c.kernelDecap() {
+			c.detachVIP()
+		}
+		c.teardownKernelDecap()
 	}
 
-	mtu, err := c.getMTU()
-	if err != nil {
-		ender()
-		return err
-	}
-
-	sanityString := ""
-	buf := make([]byte, mtu)
-	sanityFailTime := time.Now().Add(time.Duration(c.readTimeout) * time.Second)
-	for !strings.HasPrefix(sanityString, "SANITY") && !time.Now().After(sanityFailTime) {
-		n, _, err := c.dataListener.ReadFrom(buf)
+	for _, bc := range c.balancers {
+		err = c.register(bc)
 		if err != nil {
-			ender()
-			return err
+			log.Warnln("Failed to register with balancer " + bc.ip.String() + ": " + err.Error())
 		}
-		sanityString = string(buf[:n])
 	}
-
-	sanitySplit := strings.Split(sanityString, " ")
-	if sanitySplit[0] != "SANITY" || len(sanitySplit) < 2 {
-		ender()
-		return errors.New("failed to complete sanity check in " + strconv.Itoa(c.readTimeout) + " seconds.")
-	}
-
-	c.comm.WriteLine("SANE " + sanitySplit[1])
-
-	resp, err := c.comm.ReadLine()
-	if err != nil {
+	if !c.connected() {
 		ender()
 		return err
 	}
-
-	tokens := strings.Split(resp, " ")
-	if tokens[0] != "REGISTERED" {
-		ender()
-		return errors.New(resp)
+	ender = func() {
+		c.closeBalancers()
+		c.dataListener.Close()
+		c.detachVIP()
+		c.teardownKernelDecap()
 	}
 
-	c.state = Paused
+	c.setState(Paused)
 
 	err = c.attachVIP()
 	if err != nil {
@@ -154,14 +244,431 @@ func (c *Client) Start(connectIP net.IP) error {
 	}()
 
 	var wg sync.WaitGroup
-	wg.Add(3)
-	go c.manageBalancerConnection(&wg)
-	go c.listen(&wg)
+	wg.Add(len(c.balancers))
+	if c.kernelDecap() {
+		// the kernel delivers packets to the vip on its own, so there's no
+		// data loop to run
+		c.setState(Active)
+	} else {
+		// listen owns the data socket from here on, so no registration may read off it, or set its
+		// deadline, even before listen gets to its first read
+		atomic.StoreUint32(&c.listening, 1)
+		wg.Add(1)
+		go func() {
+			err := c.listen(&wg)
+			if err != nil {
+				log.Errorln("Failed to listen for packets: " + err.Error())
+			}
+		}()
+	}
+	for _, bc := range c.balancers {
+		go c.manageBalancerConnection(bc, &wg)
+	}
+	go c.sendHealth()
 	go c.listenUnix()
 	wg.Wait()
 	return nil
 }
 
+// register dials the balancer and registers with it, answering its sanity check. bc.conn is only
+// replaced once registration succeeds
+func (c *Client) register(bc *balancerConn) error {
+	c.registerMux.Lock()
+	defer c.registerMux.Unlock()
+
+	addr := net.JoinHostPort(bc.ip.String(), "1338")
+	var comm util.Communicator
+	if c.tls != nil {
+		conn, err := tls.Dial("tcp", addr, c.tls)
+		if err != nil {
+			return err
+		}
+		comm = util.NewTLSCommunicator(conn, c.readTimeout, c.writeTimeout)
+	} else {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		comm = util.NewTCPCommunicator(conn, c.readTimeout, c.writeTimeout)
+	}
+
+	// drop any sanity check left over from an earlier attempt
+	select {
+	case <-c.sanity:
+	default:
+	}
+
+	conn, hello, err := protocol.Connect(comm, c.protocol, protocol.Capabilities)
+	if err != nil {
+		comm.Close()
+		return err
+	}
+
+	// every registration gets a fresh key, so packets from an earlier one can't be replayed
+	var auth *util.DataAuth
+	var exchange []byte
+	if !c.kernelDecap() {
+		auth, exchange, err = c.dataAuth(hello)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		c.keyMux.Lock()
+		c.dataKeys[auth.KeyID()] = &dataKey{auth: auth}
+		c.keyMux.Unlock()
+	}
+	registered := false
+	defer func() {
+		if !registered && auth != nil {
+			c.forgetKey(auth)
+		}
+	}()
+
+	err = conn.Request(c.registerMessage(auth, exchange))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	nonce, err := c.readSanity()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.Request(&protocol.Message{Type: protocol.Sane, Nonce: nonce})
+
+	resp, err := conn.ReadMessage()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if resp.Type != protocol.Registered {
+		conn.Close()
+		return errors.New(resp.String())
+	}
+
+	if bc.auth != nil {
+		c.forgetKey(bc.auth)
+	}
+	registered = true
+	bc.auth = auth
+	bc.pendingMux.Lock()
+	bc.pending = make(map[uint64]string)
+	bc.pendingMux.Unlock()
+	// the health loop and rpc send on the connection from their own goroutines
+	bc.connMux.Lock()
+	bc.conn = conn
+	bc.connMux.Unlock()
+	return nil
+}
+
+// current returns the connection to the balancer, or nil if it was lost
+func (bc *balancerConn) current() *protocol.Conn {
+	bc.connMux.Lock()
+	defer bc.connMux.Unlock()
+	return bc.conn
+}
+
+// request sends m to the balancer, remembering it until the reply comes in. Version 1 replies
+// carry no id, so nothing is remembered there
+func (bc *balancerConn) request(m *protocol.Message) error {
+	conn := bc.current()
+	if conn == nil {
+		return errors.New("not connected to balancer " + bc.ip.String())
+	}
+	err := conn.Request(m)
+	if err != nil || conn.Version() < protocol.V2 {
+		return err
+	}
+	bc.pendingMux.Lock()
+	bc.pending[m.ID] = m.Type
+	bc.pendingMux.Unlock()
+	return nil
+}
+
+// answered returns the type of the request reply answers, or an empty string if the reply
+// answers no outstanding request
+func (bc *balancerConn) answered(reply *protocol.Message) string {
+	bc.pendingMux.Lock()
+	defer bc.pendingMux.Unlock()
+	req, ok := bc.pending[reply.ID]
+	if ok {
+		delete(bc.pending, reply.ID)
+	}
+	return req
+}
+
+// forgetKey stops accepting packets sealed with auth
+func (c *Client) forgetKey(auth *util.DataAuth) {
+	c.keyMux.Lock()
+	delete(c.dataKeys, auth.KeyID())
+	c.keyMux.Unlock()
+}
+
+// authenticate opens a packet sealed by a balancer, dropping and counting packets that fail
+// authentication or were seen before
+func (c *Client) authenticate(sealed []byte) ([]byte, bool) {
+	id, ok := util.SealedKeyID(sealed)
+	c.keyMux.Lock()
+	key := c.dataKeys[id]
+	c.keyMux.Unlock()
+	if !ok || key == nil {
+		atomic.AddUint64(&c.unauthenticated, 1)
+		return nil, false
+	}
+
+	packet, seq, err := key.auth.Open(sealed)
+	if err != nil {
+		atomic.AddUint64(&c.unauthenticated, 1)
+		return nil, false
+	}
+	if !key.window.Check(seq) {
+		atomic.AddUint64(&c.replayed, 1)
+		return nil, false
+	}
+	return packet, true
+}
+
+// connected returns whether the client is connected to at least one balancer
+func (c *Client) connected() bool {
+	for _, bc := range c.balancers {
+		if bc.current() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// agreedView returns the state every connected balancer that acked a health check has the
+// client in, or an empty string if they don't agree yet. Must hold c.stateMux
+func (c *Client) agreedView() string {
+	view := ""
+	for _, bc := range c.balancers {
+		if bc.current() == nil || bc.view == "" {
+			continue
+		}
+		if view != "" && bc.view != view {
+			return ""
+		}
+		view = bc.view
+	}
+	return view
+}
+
+// getState returns the state the client is in
+func (c *Client) getState() HealthState {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	return c.state
+}
+
+func (c *Client) setState(state HealthState) {
+	c.stateMux.Lock()
+	c.state = state
+	c.stateMux.Unlock()
+}
+
+// send sends m to every balancer the client is connected to. Throws error if it reaches none
+func (c *Client) send(m *protocol.Message) error {
+	err := errors.New("not connected to a balancer")
+	sent := false
+	for _, bc := range c.balancers {
+		if bc.current() == nil {
+			continue
+		}
+		// every balancer numbers its own requests
+		msg := *m
+		if werr := bc.request(&msg); werr != nil {
+			err = werr
+			continue
+		}
+		sent = true
+	}
+	if sent {
+		return nil
+	}
+	return err
+}
+
+func (c *Client) closeBalancers() {
+	for _, bc := range c.balancers {
+		if conn := bc.current(); conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// disconnect marks the connection to bc as lost. The client only counts as reconnecting once it
+// has lost every balancer
+func (c *Client) disconnect(bc *balancerConn) {
+	bc.connMux.Lock()
+	if bc.conn != nil {
+		bc.conn.Close()
+		bc.conn = nil
+	}
+	bc.connMux.Unlock()
+
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	bc.view = ""
+	if !c.connected() && c.state != Reconnecting {
+		c.restoreState = c.state
+		c.state = Reconnecting
+	}
+}
+
+// dataAuth picks the key the balancer authenticates data packets with. Over tls the key is handed
+// over as it is. Otherwise it comes out of the key exchange the balancer offered in hello, and
+// the public key to answer with is returned too
+func (c *Client) dataAuth(hello *protocol.Message) (*util.DataAuth, []byte, error) {
+	if c.tls != nil {
+		auth, err := util.GenerateDataAuth()
+		return auth, nil, err
+	}
+	if hello == nil || hello.Exchange == "" {
+		return nil, nil, errors.New("data key can't be sent in plaintext. use tls or protocol version 2")
+	}
+	offer, err := hex.DecodeString(hello.Exchange)
+	if err != nil {
+		return nil, nil, errors.New("balancer's exchange key not parseable")
+	}
+	exchange, err := util.NewKeyExchange()
+	if err != nil {
+		return nil, nil, err
+	}
+	auth, err := exchange.DataAuth(rand.Uint32(), offer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return auth, exchange.Public(), nil
+}
+
+// registerMessage builds the REGISTER message for the client, handing over auth's key if not nil,
+// or the public key of the exchange it came out of if exchange is not nil
+func (c *Client) registerMessage(auth *util.DataAuth, exchange []byte) *protocol.Message {
+	register := &protocol.Message{
+		Type:   protocol.Register,
+		Name:   c.name,
+		DataIP: c.dataIP.String(),
+		VIP:    c.vips[0].String(),
+		Pool:   c.service,
+		Labels: c.labels,
+	}
+	c.stateMux.Lock()
+	register.Weight = c.weight
+	state := c.state
+	if state == Reconnecting {
+		state = c.restoreState
+	}
+	c.stateMux.Unlock()
+	switch state {
+	case Paused:
+		register.State = "paused"
+	case Draining:
+		register.State = "draining"
+	}
+	if c.kernelDecap() {
+		register.Encap = c.encap
+		if c.encap == EncapFOU || c.encap == EncapGUE {
+			register.Port = c.encapPort
+		}
+	}
+	if auth != nil {
+		register.KeyID = auth.KeyID()
+		if exchange != nil {
+			register.Exchange = hex.EncodeToString(exchange)
+		} else {
+			register.Key = hex.EncodeToString(auth.Key())
+		}
+	}
+	return register
+}
+
+// readSanity waits for the balancer's sanity check on the data socket and returns its nonce.
+// Once listen owns the socket, it hands sanity checks over instead
+func (c *Client) readSanity() (string, error) {
+	timeout := time.Duration(c.readTimeout) * time.Second
+	failed := errors.New("failed to complete sanity check in " + strconv.Itoa(c.readTimeout) + " seconds.")
+
+	sanityString := ""
+	if atomic.LoadUint32(&c.listening) == 1 {
+		select {
+		case sanityString = <-c.sanity:
+		case <-time.After(timeout):
+			return "", failed
+		}
+	} else {
+		mtu, err := c.getMTU()
+		if err != nil {
+			return "", err
+		}
+		buf := make([]byte, mtu)
+		c.dataListener.SetReadDeadline(time.Now().Add(timeout))
+		defer c.dataListener.SetReadDeadline(time.Time{})
+		for !strings.HasPrefix(sanityString, "SANITY") {
+			n, _, err := c.dataListener.ReadFrom(buf)
+			if err != nil {
+				if errChk, ok := err.(net.Error); ok && errChk.Timeout() {
+					return "", failed
+				}
+				return "", err
+			}
+			payload := buf[:n]
+			if !c.kernelDecap() {
+				var authentic bool
+				payload, authentic = c.authenticate(payload)
+				if !authentic {
+					continue
+				}
+			}
+			sanityString = string(payload)
+		}
+	}
+
+	sanitySplit := strings.Split(sanityString, " ")
+	if sanitySplit[0] != "SANITY" || len(sanitySplit) < 2 {
+		return "", failed
+	}
+	return sanitySplit[1], nil
+}
+
+// reconnect registers with bc again after the connection to it was lost, backing off
+// exponentially with jitter between attempts. The registration carries the state the client was
+// in, so the balancer doesn't hash new flows to a paused or draining client in the meantime
+func (c *Client) reconnect(bc *balancerConn) {
+	delay := reconnectBase
+	for attempt := 1; c.registered(); attempt++ {
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.Infof("Reconnecting to balancer %v in %v (attempt %v)\n", bc.ip, wait, attempt)
+		time.Sleep(wait)
+
+		err := c.register(bc)
+		if err == nil {
+			break
+		}
+		log.Warnln("Failed to reconnect: " + err.Error())
+		delay *= 2
+		if delay > reconnectMax {
+			delay = reconnectMax
+		}
+	}
+	if bc.current() == nil {
+		return
+	}
+
+	log.Infoln("Reconnected to balancer " + bc.ip.String())
+	c.stateMux.Lock()
+	if c.state == Reconnecting {
+		c.state = c.restoreState
+	}
+	c.stateMux.Unlock()
+}
+
+// kernelDecap returns whether the kernel strips the encapsulation instead of the client
+func (c *Client) kernelDecap() bool {
+	return c.encap != EncapUDP
+}
+
 func stateToString(health HealthState) string {
 	switch health {
 	case Unregistered:
@@ -174,6 +681,10 @@ func stateToString(health HealthState) string {
 		return "Paused"
 	case Deregistering:
 		return "Deregistering"
+	case Draining:
+		return "Draining"
+	case Reconnecting:
+		return "Reconnecting"
 	}
 	return "State not found"
 }
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// EncapUDP has the client read packets off its data socket and write them to the vip itself
+	EncapUDP = "udp"
+	// EncapFOU has the kernel strip bare fou encapsulation
+	EncapFOU = "fou"
+	// EncapGUE has the kernel strip gue encapsulation
+	EncapGUE = "gue"
+	// EncapIPIP has the kernel strip ipip (or sit for ipv6 vips) encapsulation
+	EncapIPIP = "ipip"
+	// EncapGRE has the kernel strip gre encapsulation
+	EncapGRE = "gre"
+)
+
+// setupKernelDecap opens a fou receive port if needed and the tunnel devices the
+// kernel needs to hand decapsulated packets to the local stack
+func (c *Client) setupKernelDecap() error {
+	if c.encap == EncapGRE {
+		err := c.addTunnel(&netlink.Gretun{LinkAttrs: netlink.LinkAttrs{Name: "caplance-gre"}, Local: c.dataIP})
+		if err != nil {
+			c.teardownKernelDecap()
+		}
+		return err
+	}
+	if c.dataIP.To4() == nil {
+		return errors.New(c.encap + " decapsulation needs an ipv4 data ip")
+	}
+
+	has4, has6 := false, false
+	for _, vip := range c.vips {
+		if vip.To4() != nil {
+			has4 = true
+		} else {
+			has6 = true
+		}
+	}
+
+	fou := netlink.Fou{Family: syscall.AF_INET, Port: c.encapPort}
+	switch c.encap {
+	case EncapIPIP:
+	case EncapGUE:
+		fou.EncapType = netlink.FOU_ENCAP_GUE
+	case EncapFOU:
+		if has4 && has6 {
+			return errors.New("fou can only carry one ip family per port. use gue for dual-stack vips")
+		}
+		fou.EncapType = netlink.FOU_ENCAP_DIRECT
+		fou.Protocol = syscall.IPPROTO_IPIP
+		if has6 {
+			fou.Protocol = syscall.IPPROTO_IPV6
+		}
+	default:
+		return errors.New("encapsulation " + c.encap + " is not decapsulated by the kernel")
+	}
+
+	if c.encap != EncapIPIP {
+		err := netlink.FouAdd(fou)
+		if err != nil {
+			return err
+		}
+		c.fou = &fou
+	}
+
+	// decapsulated packets get handed to the ipip and sit handlers, which drop
+	// anything that doesn't match a tunnel device
+	if has4 {
+		err := c.addTunnel(&netlink.Iptun{LinkAttrs: netlink.LinkAttrs{Name: "caplance-ipip"}, Local: c.dataIP})
+		if err != nil {
+			c.teardownKernelDecap()
+			return err
+		}
+	}
+	if has6 {
+		err := c.addTunnel(&netlink.Sittun{LinkAttrs: netlink.LinkAttrs{Name: "caplance-sit"}, Local: c.dataIP})
+		if err != nil {
+			c.teardownKernelDecap()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) addTunnel(link netlink.Link) error {
+	err := netlink.LinkAdd(link)
+	if err != nil {
+		return err
+	}
+	c.tunnels = append(c.tunnels, link)
+
+	err = netlink.LinkSetUp(link)
+	if err != nil {
+		return err
+	}
+
+	// inner packets come from clients that aren't routed through the tunnel, so
+	// reverse path filtering would drop all of them. the kernel goes by the stricter of
+	// the device's setting and conf/all's, which is left to the host's admin
+	name := link.Attrs().Name
+	err = ioutil.WriteFile("/proc/sys/net/ipv4/conf/"+name+"/rp_filter", []byte("0"), 0644)
+	if err != nil {
+		return err
+	}
+	all, err := ioutil.ReadFile("/proc/sys/net/ipv4/conf/all/rp_filter")
+	if err == nil && bytes.Equal(bytes.TrimSpace(all), []byte("1")) {
+		log.Warnln("net.ipv4.conf.all.rp_filter is 1, so the kernel drops ipv4 packets decapsulated from " +
+			name + ". Set it to 0 or 2 (loose) for them to get through")
+	}
+	return nil
+}
+
+// teardownKernelDecap removes everything setupKernelDecap created
+func (c *Client) teardownKernelDecap() {
+	for _, link := range c.tunnels {
+		netlink.LinkDel(link)
+	}
+	c.tunnels = nil
+	if c.fou != nil {
+		netlink.FouDel(*c.fou)
+		c.fou = nil
+	}
+}
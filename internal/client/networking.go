@@ -1,43 +1,22 @@
 package client
 
 import (
+	"bytes"
 	"errors"
 	"net"
 	"os"
-	"strings"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
-	"github.com/google/gopacket/pcap"
 	"github.com/vishvananda/netlink"
-)
 
-func findDevice(ip net.IP) (string, error) {
-	devices, err := pcap.FindAllDevs()
-	if err != nil {
-		return "", err
-	}
-	foundDevice := ""
-	for _, device := range devices {
-		for _, address := range device.Addresses {
-			ipNet := &net.IPNet{IP: address.IP, Mask: address.Netmask}
-			if ipNet.Contains(ip) {
-				if foundDevice == "" {
-					foundDevice = device.Name
-				} else if foundDevice != device.Name {
-					return "", errors.New("multiple devices on the same subnet. VIP cannot be assigned")
-				}
-			}
-		}
-	}
-	if foundDevice == "" {
-		return "", errors.New("no device on same subnet as VIP. VIP cannot be assigned")
-	}
-	return foundDevice, nil
-}
+	"github.com/pwpon500/caplance/pkg/protocol"
+	"github.com/pwpon500/caplance/pkg/util"
+)
 
 func initPacketPool(size int) *sync.Pool {
 	return &sync.Pool{
@@ -50,58 +29,115 @@ func initPacketPool(size int) *sync.Pool {
 	}
 }
 
-func (c *Client) manageBalancerConnection(wg *sync.WaitGroup) {
+func (c *Client) manageBalancerConnection(bc *balancerConn, wg *sync.WaitGroup) {
 	defer wg.Done()
-	go c.sendHealth()
-	defer log.Debugln("ended balancer connection management")
-	for c.state == Active || c.state == Paused {
-		message, err := c.comm.ReadLine()
-		if err != nil {
-			log.Errorln("Read timeout exceeded. Stopping")
-			c.gracefulStop()
-			return
+	defer log.Debugln("ended balancer connection management for " + bc.ip.String())
+	for c.registered() {
+		conn := bc.current()
+		if conn == nil {
+			c.reconnect(bc)
+			continue
 		}
-
-		tokens := strings.Split(message, " ")
-		if len(tokens) < 1 {
-			log.Debugln("Empty message received from server")
+		msg, err := conn.ReadMessage()
+		if _, ok := err.(*protocol.MalformedError); ok {
+			log.Debugln("Message received from server not matching spec: " + err.Error())
+			continue
+		}
+		if err != nil {
+			if c.getState() == Deregistering {
+				return
+			}
+			log.Errorln("Lost connection to balancer " + bc.ip.String() + ": " + err.Error())
+			c.disconnect(bc)
 			continue
 		}
 
-		switch tokens[0] {
-		case "INVALID":
-			log.Debugln(message)
+		req := bc.answered(msg)
+		switch msg.Type {
+		case protocol.Invalid:
+			if req != "" {
+				log.Warnln("Balancer " + bc.ip.String() + " rejected " + req + ": " + msg.Detail)
+			} else {
+				log.Debugln(msg)
+			}
 
-		case "DEREGISTERED":
-			c.state = Deregistering
+		case protocol.Deregistered:
+			c.setState(Deregistering)
 			c.gracefulStop()
 			return
 
-		case "PAUSED":
-			c.state = Paused
+		case protocol.Paused:
+			c.setState(Paused)
+
+		case protocol.Resumed:
+			c.setState(Active)
 
-		case "RESUMED":
-			c.state = Active
+		case protocol.Draining:
+			c.setState(Draining)
 
-		case "HEALTHACK":
-			if len(tokens) < 2 {
-				log.Debugln("HEALTHACK received from server with no status code")
+		case protocol.Weighted:
+			if msg.Weight < 1 {
+				log.Debugln("WEIGHTED received from server with no weight")
+				continue
+			}
+			c.stateMux.Lock()
+			c.weight = msg.Weight
+			c.stateMux.Unlock()
+
+		case protocol.HealthAck:
+			// older balancers only send the status code
+			if msg.State == "" {
+				continue
+			}
+			// the balancers of a pair may briefly disagree, and the client only follows them
+			// once they don't
+			c.stateMux.Lock()
+			bc.view = msg.State
+			view := c.agreedView()
+			switch {
+			case view == "active":
+				c.state = Active
+			case view == "draining" && c.state != Draining:
+				log.Warnln("Balancers are draining this backend")
+				c.state = Draining
+			case view == "paused" && c.state != Paused:
+				log.Warnln("Balancers took this backend out of their pools")
+				c.state = Paused
 			}
+			c.stateMux.Unlock()
 		default:
-			log.Debugln("Message received from server not matching spec: " + message)
+			log.Debugln("Message received from server not matching spec: " + msg.String())
 		}
 	}
 
 }
 
 func (c *Client) sendHealth() {
-	for c.state == Active || c.state == Paused {
-		log.Debugln("sending health")
-		c.comm.WriteLine("HEALTH 200")
+	for c.registered() {
+		if c.getState() == Reconnecting {
+			time.Sleep(time.Duration(c.healthRate) * time.Second)
+			continue
+		}
+		code, detail := c.runProbes()
+		log.Debugln("sending health " + strconv.Itoa(code))
+		c.send(&protocol.Message{Type: protocol.Health, Code: code, Detail: detail})
+
+		c.stateMux.Lock()
+		pause, resume := c.streak.Record(code, c.state)
+		c.stateMux.Unlock()
+		if resume {
+			log.Infoln("Probes passing again, resuming")
+			c.resume()
+		} else if pause {
+			log.Warnln("Probes failing, pausing")
+			c.pause()
+		}
 		time.Sleep(time.Duration(c.healthRate) * time.Second)
 	}
 }
 
+// listen reads the packets the balancers forward off the data socket until the client is no
+// longer registered or the socket is closed. Failed reads are logged and skipped
 func (c *Client) listen(wg *sync.WaitGroup) error {
 	defer wg.Done()
 
@@ -110,28 +146,65 @@ func (c *Client) listen(wg *sync.WaitGroup) error {
 		return err
 	}
 
-	pool := initPacketPool(mtu)
+	// sealed packets carry the auth header on top of a full size packet
+	reader, err := util.NewBatchReader(c.dataListener, c.batch.Size, mtu+util.AuthHeaderLen)
+	if err != nil {
+		return err
+	}
+	pool := initPacketPool(mtu + util.AuthHeaderLen)
+	writer, err := c.vipWriters()
+	if err != nil {
+		return err
+	}
 
+	// the handlers stop with listen, and only then can the raw sockets they write to be closed
+	done := make(chan struct{})
+	var handlers sync.WaitGroup
+	handlers.Add(20)
 	for i := 0; i < 20; i++ {
-		go c.handlePackets(pool)
+		go c.handlePackets(pool, writer, done, &handlers)
 	}
-
-	c.state = Active
-	for c.state == Active || c.state == Paused {
-		packet := pool.Get().(*rawPacket)
-		n, _, err := c.dataListener.ReadFrom(packet.payload)
+	defer func() {
+		close(done)
+		handlers.Wait()
+		writer.Close()
+	}()
+
+	c.setState(Active)
+	for c.registered() {
+		batch, err := reader.Read()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
-			return err
+			// a failed read, like one reporting an icmp error, loses nothing else queued on the socket
+			log.Warnln("Failed to read from data socket: " + err.Error())
+			continue
+		}
+		for _, data := range batch {
+			payload, authentic := c.authenticate(data)
+			if !authentic {
+				continue
+			}
+			// ip packets never start with an S, so this can only be a sanity check from a re-registration
+			if bytes.HasPrefix(payload, []byte("SANITY")) {
+				select {
+				case c.sanity <- string(payload):
+				default:
+				}
+				continue
+			}
+			packet := pool.Get().(*rawPacket)
+			packet.size = copy(packet.payload, payload)
+			c.packets <- packet
 		}
-		packet.size = n
-		c.packets <- packet
 	}
 
 	return nil
 }
 
 func (c *Client) getMTU() (int, error) {
-	devName, err := findDevice(c.dataIP)
+	devName, err := util.FindDevice(c.dataIP)
 	if err != nil {
 		return 0, err
 	}
@@ -148,8 +221,9 @@ func (c *Client) attachVIP() error {
 	if err != nil {
 		return err
 	}
-	vipNet := &net.IPNet{IP: c.vip, Mask: net.CIDRMask(32, 32)}
-	netlink.AddrAdd(lo, &netlink.Addr{IPNet: vipNet})
+	for _, vip := range c.vips {
+		netlink.AddrAdd(lo, &netlink.Addr{IPNet: util.HostNet(vip)})
+	}
 	return nil
 }
 
@@ -158,48 +232,99 @@ func (c *Client) detachVIP() error {
 	if err != nil {
 		return err
 	}
-	vipNet := &net.IPNet{IP: c.vip, Mask: net.CIDRMask(32, 32)}
-	netlink.AddrDel(lo, &netlink.Addr{IPNet: vipNet})
+	for _, vip := range c.vips {
+		netlink.AddrDel(lo, &netlink.Addr{IPNet: util.HostNet(vip)})
+	}
 	return nil
 }
 
-func (c *Client) handlePackets(pool *sync.Pool) {
-	fd, _ := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+// vipWriter writes packets to the vips through a raw socket per family
+type vipWriter struct {
+	fd4, fd6 int
+	v4, v6   *util.BatchWriter
+}
 
-	if c.vip.To4() == nil {
-		log.Panicln("vip is not ipv4")
+// Write writes a packet through the socket of its ip version
+func (w *vipWriter) Write(packet []byte) error {
+	if len(packet) > 0 && packet[0]>>4 == 6 {
+		return w.v6.Write(packet)
 	}
+	return w.v4.Write(packet)
+}
 
-	var vipFour [4]byte
-	copy(vipFour[:], c.vip[:4])
+// Close sends what is left in the batches and closes the sockets
+func (w *vipWriter) Close() {
+	w.v4.Close()
+	w.v6.Close()
+	syscall.Close(w.fd4)
+	syscall.Close(w.fd6)
+}
 
-	addr := syscall.SockaddrInet4{
-		Port: 0,
-		Addr: vipFour,
+// vipWriters opens the raw sockets packets are written to the vips through. Packets carry their
+// own header, so the destination only has to route to something local. Any vip of the matching
+// family will do
+func (c *Client) vipWriters() (*vipWriter, error) {
+	fd4, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		return nil, err
 	}
-
-	for c.state == Active || c.state == Paused {
-		packet := <-c.packets
-		err := syscall.Sendto(fd, packet.payload[:packet.size], 0, &addr)
-		if err != nil {
-			log.Warnln("Failed to write packet to local vip")
+	fd6, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		syscall.Close(fd4)
+		return nil, err
+	}
+	dst4, dst6 := net.IPv4zero, net.IPv6zero
+	for _, vip := range c.vips {
+		if vip.To4() != nil {
+			dst4 = vip
+		} else {
+			dst6 = vip
 		}
+	}
+	return &vipWriter{
+		fd4: fd4,
+		fd6: fd6,
+		v4:  util.NewRawBatchWriter(fd4, dst4, c.batch, vipFlushed),
+		v6:  util.NewRawBatchWriter(fd6, dst6, c.batch, vipFlushed),
+	}, nil
+}
+
+// vipFlushed logs the packets a batch to the vips failed to write
+func vipFlushed(sent, bytes, failed int, err error) {
+	if failed > 0 {
+		log.Warnln("Failed to write " + strconv.Itoa(failed) + " packets to local vip: " + err.Error())
+	}
+}
 
-		pool.Put(packet)
+// handlePackets writes packets off c.packets to the vips until done is closed
+func (c *Client) handlePackets(pool *sync.Pool, writer *vipWriter, done <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case packet := <-c.packets:
+			err := writer.Write(packet.payload[:packet.size])
+			if err != nil {
+				log.Warnln("Failed to write packet to local vip: " + err.Error())
+			}
+			pool.Put(packet)
+		case <-done:
+			return
+		}
 	}
 }
 
 func (c *Client) deregister() error {
-	c.state = Deregistering
-	return c.comm.WriteLine("DEREGISTER " + c.name)
+	c.setState(Deregistering)
+	return c.send(&protocol.Message{Type: protocol.Deregister, Name: c.name})
 }
 
 func (c *Client) gracefulStop() {
-	if c.state != Deregistering {
+	if c.getState() != Deregistering {
 		c.deregister()
 	}
-	c.comm.Close()
+	c.closeBalancers()
 	c.dataListener.Close()
+	c.teardownKernelDecap()
 	c.detachVIP()
 	if r := recover(); r != nil {
 		log.Errorln(r)
@@ -207,16 +332,48 @@ func (c *Client) gracefulStop() {
 	os.Exit(0)
 }
 
+// registered returns whether the client is registered with the balancer, whatever traffic it gets.
+// Clients reconnecting to the balancer count as registered so they keep their vip and data socket
+func (c *Client) registered() bool {
+	state := c.getState()
+	return state == Active || state == Paused || state == Draining || state == Reconnecting
+}
+
+func (c *Client) drain() error {
+	if c.getState() != Active {
+		return errors.New("only an active client can be drained")
+	}
+	return c.send(&protocol.Message{Type: protocol.Drain, Name: c.name})
+}
+
 func (c *Client) pause() error {
-	if c.state == Paused {
+	state := c.getState()
+	if state == Reconnecting {
+		return errors.New("not connected to the balancer")
+	}
+	if state == Paused {
 		return errors.New("cannot pause an already paused client")
 	}
-	return c.comm.WriteLine("PAUSE " + c.name)
+	return c.send(&protocol.Message{Type: protocol.Pause, Name: c.name})
+}
+
+func (c *Client) setWeight(weight int) error {
+	if c.getState() == Reconnecting {
+		return errors.New("not connected to the balancer")
+	}
+	if weight < 1 {
+		return errors.New("weight must be positive")
+	}
+	return c.send(&protocol.Message{Type: protocol.Weight, Weight: weight})
 }
 
 func (c *Client) resume() error {
-	if c.state == Active {
+	state := c.getState()
+	if state == Reconnecting {
+		return errors.New("not connected to the balancer")
+	}
+	if state == Active {
 		return errors.New("cannot resume an already active client")
 	}
-	return c.comm.WriteLine("RESUME " + c.name)
+	return c.send(&protocol.Message{Type: protocol.Resume, Name: c.name})
 }
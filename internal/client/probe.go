@@ -0,0 +1,161 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ProbeHTTP passes if a GET of its target url returns a 2xx. The response status is reported
+	ProbeHTTP = "http"
+	// ProbeTCP passes if a tcp connection to its target port on every vip can be opened
+	ProbeTCP = "tcp"
+	// ProbeExec passes if its target command, run through sh, exits 0
+	ProbeExec = "exec"
+)
+
+// Probe is a local check of the service behind the client
+type Probe struct {
+	Type    string // one of ProbeHTTP, ProbeTCP or ProbeExec
+	Target  string // url for http, port for tcp and command for exec
+	Timeout time.Duration
+}
+
+// HealthConfig configures how the client decides the status it reports to the balancer
+type HealthConfig struct {
+	Probes []*Probe // probes run before every health check. always healthy if empty
+	Fall   int      // failed health checks in a row before the client pauses itself
+	Rise   int      // passed health checks in a row before a client paused by its probes resumes
+}
+
+// probeResult is the outcome of the last run of a probe
+type probeResult struct {
+	code   int    // http style status code
+	detail string // why the probe failed, if it did
+	at     time.Time
+}
+
+// Run runs the probe once against every vip, returning an http style status code and what the
+// probe found. A tcp probe fails on the first vip it can't connect to
+func (p *Probe) Run(vips []net.IP) (int, string) {
+	switch p.Type {
+	case ProbeHTTP:
+		client := &http.Client{Timeout: p.Timeout}
+		resp, err := client.Get(p.Target)
+		if err != nil {
+			return http.StatusServiceUnavailable, err.Error()
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Status
+
+	case ProbeTCP:
+		for _, vip := range vips {
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(vip.String(), p.Target), p.Timeout)
+			if err != nil {
+				return http.StatusServiceUnavailable, err.Error()
+			}
+			conn.Close()
+		}
+		return http.StatusOK, "connected"
+
+	case ProbeExec:
+		ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, "sh", "-c", p.Target).CombinedOutput()
+		detail := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0]
+		if err != nil {
+			if detail == "" {
+				detail = err.Error()
+			}
+			return http.StatusServiceUnavailable, detail
+		}
+		return http.StatusOK, detail
+	}
+	return http.StatusInternalServerError, "unknown probe type " + p.Type
+}
+
+func (r probeResult) healthy() bool {
+	return r.code/100 == 2
+}
+
+func (r probeResult) String() string {
+	if r.at.IsZero() {
+		return "not run yet"
+	}
+	s := strconv.Itoa(r.code)
+	if r.detail != "" {
+		s += " " + r.detail
+	}
+	return s + " (" + time.Since(r.at).Round(time.Second).String() + " ago)"
+}
+
+// runProbes runs every probe, recording the results, and returns the status to report with what
+// the probe behind it found. That is the first failing probe, or 200 if they all pass
+func (c *Client) runProbes() (int, string) {
+	code, detail := http.StatusOK, ""
+	for i, probe := range c.health.Probes {
+		status, found := probe.Run(c.vips)
+		result := probeResult{status, found, time.Now()}
+		c.probeMux.Lock()
+		c.probeResults[i] = result
+		c.probeMux.Unlock()
+		if !result.healthy() && code == http.StatusOK {
+			code = result.code
+			detail = probe.Type + " " + probe.Target + ": " + result.detail
+		}
+	}
+	return code, detail
+}
+
+// ProbeStreak counts the health checks passed and failed in a row, deciding when a client pauses
+// itself over failing probes and when it resumes
+type ProbeStreak struct {
+	Rise     int // passed health checks in a row before a client paused by its probes resumes
+	Fall     int // failed health checks in a row before an active client pauses itself
+	passes   int
+	failures int
+	paused   bool // paused by failing probes rather than by request
+}
+
+// Record counts a health check reporting code, sent while the client was in state. Returns whether
+// the client should pause or resume itself
+func (s *ProbeStreak) Record(code int, state HealthState) (pause, resume bool) {
+	if code/100 == 2 {
+		s.failures = 0
+		s.passes++
+		if s.paused && state == Paused && s.passes >= s.Rise {
+			s.paused = false
+			return false, true
+		}
+		return false, false
+	}
+	s.passes = 0
+	s.failures++
+	if state == Active && s.failures >= s.Fall {
+		s.paused = true
+		return true, false
+	}
+	return false, false
+}
+
+// Forget hands the pause over to whoever asked for it, so passing probes don't resume the client
+func (s *ProbeStreak) Forget() {
+	s.paused = false
+}
+
+// probeReport describes the last result of every probe
+func (c *Client) probeReport() string {
+	c.probeMux.Lock()
+	defer c.probeMux.Unlock()
+
+	var lines []string
+	for i, probe := range c.health.Probes {
+		lines = append(lines, probe.Type+" "+probe.Target+": "+c.probeResults[i].String())
+	}
+	return strings.Join(lines, "\n")
+}
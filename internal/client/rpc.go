@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"net/rpc"
 	"os"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,9 +22,14 @@ func (c *Client) listenUnix() {
 		log.Panicln(err)
 	}
 
-	rpc.Register(c)
-	rpc.HandleHTTP()
-	http.Serve(c.unixSock, nil)
+	// not the default server, for the same reason as the balancer's
+	server := rpc.NewServer()
+	if err := server.Register(c); err != nil {
+		log.Panicln(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+	http.Serve(c.unixSock, mux)
 }
 
 // Deregister command from caplancectl
@@ -37,6 +44,10 @@ func (c *Client) Deregister(req *string, reply *string) error {
 
 // Pause command from caplancectl
 func (c *Client) Pause(req *string, reply *string) error {
+	// paused by request, so passing probes don't resume it
+	c.stateMux.Lock()
+	c.streak.Forget()
+	c.stateMux.Unlock()
 	err := c.pause()
 	if err == nil {
 		*reply = "Pause request sent"
@@ -57,8 +68,52 @@ func (c *Client) Resume(req *string, reply *string) error {
 	return nil
 }
 
+// Drain command from caplancectl
+func (c *Client) Drain(req *string, reply *string) error {
+	err := c.drain()
+	if err == nil {
+		*reply = "Drain request sent"
+	} else {
+		*reply = "Drain request encountered an error: " + err.Error()
+	}
+	return nil
+}
+
+// SetWeight command from caplancectl
+func (c *Client) SetWeight(req *string, reply *string) error {
+	weight, err := strconv.Atoi(*req)
+	if err == nil {
+		err = c.setWeight(weight)
+	}
+	if err == nil {
+		*reply = "Weight request sent"
+	} else {
+		*reply = "Weight request encountered an error: " + err.Error()
+	}
+	return nil
+}
+
 // GetState command from caplancectl
 func (c *Client) GetState(req *string, reply *string) error {
+	c.stateMux.Lock()
 	*reply = stateToString(c.state)
+	for _, bc := range c.balancers {
+		status := "reconnecting"
+		if conn := bc.current(); conn != nil {
+			status = "connected, protocol version " + strconv.Itoa(conn.Version())
+			if bc.view != "" {
+				status += ", has us " + bc.view
+			}
+		}
+		*reply += "\nbalancer " + bc.ip.String() + ": " + status
+	}
+	c.stateMux.Unlock()
+	if !c.kernelDecap() {
+		*reply += "\ndropped packets: " + strconv.FormatUint(atomic.LoadUint64(&c.unauthenticated), 10) +
+			" unauthenticated, " + strconv.FormatUint(atomic.LoadUint64(&c.replayed), 10) + " replayed"
+	}
+	if len(c.health.Probes) > 0 {
+		*reply += "\n" + c.probeReport()
+	}
 	return nil
 }
@@ -0,0 +1,141 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/pwpon500/caplance/pkg/util"
+)
+
+// Conn sends and receives messages over a communicator in the version agreed on with the peer
+type Conn struct {
+	comm    util.Communicator
+	version int
+	lastID  uint64 // id of the last request sent. atomic
+}
+
+// Accept works out which version a connecting client speaks. Version 2 clients open with a HELLO
+// frame and get one back advertising caps and offering exchange, if not empty, for the data key.
+// Anything else is a version 1 client. Returns the client's HELLO, which is nil for version 1
+func Accept(comm util.Communicator, caps []string, exchange string) (*Conn, *Message, error) {
+	// frames start with their length, which never fills the top byte. lines start with a letter
+	first, err := comm.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if first[0] != 0 {
+		return &Conn{comm: comm, version: V1}, nil, nil
+	}
+
+	conn := &Conn{comm: comm, version: V2}
+	hello, err := conn.ReadMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	if hello.Type != Hello || hello.Version < V2 {
+		return nil, nil, errors.New("expected a HELLO, got " + hello.Type)
+	}
+	if hello.Version < Latest {
+		conn.version = hello.Version
+	}
+	err = conn.Reply(hello, &Message{Type: Hello, Version: conn.version, Capabilities: caps, Exchange: exchange})
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, hello, nil
+}
+
+// Connect starts a conversation with a balancer in version, advertising caps. From version 2 it
+// exchanges HELLOs, settling on the older version of the two, and returns the balancer's HELLO.
+// Version 1 has no HELLO, so the returned one is nil
+func Connect(comm util.Communicator, version int, caps []string) (*Conn, *Message, error) {
+	conn := &Conn{comm: comm, version: version}
+	if version < V2 {
+		return conn, nil, nil
+	}
+	if version > Latest {
+		return nil, nil, errors.New("protocol version " + strconv.Itoa(version) + " is not supported")
+	}
+
+	err := conn.Request(&Message{Type: Hello, Version: version, Capabilities: caps})
+	if err != nil {
+		return nil, nil, err
+	}
+	hello, err := conn.ReadMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	if hello.Type != Hello {
+		return nil, nil, errors.New("expected a HELLO, got " + hello.String())
+	}
+	if hello.Version < V2 || hello.Version > version {
+		return nil, nil, errors.New("balancer answered with protocol version " + strconv.Itoa(hello.Version))
+	}
+	conn.version = hello.Version
+	return conn, hello, nil
+}
+
+// Version returns the protocol version spoken on the connection
+func (c *Conn) Version() int {
+	return c.version
+}
+
+// ReadMessage reads the next message. Throws a *MalformedError if it can't be parsed
+func (c *Conn) ReadMessage() (*Message, error) {
+	if c.version < V2 {
+		line, err := c.comm.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		return parseText(line)
+	}
+
+	frame, err := c.comm.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{}
+	err = json.Unmarshal(frame, m)
+	if err != nil {
+		return nil, malformed("message not parseable: " + err.Error())
+	}
+	return m, nil
+}
+
+// WriteMessage writes m as it is
+func (c *Conn) WriteMessage(m *Message) error {
+	if c.version < V2 {
+		return c.comm.WriteLine(formatText(m))
+	}
+	frame, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return c.comm.WriteFrame(frame)
+}
+
+// Request numbers m with the next request id and writes it
+func (c *Conn) Request(m *Message) error {
+	m.ID = atomic.AddUint64(&c.lastID, 1)
+	return c.WriteMessage(m)
+}
+
+// Reply writes m as the reply to req. req may be nil for messages that couldn't be parsed
+func (c *Conn) Reply(req, m *Message) error {
+	if req != nil {
+		m.ID = req.ID
+	}
+	return c.WriteMessage(m)
+}
+
+// Invalid replies to req that it was rejected for reason
+func (c *Conn) Invalid(req *Message, reason string) error {
+	return c.Reply(req, &Message{Type: Invalid, Detail: reason})
+}
+
+// Close closes the underlying communicator
+func (c *Conn) Close() error {
+	return c.comm.Close()
+}
@@ -0,0 +1,107 @@
+// Package protocol implements the management protocol between backends and balancers. From
+// version 2, peers open with a HELLO exchange and then send json messages in length prefixed
+// frames. Version 1 is the original space separated text, still spoken with clients that start
+// straight away with a REGISTER line
+package protocol
+
+import "strconv"
+
+// protocol versions
+const (
+	V1 = 1
+	V2 = 2
+	// Latest is the newest version this build speaks
+	Latest = V2
+)
+
+// message types. The client sends REGISTER, SANE, DEREGISTER, PAUSE, RESUME, DRAIN, WEIGHT and
+// HEALTH, and the balancer answers with the matching REGISTERED, DEREGISTERED, PAUSED, RESUMED,
+// DRAINING, WEIGHTED or HEALTHACK, or with INVALID. HELLO is sent by both
+const (
+	Hello        = "HELLO"
+	Register     = "REGISTER"
+	Registered   = "REGISTERED"
+	Sane         = "SANE"
+	Deregister   = "DEREGISTER"
+	Deregistered = "DEREGISTERED"
+	Pause        = "PAUSE"
+	Paused       = "PAUSED"
+	Resume       = "RESUME"
+	Resumed      = "RESUMED"
+	Drain        = "DRAIN"
+	Draining     = "DRAINING"
+	Weight       = "WEIGHT"
+	Weighted     = "WEIGHTED"
+	Health       = "HEALTH"
+	HealthAck    = "HEALTHACK"
+	Invalid      = "INVALID"
+)
+
+// capabilities peers advertise in their HELLO
+const (
+	CapDataAuth = "data-auth" // udp packets are sealed with the key sent in REGISTER
+	CapDrain    = "drain"     // backends can be drained
+	CapLabels   = "labels"    // backends can register with labels
+)
+
+// Capabilities is what this build supports
+var Capabilities = []string{CapDataAuth, CapDrain, CapLabels}
+
+// Message is a single message of the protocol. Only the fields its type uses are set
+type Message struct {
+	Type string `json:"type"`
+	// ID correlates requests and replies. Clients number their requests and the balancer echoes
+	// the number in its reply. Messages the balancer sends unprompted have no id
+	ID uint64 `json:"id,omitempty"`
+
+	Version      int      `json:"version,omitempty"`      // HELLO
+	Capabilities []string `json:"capabilities,omitempty"` // HELLO
+	// Exchange is a hex encoded x25519 public key. The balancer offers one in its HELLO on
+	// plaintext connections and the client answers with its own in REGISTER, instead of a Key
+	Exchange string `json:"exchange,omitempty"`
+
+	Name   string            `json:"name,omitempty"`
+	DataIP string            `json:"data_ip,omitempty"` // REGISTER and REGISTERED
+	VIP    string            `json:"vip,omitempty"`     // REGISTER
+	Pool   string            `json:"pool,omitempty"`    // REGISTER
+	Encap  string            `json:"encap,omitempty"`   // REGISTER
+	Port   int               `json:"port,omitempty"`    // REGISTER
+	KeyID  uint32            `json:"key_id,omitempty"`  // REGISTER
+	Key    string            `json:"key,omitempty"`     // REGISTER, hex encoded
+	Labels map[string]string `json:"labels,omitempty"`  // REGISTER, version 2 only
+	Weight int               `json:"weight,omitempty"`  // REGISTER, WEIGHT and WEIGHTED
+	Nonce  string            `json:"nonce,omitempty"`   // SANE
+	Code   int               `json:"code,omitempty"`    // HEALTH and HEALTHACK
+	State  string            `json:"state,omitempty"`   // REGISTER and HEALTHACK
+	// Detail is the reason for INVALID and DEREGISTERED, and what the probes found for HEALTH
+	Detail string `json:"detail,omitempty"`
+}
+
+// MalformedError is returned for messages that were received but could not be parsed. The
+// connection can still be used
+type MalformedError struct {
+	reason string
+}
+
+func (e *MalformedError) Error() string {
+	return e.reason
+}
+
+func malformed(reason string) error {
+	return &MalformedError{reason}
+}
+
+// String describes the message for logs
+func (m *Message) String() string {
+	s := m.Type
+	if m.ID != 0 {
+		s += " #" + strconv.FormatUint(m.ID, 10)
+	}
+	if m.Name != "" {
+		s += " " + m.Name
+	}
+	if m.Detail != "" {
+		s += ": " + m.Detail
+	}
+	return s
+}
@@ -0,0 +1,191 @@
+package protocol
+
+import (
+	"strconv"
+	"strings"
+)
+
+// version 1 messages are a line of space separated tokens, starting with the type:
+// REGISTER <name> <ip> [vip=<vip>] [weight=<weight>] [pool=<pool>] [encap=<encap>] [port=<port>] [state=<state>] [keyid=<id> key=<hex key>]
+// REGISTERED <name> <ip>
+// SANE <nonce>
+// DEREGISTER|PAUSE|RESUME|DRAIN <name>
+// DEREGISTERED <name> <reason>
+// PAUSED|RESUMED|DRAINING <name>
+// WEIGHT <weight>
+// WEIGHTED <name> <weight>
+// HEALTH <code>
+// HEALTHACK <code> <state>
+// INVALID <reason>
+// version 1 has no HELLO to offer a key exchange in, so keys are only taken over tls
+
+// parseText parses a version 1 line
+func parseText(line string) (*Message, error) {
+	tokens := strings.Split(strings.Trim(line, " \n\r\t\f"), " ")
+	m := &Message{Type: tokens[0]}
+	args := tokens[1:]
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+
+	var err error
+	switch m.Type {
+	case Register:
+		if len(args) < 2 {
+			return nil, malformed("registration failed")
+		}
+		m.Name, m.DataIP = args[0], args[1]
+		err = parseOptions(m, args[2:])
+		if err != nil {
+			return nil, err
+		}
+
+	case Registered:
+		m.Name, m.DataIP = arg(0), arg(1)
+
+	case Sane:
+		m.Nonce = arg(0)
+
+	case Deregister, Pause, Resume, Drain, Paused, Resumed, Draining:
+		m.Name = arg(0)
+
+	case Deregistered:
+		m.Name = arg(0)
+		if len(args) > 1 {
+			m.Detail = strings.Join(args[1:], " ")
+		}
+
+	case Weight:
+		if len(args) < 1 {
+			return nil, malformed("no weight given")
+		}
+		m.Weight, err = strconv.Atoi(args[0])
+		if err != nil {
+			return nil, malformed("weight not parseable")
+		}
+
+	case Weighted:
+		m.Name = arg(0)
+		m.Weight, _ = strconv.Atoi(arg(1))
+
+	case Health:
+		if len(args) < 1 {
+			return nil, malformed("no status code in health check")
+		}
+		m.Code, err = strconv.Atoi(args[0])
+		if err != nil {
+			return nil, malformed("status code not parseable")
+		}
+
+	case HealthAck:
+		// older balancers only send the status code
+		m.Code, _ = strconv.Atoi(arg(0))
+		m.State = arg(1)
+
+	case Invalid:
+		m.Detail = strings.Join(args, " ")
+	}
+	return m, nil
+}
+
+// parseOptions parses the key=value options of a REGISTER line. Tokens without an = are ignored
+func parseOptions(m *Message, tokens []string) error {
+	var err error
+	for _, token := range tokens {
+		pair := strings.SplitN(token, "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		switch pair[0] {
+		case "vip":
+			m.VIP = pair[1]
+		case "pool":
+			m.Pool = pair[1]
+		case "encap":
+			m.Encap = pair[1]
+		case "port":
+			m.Port, err = strconv.Atoi(pair[1])
+			if err != nil {
+				return malformed("port not parseable")
+			}
+		case "weight":
+			m.Weight, err = strconv.Atoi(pair[1])
+			if err != nil {
+				return malformed("weight must be a positive integer")
+			}
+		case "state":
+			m.State = pair[1]
+		case "keyid":
+			id, err := strconv.ParseUint(pair[1], 10, 32)
+			if err != nil {
+				return malformed("keyid not parseable")
+			}
+			m.KeyID = uint32(id)
+		case "key":
+			m.Key = pair[1]
+		}
+	}
+	return nil
+}
+
+// formatText formats a message as a version 1 line. Fields version 1 has no room for, like
+// labels and request ids, are left out
+func formatText(m *Message) string {
+	tokens := []string{m.Type}
+	switch m.Type {
+	case Register:
+		tokens = append(tokens, m.Name, m.DataIP)
+		if m.VIP != "" {
+			tokens = append(tokens, "vip="+m.VIP)
+		}
+		if m.Weight != 0 {
+			tokens = append(tokens, "weight="+strconv.Itoa(m.Weight))
+		}
+		if m.Pool != "" {
+			tokens = append(tokens, "pool="+m.Pool)
+		}
+		if m.Encap != "" {
+			tokens = append(tokens, "encap="+m.Encap)
+		}
+		if m.Port != 0 {
+			tokens = append(tokens, "port="+strconv.Itoa(m.Port))
+		}
+		if m.State != "" {
+			tokens = append(tokens, "state="+m.State)
+		}
+		if m.Key != "" {
+			tokens = append(tokens, "keyid="+strconv.FormatUint(uint64(m.KeyID), 10), "key="+m.Key)
+		}
+
+	case Registered:
+		tokens = append(tokens, m.Name, m.DataIP)
+
+	case Sane:
+		tokens = append(tokens, m.Nonce)
+
+	case Deregister, Pause, Resume, Drain, Paused, Resumed, Draining:
+		tokens = append(tokens, m.Name)
+
+	case Deregistered:
+		tokens = append(tokens, m.Name, m.Detail)
+
+	case Weight:
+		tokens = append(tokens, strconv.Itoa(m.Weight))
+
+	case Weighted:
+		tokens = append(tokens, m.Name, strconv.Itoa(m.Weight))
+
+	case Health:
+		tokens = append(tokens, strconv.Itoa(m.Code))
+
+	case HealthAck:
+		tokens = append(tokens, strconv.Itoa(m.Code), m.State)
+
+	case Invalid:
+		tokens = append(tokens, m.Detail)
+	}
+	return strings.Join(tokens, " ")
+}
@@ -0,0 +1,232 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// AuthKeyLen is the length of the keys data packets are authenticated with
+	AuthKeyLen = 32
+	// AuthHeaderLen is the length of the header in front of every authenticated data packet:
+	// version, key id, sequence number and a truncated hmac-sha256 tag
+	AuthHeaderLen = 1 + 4 + 8 + authTagLen
+
+	// ExchangeKeyLen is the length of the public keys traded in a KeyExchange
+	ExchangeKeyLen = 32
+
+	authVersion = 1
+	authTagLen  = 16
+	// the flow-sharded forwarder workers seal concurrently and send in batches, so packets can
+	// arrive well out of order. the bitmap has one word more than the window, like rfc 6479
+	replayWin   = 4096 // sequence numbers behind the newest one that are still accepted
+	replayWords = replayWin/64 + 1
+)
+
+// DataAuth authenticates the udp encapsulated packets a balancer sends a backend with a key the
+// backend picked when registering. Sequence numbers carry on across the forwarders a backend
+// gets while it is registered, so the backend's replay window keeps working
+type DataAuth struct {
+	keyID   uint32
+	key     []byte
+	seq     uint64    // last sequence number handed out
+	sealers sync.Pool // of *Sealer, so the workers sealing packets reuse their hmac and buffer
+}
+
+// NewDataAuth creates a DataAuth for key, which the backend knows as keyID. Throws error if the
+// key is not AuthKeyLen bytes long
+func NewDataAuth(keyID uint32, key []byte) (*DataAuth, error) {
+	if len(key) != AuthKeyLen {
+		return nil, errors.New("data key must be 32 bytes")
+	}
+	return &DataAuth{keyID: keyID, key: key}, nil
+}
+
+// GenerateDataAuth creates a DataAuth with a random key and key id
+func GenerateDataAuth() (*DataAuth, error) {
+	raw := make([]byte, 4+AuthKeyLen)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return nil, err
+	}
+	return NewDataAuth(binary.BigEndian.Uint32(raw), raw[4:])
+}
+
+// KeyExchange is one side of an x25519 exchange for a data key, so the key never has to cross a
+// plaintext management connection
+type KeyExchange struct {
+	private [32]byte
+	public  [32]byte
+}
+
+// NewKeyExchange creates a KeyExchange with a fresh key pair
+func NewKeyExchange() (*KeyExchange, error) {
+	x := &KeyExchange{}
+	_, err := rand.Read(x.private[:])
+	if err != nil {
+		return nil, err
+	}
+	curve25519.ScalarBaseMult(&x.public, &x.private)
+	return x, nil
+}
+
+// Public returns the public key to hand the peer
+func (x *KeyExchange) Public() []byte {
+	return x.public[:]
+}
+
+// DataAuth derives the data key shared with the peer that sent peerPublic, known to the backend
+// as keyID. Throws error if peerPublic is not a usable public key
+func (x *KeyExchange) DataAuth(keyID uint32, peerPublic []byte) (*DataAuth, error) {
+	if len(peerPublic) != ExchangeKeyLen {
+		return nil, errors.New("public key must be 32 bytes")
+	}
+	var peer, shared [32]byte
+	copy(peer[:], peerPublic)
+	curve25519.ScalarMult(&shared, &x.private, &peer)
+	if shared == [32]byte{} {
+		return nil, errors.New("public key is of low order")
+	}
+	mac := hmac.New(sha256.New, shared[:])
+	mac.Write([]byte("caplance data key"))
+	return NewDataAuth(keyID, mac.Sum(nil))
+}
+
+// KeyID returns the id the backend knows the key by
+func (a *DataAuth) KeyID() uint32 {
+	return a.keyID
+}
+
+// Key returns the key
+func (a *DataAuth) Key() []byte {
+	return a.key
+}
+
+// Seal returns packet behind a header authenticating it under the next sequence number
+func (a *DataAuth) Seal(packet []byte) []byte {
+	s := a.Sealer()
+	defer a.PutSealer(s)
+	return append([]byte(nil), s.Seal(packet)...)
+}
+
+// Sealer seals packets under the key of a DataAuth without allocating, reusing its hmac and
+// buffers. Not safe for concurrent use
+type Sealer struct {
+	auth   *DataAuth
+	mac    hash.Hash
+	sum    []byte
+	header [AuthHeaderLen]byte
+	buf    []byte
+}
+
+// Sealer takes a Sealer from the pool of a, or makes one if the pool is empty. Hand it back with
+// PutSealer once its output is sent
+func (a *DataAuth) Sealer() *Sealer {
+	if s, ok := a.sealers.Get().(*Sealer); ok {
+		return s
+	}
+	return &Sealer{auth: a, mac: hmac.New(sha256.New, a.key), sum: make([]byte, 0, sha256.Size)}
+}
+
+// PutSealer returns s to the pool of a. Its output can't be used after
+func (a *DataAuth) PutSealer(s *Sealer) {
+	a.sealers.Put(s)
+}
+
+// Header returns the header authenticating packet under the next sequence number, to send in
+// front of it. Valid until the next use of s
+func (s *Sealer) Header(packet []byte) []byte {
+	h := s.header[:]
+	h[0] = authVersion
+	binary.BigEndian.PutUint32(h[1:5], s.auth.keyID)
+	binary.BigEndian.PutUint64(h[5:13], atomic.AddUint64(&s.auth.seq, 1))
+	s.mac.Reset()
+	s.mac.Write(h[:13])
+	s.mac.Write(packet)
+	s.sum = s.mac.Sum(s.sum[:0])
+	copy(h[13:], s.sum[:authTagLen])
+	return h
+}
+
+// Seal returns packet behind its header like DataAuth.Seal, in a buffer that is only valid until
+// the next use of s
+func (s *Sealer) Seal(packet []byte) []byte {
+	s.buf = append(append(s.buf[:0], s.Header(packet)...), packet...)
+	return s.buf
+}
+
+// Open checks the header of a sealed packet and returns the packet behind it with its sequence
+// number. Throws error if the packet was not sealed with this key
+func (a *DataAuth) Open(sealed []byte) ([]byte, uint64, error) {
+	id, ok := SealedKeyID(sealed)
+	if !ok || id != a.keyID {
+		return nil, 0, errors.New("packet not sealed with this key")
+	}
+	packet := sealed[AuthHeaderLen:]
+	if !hmac.Equal(sealed[13:AuthHeaderLen], a.tag(sealed[:13], packet)) {
+		return nil, 0, errors.New("packet failed authentication")
+	}
+	return packet, binary.BigEndian.Uint64(sealed[5:13]), nil
+}
+
+func (a *DataAuth) tag(header, packet []byte) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(header)
+	mac.Write(packet)
+	return mac.Sum(nil)[:authTagLen]
+}
+
+// SealedKeyID returns the key id in the header of a sealed packet. Returns false if packet is too
+// short or of an unknown version
+func SealedKeyID(sealed []byte) (uint32, bool) {
+	if len(sealed) < AuthHeaderLen || sealed[0] != authVersion {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(sealed[1:5]), true
+}
+
+// ReplayWindow remembers which of the latest sequence numbers were seen, like the ipsec
+// anti-replay window
+type ReplayWindow struct {
+	top    uint64              // highest sequence number seen
+	bitmap [replayWords]uint64 // bit seq%64 of word seq/64 is set if seq was seen, as a ring
+	mux    sync.Mutex
+}
+
+// Check records seq and returns whether it is new. Sequence numbers too far behind the highest
+// one seen count as replayed
+func (w *ReplayWindow) Check(seq uint64) bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if seq == 0 {
+		return false
+	}
+	if seq > w.top {
+		// clear the words the window slides over
+		ahead := seq/64 - w.top/64
+		if ahead > replayWords {
+			ahead = replayWords
+		}
+		for i := uint64(1); i <= ahead; i++ {
+			w.bitmap[(w.top/64+i)%replayWords] = 0
+		}
+		w.top = seq
+	} else if w.top-seq >= replayWin {
+		return false
+	}
+	word, bit := &w.bitmap[seq/64%replayWords], uint64(1)<<(seq%64)
+	if *word&bit != 0 {
+		return false
+	}
+	*word |= bit
+	return true
+}
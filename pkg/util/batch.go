@@ -0,0 +1,305 @@
+package util
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultBatchFlush is how long a packet waits for its batch to fill up if the config doesn't say
+	DefaultBatchFlush = 100 * time.Microsecond
+
+	// batchSlot is the size of each packet buffer of a BatchWriter. Bigger packets skip the batch
+	batchSlot = 2048
+)
+
+// BatchConfig configures how packets are batched into syscalls
+type BatchConfig struct {
+	Size  int           // packets per syscall. 1 or less sends every packet on its own
+	Flush time.Duration // longest a packet waits for its batch to fill up. DefaultBatchFlush if 0
+}
+
+// mmsghdr is struct mmsghdr, which x/sys doesn't have. Go pads it to the alignment of Msghdr
+// the same way C does, so its size matches on both 32 and 64 bit platforms
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+func sendmmsg(fd int, msgs []mmsghdr) (int, syscall.Errno) {
+	n, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(fd), uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), 0, 0, 0)
+	return int(n), errno
+}
+
+func recvmmsg(fd int, msgs []mmsghdr) (int, syscall.Errno) {
+	n, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, uintptr(fd), uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), 0, 0, 0)
+	return int(n), errno
+}
+
+// newMsgs sets up count messages with a buffer of size bytes each, all going to name if it is
+// not nil
+func newMsgs(count, size int, name unsafe.Pointer, nameLen int) ([]mmsghdr, []unix.Iovec, [][]byte) {
+	msgs := make([]mmsghdr, count)
+	iovs := make([]unix.Iovec, count)
+	bufs := make([][]byte, count)
+	for i := range msgs {
+		bufs[i] = make([]byte, size)
+		iovs[i].Base = &bufs[i][0]
+		iovs[i].SetLen(size)
+		msgs[i].hdr.Iov = &iovs[i]
+		msgs[i].hdr.Iovlen = 1
+		if name != nil {
+			msgs[i].hdr.Name = (*byte)(name)
+			msgs[i].hdr.Namelen = uint32(nameLen)
+		}
+	}
+	return msgs, iovs, bufs
+}
+
+// FlushFunc is told how many packets a BatchWriter sent, how many bytes they held and how many
+// it dropped when it sent them, along with the last error behind the drops
+type FlushFunc func(sent, bytes, failed int, err error)
+
+// BatchWriter gathers packets written to a socket and sends each batch with a single sendmmsg.
+// A batch goes out once it is full or its first packet has waited for the flush interval. Safe
+// for concurrent use
+type BatchWriter struct {
+	send   func(msgs []mmsghdr) (int, syscall.Errno, error)
+	name   unsafe.Pointer // destination of every packet. nil on connected sockets
+	nameSz int
+	msgs   []mmsghdr
+	iovs   []unix.Iovec
+	bufs   [][]byte
+	n      int // packets waiting in the batch
+	flush  time.Duration
+	timer  *time.Timer
+	report FlushFunc // told the outcome of every send. nil if nobody asks
+	closed bool
+	mux    sync.Mutex
+}
+
+// NewBatchWriter creates a BatchWriter on a connected socket, which has to be backed by a file
+// descriptor like the net package's connections. report is told what every send did, if not nil
+func NewBatchWriter(conn net.Conn, conf BatchConfig, report FlushFunc) (*BatchWriter, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("batching needs a connection with a file descriptor")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	send := func(msgs []mmsghdr) (int, syscall.Errno, error) {
+		var n int
+		var errno syscall.Errno
+		err := raw.Write(func(fd uintptr) bool {
+			n, errno = sendmmsg(int(fd), msgs)
+			return errno != unix.EAGAIN
+		})
+		return n, errno, err
+	}
+	return newBatchWriter(send, nil, 0, conf, report), nil
+}
+
+// NewRawBatchWriter creates a BatchWriter on a blocking raw ip socket, sending every packet to
+// dst. report is told what every send did, if not nil
+func NewRawBatchWriter(fd int, dst net.IP, conf BatchConfig, report FlushFunc) *BatchWriter {
+	send := func(msgs []mmsghdr) (int, syscall.Errno, error) {
+		n, errno := sendmmsg(fd, msgs)
+		return n, errno, nil
+	}
+	if ip4 := dst.To4(); ip4 != nil {
+		name := &unix.RawSockaddrInet4{Family: unix.AF_INET}
+		copy(name.Addr[:], ip4)
+		return newBatchWriter(send, unsafe.Pointer(name), unix.SizeofSockaddrInet4, conf, report)
+	}
+	name := &unix.RawSockaddrInet6{Family: unix.AF_INET6}
+	copy(name.Addr[:], dst.To16())
+	return newBatchWriter(send, unsafe.Pointer(name), unix.SizeofSockaddrInet6, conf, report)
+}
+
+func newBatchWriter(send func([]mmsghdr) (int, syscall.Errno, error), name unsafe.Pointer, nameSz int, conf BatchConfig, report FlushFunc) *BatchWriter {
+	size := conf.Size
+	if size < 1 {
+		size = 1
+	}
+	flush := conf.Flush
+	if flush <= 0 {
+		flush = DefaultBatchFlush
+	}
+	w := &BatchWriter{send: send, name: name, nameSz: nameSz, flush: flush, report: report}
+	w.msgs, w.iovs, w.bufs = newMsgs(size, batchSlot, name, nameSz)
+	w.timer = time.AfterFunc(time.Hour, w.timedFlush)
+	w.timer.Stop()
+	return w
+}
+
+// Write queues a packet made up of parts. Whether it makes it out is only known once its batch is
+// sent, so that goes to the writer's FlushFunc. Throws error if the writer is closed
+func (w *BatchWriter) Write(parts ...[]byte) error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.closed {
+		return errors.New("batch writer is closed")
+	}
+
+	size := 0
+	for _, p := range parts {
+		size += len(p)
+	}
+	if size > batchSlot {
+		// too big for a slot, so it goes out on its own after what is already waiting
+		w.flushLocked()
+		w.sendOne(parts, size)
+		return nil
+	}
+
+	buf := w.bufs[w.n][:0]
+	for _, p := range parts {
+		buf = append(buf, p...)
+	}
+	w.iovs[w.n].SetLen(len(buf))
+	w.n++
+	if w.n == len(w.msgs) {
+		w.flushLocked()
+	} else if w.n == 1 {
+		w.timer.Reset(w.flush)
+	}
+	return nil
+}
+
+// sendOne sends a packet outside of the batch and reports it. Must hold w.mux
+func (w *BatchWriter) sendOne(parts [][]byte, size int) {
+	buf := make([]byte, 0, size)
+	for _, p := range parts {
+		buf = append(buf, p...)
+	}
+	msgs, iovs, _ := newMsgs(1, 1, w.name, w.nameSz)
+	iovs[0].Base = &buf[0]
+	iovs[0].SetLen(len(buf))
+	_, errno, err := w.send(msgs)
+	if err == nil && errno != 0 {
+		err = errno
+	}
+	if err != nil {
+		w.reportLocked(0, 0, 1, err)
+		return
+	}
+	w.reportLocked(1, size, 0, nil)
+}
+
+// Flush sends the packets waiting in the batch
+func (w *BatchWriter) Flush() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.flushLocked()
+}
+
+func (w *BatchWriter) timedFlush() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.flushLocked()
+}
+
+// flushLocked sends the batch and reports how many of its packets went out. A packet the socket
+// refuses is dropped and the rest still go out, unless the socket itself fails, which drops what
+// is left. Must hold w.mux
+func (w *BatchWriter) flushLocked() {
+	if w.n == 0 {
+		return
+	}
+	var err error
+	sent, failed, bytes := 0, 0, 0
+	for i := 0; i < w.n; {
+		n, errno, serr := w.send(w.msgs[i:w.n])
+		if serr != nil {
+			err = serr
+			failed += w.n - i
+			break
+		}
+		if errno != 0 {
+			err = errno
+			failed++
+			i++
+			continue
+		}
+		for _, iov := range w.iovs[i : i+n] {
+			bytes += int(iov.Len)
+		}
+		sent += n
+		i += n
+	}
+	w.n = 0
+	w.reportLocked(sent, bytes, failed, err)
+}
+
+// reportLocked hands the outcome of a send to the writer's FlushFunc. Must hold w.mux
+func (w *BatchWriter) reportLocked(sent, bytes, failed int, err error) {
+	if w.report != nil {
+		w.report(sent, bytes, failed, err)
+	}
+}
+
+// Close sends what is left in the batch. It doesn't close the socket
+func (w *BatchWriter) Close() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.timer.Stop()
+	w.closed = true
+	w.flushLocked()
+}
+
+// BatchReader reads packets off a socket up to a batch at a time with recvmmsg. Not safe for
+// concurrent use
+type BatchReader struct {
+	raw  syscall.RawConn
+	msgs []mmsghdr
+	bufs [][]byte
+	out  [][]byte
+}
+
+// NewBatchReader creates a BatchReader reading up to size packets of at most bufSize bytes per
+// syscall from conn, which has to be backed by a file descriptor like the net package's connections
+func NewBatchReader(conn net.PacketConn, size, bufSize int) (*BatchReader, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("batching needs a connection with a file descriptor")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	if size < 1 {
+		size = 1
+	}
+	r := &BatchReader{raw: raw, out: make([][]byte, size)}
+	r.msgs, _, r.bufs = newMsgs(size, bufSize, nil, 0)
+	return r, nil
+}
+
+// Read waits for at least one packet and returns every packet already there, up to the batch
+// size. The packets are only valid until the next Read
+func (r *BatchReader) Read() ([][]byte, error) {
+	var n int
+	var errno syscall.Errno
+	err := r.raw.Read(func(fd uintptr) bool {
+		n, errno = recvmmsg(int(fd), r.msgs)
+		return errno != unix.EAGAIN
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errno != 0 {
+		return nil, errno
+	}
+	for i := 0; i < n; i++ {
+		r.out[i] = r.bufs[i][:r.msgs[i].len]
+	}
+	return r.out[:n], nil
+}
@@ -2,15 +2,27 @@ package util
 
 import (
 	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-// Communicator is the connection manager for a backend
+// MaxFrame is the largest frame a Communicator reads
+const MaxFrame = 64 * 1024
+
+// Communicator is the connection manager for a backend. It reads and writes newline terminated
+// lines or frames prefixed with their big endian 32 bit length
 type Communicator interface {
 	ReadLine() (string, error)
 	WriteLine(data string) error
+	ReadFrame() ([]byte, error)
+	WriteFrame(data []byte) error
+	Peek(n int) ([]byte, error)
 	Close() error
 }
 
@@ -18,6 +30,7 @@ type Communicator interface {
 type TCPCommunicator struct {
 	reader       *bufio.Reader
 	writer       *bufio.Writer
+	writeMux     sync.Mutex // lines can be written from several goroutines
 	conn         net.Conn
 	readTimeout  time.Duration
 	writeTimeout time.Duration
@@ -28,11 +41,11 @@ func NewTCPCommunicator(conn net.Conn, readInt, writeInt int) *TCPCommunicator {
 	readTimeout := time.Duration(readInt) * time.Second
 	writeTimeout := time.Duration(writeInt) * time.Second
 	return &TCPCommunicator{
-		bufio.NewReader(conn),
-		bufio.NewWriter(conn),
-		conn,
-		readTimeout,
-		writeTimeout}
+		reader:       bufio.NewReader(conn),
+		writer:       bufio.NewWriter(conn),
+		conn:         conn,
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout}
 }
 
 // ReadLine reads a line from the connection with the applied timeout
@@ -47,6 +60,8 @@ func (t *TCPCommunicator) ReadLine() (string, error) {
 
 // WriteLine writes to the connection with the applied timeout
 func (t *TCPCommunicator) WriteLine(data string) error {
+	t.writeMux.Lock()
+	defer t.writeMux.Unlock()
 	t.conn.SetWriteDeadline(time.Now().Add(t.writeTimeout))
 	_, err := t.writer.WriteString(data + "\n")
 	if err != nil {
@@ -56,6 +71,48 @@ func (t *TCPCommunicator) WriteLine(data string) error {
 	return err
 }
 
+// ReadFrame reads a length prefixed frame from the connection with the applied timeout. Throws
+// error if the frame is longer than MaxFrame
+func (t *TCPCommunicator) ReadFrame() ([]byte, error) {
+	t.conn.SetReadDeadline(time.Now().Add(t.readTimeout))
+	var length [4]byte
+	_, err := io.ReadFull(t.reader, length[:])
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > MaxFrame {
+		return nil, errors.New("frame of " + strconv.FormatUint(uint64(n), 10) + " bytes is too long")
+	}
+	frame := make([]byte, n)
+	_, err = io.ReadFull(t.reader, frame)
+	return frame, err
+}
+
+// WriteFrame writes data as a length prefixed frame with the applied timeout
+func (t *TCPCommunicator) WriteFrame(data []byte) error {
+	t.writeMux.Lock()
+	defer t.writeMux.Unlock()
+	t.conn.SetWriteDeadline(time.Now().Add(t.writeTimeout))
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	_, err := t.writer.Write(length[:])
+	if err != nil {
+		return err
+	}
+	_, err = t.writer.Write(data)
+	if err != nil {
+		return err
+	}
+	return t.writer.Flush()
+}
+
+// Peek returns the next n bytes without consuming them, waiting at most the read timeout
+func (t *TCPCommunicator) Peek(n int) ([]byte, error) {
+	t.conn.SetReadDeadline(time.Now().Add(t.readTimeout))
+	return t.reader.Peek(n)
+}
+
 // Close closes the underlying tcp connection
 func (t *TCPCommunicator) Close() error {
 	return t.conn.Close()
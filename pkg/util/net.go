@@ -0,0 +1,119 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strconv"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/gopacket/pcap"
+)
+
+// ParseIPs parses a list of ips of either family. Throws error if the list is empty or an ip
+// doesn't parse
+func ParseIPs(raw []string) ([]net.IP, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("no ips given")
+	}
+	ips := make([]net.IP, 0, len(raw))
+	for _, s := range raw {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("could not parse ip " + s)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// HasIPv4 returns whether any of ips is an ipv4 address
+func HasIPv4(ips []net.IP) bool {
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// HostNet returns the /32 or /128 network containing only ip
+func HostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// IPTablesFor returns an iptables handle for the family of the given ip
+func IPTablesFor(ip net.IP) (*iptables.IPTables, error) {
+	if ip.To4() != nil {
+		return iptables.New()
+	}
+	return iptables.NewWithProtocol(iptables.ProtocolIPv6)
+}
+
+// FindDevice returns the name of the device on the same subnet as ip. Throws error if there is
+// no such device or more than one
+func FindDevice(ip net.IP) (string, error) {
+	devices, err := pcap.FindAllDevs()
+	if err != nil {
+		return "", err
+	}
+	foundDevice := ""
+	for _, device := range devices {
+		for _, address := range device.Addresses {
+			ipNet := &net.IPNet{IP: address.IP, Mask: address.Netmask}
+			if ipNet.Contains(ip) {
+				if foundDevice == "" {
+					foundDevice = device.Name
+				} else if foundDevice != device.Name {
+					return "", errors.New("multiple devices on the same subnet. VIP cannot be assigned")
+				}
+			}
+		}
+	}
+	if foundDevice == "" {
+		return "", errors.New("no device on same subnet as VIP. VIP cannot be assigned")
+	}
+	return foundDevice, nil
+}
+
+// arpSysctls keep linux from answering arp requests for addresses on loopback, which it does on
+// every interface by default, and from sourcing its own requests from them. The kernel goes by
+// the higher of conf/all's value and the interface's
+var arpSysctls = []struct{ name, value string }{{"arp_ignore", "1"}, {"arp_announce", "2"}}
+
+// HideLoopbackAddrs stops the host from answering arp for the ipv4 addresses on loopback or
+// announcing them. A NOARP device wouldn't do, as linux answers for any local address on any
+// interface. Settings that are already as strict are left alone. Returns a function putting back
+// what it changed
+func HideLoopbackAddrs() (func(), error) {
+	saved := make(map[string][]byte)
+	restore := func() {
+		for path, value := range saved {
+			ioutil.WriteFile(path, value, 0644)
+		}
+	}
+	for _, sysctl := range arpSysctls {
+		path := "/proc/sys/net/ipv4/conf/all/" + sysctl.name
+		old, err := ioutil.ReadFile(path)
+		if err != nil {
+			restore()
+			return nil, err
+		}
+		current, err := strconv.Atoi(string(bytes.TrimSpace(old)))
+		want, _ := strconv.Atoi(sysctl.value)
+		if err == nil && current >= want {
+			continue
+		}
+		err = ioutil.WriteFile(path, []byte(sysctl.value), 0644)
+		if err != nil {
+			restore()
+			return nil, err
+		}
+		saved[path] = old
+	}
+	return restore, nil
+}
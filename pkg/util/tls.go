@@ -0,0 +1,103 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// TLSCommunicator is an implementation of Communicator over TLS. It can tell which names the peer's
+// certificate was issued to
+type TLSCommunicator struct {
+	*TCPCommunicator
+	conn *tls.Conn
+}
+
+// NewTLSCommunicator creates a new TLS Communicator
+func NewTLSCommunicator(conn *tls.Conn, readInt, writeInt int) *TLSCommunicator {
+	return &TLSCommunicator{
+		TCPCommunicator: NewTCPCommunicator(conn, readInt, writeInt),
+		conn:            conn}
+}
+
+// VerifyName checks that the peer may use name, which is only the common name or a dns name of
+// its certificate. Throws error if the handshake fails, the peer presented no certificate or it
+// was not issued to name
+func (t *TLSCommunicator) VerifyName(name string) error {
+	err := t.conn.Handshake()
+	if err != nil {
+		return err
+	}
+	certs := t.conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("no certificate presented for " + name)
+	}
+	if certs[0].Subject.CommonName == name {
+		return nil
+	}
+	for _, dnsName := range certs[0].DNSNames {
+		if dnsName == name {
+			return nil
+		}
+	}
+	return errors.New("certificate was not issued to " + name)
+}
+
+// ServerTLSConfig loads the certificate the balancer serves the management protocol with. If
+// clientCA is not empty, every backend has to present a certificate signed by it and can only
+// register under a name it was issued to. Otherwise backends connect without one
+func ServerTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCA == "" {
+		return conf, nil
+	}
+
+	// a backend without a certificate could take any name, including the ones bound to
+	// certificates, so they are all required to have one
+	conf.ClientCAs, err = loadPool(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	conf.ClientAuth = tls.RequireAndVerifyClientCert
+	return conf, nil
+}
+
+// ClientTLSConfig builds the config a backend connects to the balancer with. The balancer's
+// certificate is checked against caFile, or the system roots if it is empty, and serverName if it
+// is not empty. The backend presents certFile if it is not empty
+func ClientTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	conf := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	var err error
+	if caFile != "" {
+		conf.RootCAs, err = loadPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// loadPool reads the pem certificates in file into a pool
+func loadPool(file string) (*x509.CertPool, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, errors.New("no certificates found in " + file)
+	}
+	return pool, nil
+}
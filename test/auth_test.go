@@ -0,0 +1,160 @@
+package test
+
+import (
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pwpon500/caplance/internal/balancer/backends"
+	"github.com/pwpon500/caplance/pkg/protocol"
+	"github.com/pwpon500/caplance/pkg/util"
+)
+
+func TestDataAuth(t *testing.T) {
+	auth, err := util.GenerateDataAuth()
+	ok(t, err)
+	other, err := util.GenerateDataAuth()
+	ok(t, err)
+
+	sealed := auth.Seal([]byte("payload"))
+	packet, seq, err := auth.Open(sealed)
+	ok(t, err)
+	equals(t, "payload", string(packet))
+	equals(t, uint64(1), seq)
+
+	_, _, err = other.Open(sealed)
+	assert(t, err != nil, "packet opened with the wrong key")
+	sealed[len(sealed)-1] ^= 1
+	_, _, err = auth.Open(sealed)
+	assert(t, err != nil, "tampered packet opened")
+	_, err = util.NewDataAuth(1, []byte("short"))
+	assert(t, err != nil, "short key accepted")
+
+	// pooled sealers carry on the sequence numbers, and their header goes in front of the packet
+	s := auth.Sealer()
+	packet, seq, err = auth.Open(s.Seal([]byte("pooled")))
+	ok(t, err)
+	equals(t, "pooled", string(packet))
+	equals(t, uint64(2), seq)
+	header := append([]byte(nil), s.Header([]byte("parts"))...)
+	packet, seq, err = auth.Open(append(header, "parts"...))
+	ok(t, err)
+	equals(t, "parts", string(packet))
+	equals(t, uint64(3), seq)
+	auth.PutSealer(s)
+}
+
+func TestKeyExchange(t *testing.T) {
+	balancer, err := util.NewKeyExchange()
+	ok(t, err)
+	backend, err := util.NewKeyExchange()
+	ok(t, err)
+
+	sealer, err := balancer.DataAuth(7, backend.Public())
+	ok(t, err)
+	opener, err := backend.DataAuth(7, balancer.Public())
+	ok(t, err)
+	packet, _, err := opener.Open(sealer.Seal([]byte("payload")))
+	ok(t, err)
+	equals(t, "payload", string(packet))
+
+	// a low order point would leave the key up to whoever sent it
+	_, err = balancer.DataAuth(7, make([]byte, util.ExchangeKeyLen))
+	assert(t, err != nil, "low order public key accepted")
+	_, err = balancer.DataAuth(7, []byte("short"))
+	assert(t, err != nil, "short public key accepted")
+}
+
+func TestReplayWindow(t *testing.T) {
+	var window util.ReplayWindow
+	assert(t, window.Check(2), "first packet rejected")
+	assert(t, window.Check(1), "reordered packet rejected")
+	assert(t, !window.Check(2), "replayed packet accepted")
+	assert(t, window.Check(5000), "newer packet rejected")
+	assert(t, window.Check(905), "packet within the window rejected")
+	assert(t, !window.Check(904), "packet behind the window accepted")
+	assert(t, !window.Check(905), "replayed packet within the window accepted")
+	assert(t, !window.Check(0), "sequence number 0 accepted")
+
+	// batches from the forwarder's workers arrive interleaved
+	for seq := uint64(6000); seq > 5000; seq-- {
+		assert(t, window.Check(seq), "reordered packet rejected: "+strconv.FormatUint(seq, 10))
+	}
+	for seq := uint64(6000); seq > 5000; seq -= 7 {
+		assert(t, !window.Check(seq), "replayed packet accepted: "+strconv.FormatUint(seq, 10))
+	}
+	// jumping past the whole window forgets it
+	assert(t, window.Check(20000), "newer packet rejected")
+	assert(t, window.Check(20000-4095), "packet within the window rejected")
+	assert(t, !window.Check(6000), "packet behind the window accepted")
+}
+
+func TestAuthenticatedSanity(t *testing.T) {
+	pool, err := backends.NewPool("test", []net.IP{net.ParseIP("10.0.0.50")}, 53, nil, nil, backends.StatusPolicy{Rise: 1, Fall: 1})
+	ok(t, err)
+	manager := backends.NewManager(localIP, 13384, 5, 5, time.Minute, nil, nil, util.BatchConfig{})
+	ok(t, manager.AddPool(pool))
+	go manager.Listen()
+
+	data, err := net.ListenPacket("udp", "127.0.0.1:0")
+	ok(t, err)
+	defer data.Close()
+	port := data.LocalAddr().(*net.UDPAddr).Port
+
+	// keys sent in plaintext are refused
+	auth, err := util.GenerateDataAuth()
+	ok(t, err)
+	comm := dialManager(t, 13384, nil)
+	ok(t, comm.WriteLine("REGISTER b1 127.0.0.1 port="+strconv.Itoa(port)+
+		" keyid="+strconv.FormatUint(uint64(auth.KeyID()), 10)+" key="+hex.EncodeToString(auth.Key())))
+	line, err := comm.ReadLine()
+	ok(t, err)
+	assert(t, strings.HasPrefix(line, "INVALID"), "plaintext key accepted: "+line)
+	comm.Close()
+
+	// the key comes out of the exchange the balancer offers instead
+	conn, _ := registerSealed(t, 13384, "b1", data)
+	conn.Close()
+}
+
+// registerSealed registers a backend named name taking packets on data, with a key from the
+// exchange the balancer offers. Returns the connection and the key the backend's packets come
+// sealed with
+func registerSealed(t *testing.T, port int, name string, data net.PacketConn) (*protocol.Conn, *util.DataAuth) {
+	conn, hello, err := protocol.Connect(dialManager(t, port, nil), protocol.V2, protocol.Capabilities)
+	ok(t, err)
+	offer, err := hex.DecodeString(hello.Exchange)
+	ok(t, err)
+	exchange, err := util.NewKeyExchange()
+	ok(t, err)
+	auth, err := exchange.DataAuth(42, offer)
+	ok(t, err)
+	register := &protocol.Message{
+		Type:     protocol.Register,
+		Name:     name,
+		DataIP:   "127.0.0.1",
+		Port:     data.LocalAddr().(*net.UDPAddr).Port,
+		KeyID:    42,
+		Exchange: hex.EncodeToString(exchange.Public()),
+	}
+	ok(t, conn.Request(register))
+
+	buf := make([]byte, 200)
+	data.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := data.ReadFrom(buf)
+	ok(t, err)
+	packet, _, err := auth.Open(buf[:n])
+	ok(t, err)
+	sanity := strings.Split(string(packet), " ")
+	equals(t, "SANITY", sanity[0])
+	equals(t, 32, len(sanity[1]))
+	ok(t, conn.Request(&protocol.Message{Type: protocol.Sane, Nonce: sanity[1]}))
+
+	reply, err := conn.ReadMessage()
+	ok(t, err)
+	equals(t, protocol.Registered, reply.Type)
+	return conn, auth
+}
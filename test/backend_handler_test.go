@@ -1,11 +1,15 @@
 package test
 
 import (
+	"net"
+	"strconv"
 	"testing"
 
-	"github.com/pwpon500/caplance/balancer/backends"
+	"github.com/pwpon500/caplance/internal/balancer/backends"
 )
 
+var localIP = net.ParseIP("127.0.0.1")
+
 func TestNonPrimeCapacity(t *testing.T) {
 	_, err := backends.NewHandler(10)
 	assert(t, err != nil, "error thrown for non-prime capacity")
@@ -15,31 +19,171 @@ func TestSingleBackend(t *testing.T) {
 	back, err := backends.NewHandler(3)
 	ok(t, err)
 
-	back.Add("b1", "gre0")
-	expected := "gre0"
+	ok(t, back.Add("b1", localIP, backends.Encap{}, 1))
 	actual, err := back.Get("10.0.0.2:53686")
 	ok(t, err)
 
-	equals(t, expected, actual)
+	equals(t, "b1", actual.Name())
 }
 
 func TestBackendRemove(t *testing.T) {
 	back, err := backends.NewHandler(3)
 	ok(t, err)
 
-	m := make(map[string]string)
-	m["gre0"] = "b1"
-	m["gre1"] = "b2"
-
-	back.Add("b1", "gre0")
-	back.Add("b2", "gre1")
+	ok(t, back.Add("b1", localIP, backends.Encap{}, 1))
+	ok(t, back.Add("b2", localIP, backends.Encap{}, 1))
 	expected, err := back.Get("192.168.1.2:789")
 	ok(t, err)
 
-	expectedName := m[expected]
-	back.Remove(expectedName)
+	ok(t, back.Remove(expected.Name()))
+	actual, err := back.Get("192.168.1.2:789")
+	ok(t, err)
+
+	assert(t, expected.Name() != actual.Name(), "removed backend was not used")
+}
+
+func TestRemoveMissingBackend(t *testing.T) {
+	back, err := backends.NewHandler(3)
+	ok(t, err)
+
+	ok(t, back.Add("b1", localIP, backends.Encap{}, 1))
+	assert(t, back.Remove("b2") != nil, "no error thrown for missing backend")
+
 	actual, err := back.Get("192.168.1.2:789")
 	ok(t, err)
+	equals(t, "b1", actual.Name())
+}
+
+func TestBackendDrain(t *testing.T) {
+	back, err := backends.NewHandler(3)
+	ok(t, err)
+
+	ok(t, back.Add("b1", localIP, backends.Encap{}, 1))
+	ok(t, back.Add("b2", localIP, backends.Encap{}, 1))
+	ok(t, back.Drain("b1"))
+	assert(t, back.Drain("b1") != nil, "no error thrown for draining a drained backend")
+
+	for _, key := range []string{"10.0.0.2:53686", "192.168.1.2:789", "172.16.0.9:443"} {
+		actual, err := back.Get(key)
+		ok(t, err)
+		equals(t, "b2", actual.Name())
+	}
+	assert(t, back.GetByName("b1") != nil, "drained backend not reachable by name")
+
+	ok(t, back.Undrain("b1", 1))
+	ok(t, back.Drain("b1"))
+	ok(t, back.Remove("b1"))
+	assert(t, back.GetByName("b1") == nil, "removed drained backend still reachable by name")
+}
+
+func TestWeightedBackends(t *testing.T) {
+	back, err := backends.NewHandler(65537)
+	ok(t, err)
+
+	ok(t, back.Add("small", localIP, backends.Encap{}, 1))
+	ok(t, back.Add("big", localIP, backends.Encap{}, 3))
+
+	counts := countOwners(t, back, 40000)
+	ratio := float64(counts["big"]) / float64(counts["small"])
+	assert(t, ratio > 2.7 && ratio < 3.3, "expected a 3:1 split, got %v", counts)
 
-	assert(t, expected != actual, "removed backend was not used")
+	ok(t, back.SetWeight("small", 3))
+	counts = countOwners(t, back, 40000)
+	ratio = float64(counts["big"]) / float64(counts["small"])
+	assert(t, ratio > 0.9 && ratio < 1.1, "expected an even split after reweighting, got %v", counts)
+}
+
+func countOwners(t *testing.T, back *backends.Handler, keys int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		owner, err := back.Get("10.0.0.2:" + strconv.Itoa(i))
+		ok(t, err)
+		counts[owner.Name()]++
+	}
+	return counts
+}
+
+func TestDeterministicTable(t *testing.T) {
+	forward, err := backends.NewHandler(53)
+	ok(t, err)
+	reverse, err := backends.NewHandler(53)
+	ok(t, err)
+
+	for i := 0; i < 5; i++ {
+		ok(t, forward.Add("b"+strconv.Itoa(i), localIP, backends.Encap{}, i+1))
+	}
+	for i := 4; i >= 0; i-- {
+		ok(t, reverse.Add("b"+strconv.Itoa(i), localIP, backends.Encap{}, i+1))
+	}
+	equals(t, forward.Fingerprint(), reverse.Fingerprint())
+
+	// the table only depends on the current backends, not on how they got there
+	ok(t, reverse.Remove("b2"))
+	assert(t, forward.Fingerprint() != reverse.Fingerprint(), "fingerprint did not change with the backends")
+	ok(t, reverse.Add("b2", localIP, backends.Encap{}, 3))
+	equals(t, forward.Fingerprint(), reverse.Fingerprint())
+
+	for i := 0; i < 100; i++ {
+		key := "10.0.0." + strconv.Itoa(i) + ":80"
+		expected, err := forward.Get(key)
+		ok(t, err)
+		actual, err := reverse.Get(key)
+		ok(t, err)
+		equals(t, expected.Name(), actual.Name())
+	}
+}
+
+func TestConcurrentBackendAdd(t *testing.T) {
+	back, err := backends.NewHandler(53)
+	ok(t, err)
+
+	// only one of the adds of a name gets through, and lookups never see a half added backend
+	added := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func() {
+			added <- back.Add("b1", localIP, backends.Encap{}, 1) == nil
+		}()
+	}
+	successes := 0
+	for i := 0; i < 8; i++ {
+		if <-added {
+			successes++
+		}
+		if actual, err := back.Get("10.0.0.2:53686"); err == nil {
+			assert(t, actual != nil, "lookup returned no backend and no error")
+		}
+	}
+	equals(t, 1, successes)
+	equals(t, 1, len(back.GetBackends()))
+}
+
+func TestFOUControlFamily(t *testing.T) {
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	ok(t, err)
+	defer sink.Close()
+	port := sink.LocalAddr().(*net.UDPAddr).Port
+	buf := make([]byte, 1500)
+
+	// control messages go to the data ip inside the tunnel
+	fou, err := backends.NewForwarder("test", "b1", localIP, backends.Encap{Type: backends.EncapFOU, Port: port})
+	ok(t, err)
+	defer fou.Close()
+	ok(t, fou.SendControl([]byte("SANITY 1")))
+	n, _, err := sink.ReadFrom(buf)
+	ok(t, err)
+	equals(t, byte(4), buf[0]>>4)
+	equals(t, localIP.To4(), net.IP(buf[16:20]))
+	equals(t, "SANITY 1", string(buf[28:n]))
+
+	// unless the tunnel only carries ipv6
+	vip := net.ParseIP("fd00::50")
+	fou6, err := backends.NewForwarder("test", "b2", localIP, backends.Encap{Type: backends.EncapFOU, Port: port, Control: vip})
+	ok(t, err)
+	defer fou6.Close()
+	ok(t, fou6.SendControl([]byte("SANITY 2")))
+	n, _, err = sink.ReadFrom(buf)
+	ok(t, err)
+	equals(t, byte(6), buf[0]>>4)
+	equals(t, vip, net.IP(buf[24:40]))
+	equals(t, "SANITY 2", string(buf[48:n]))
 }
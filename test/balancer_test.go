@@ -1,25 +1,119 @@
 package test
 
 import (
+	"encoding/binary"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/gopacket/pcap"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/pwpon500/caplance/internal/balancer"
+	"github.com/pwpon500/caplance/internal/balancer/backends"
+	"github.com/pwpon500/caplance/internal/balancer/conntrack"
+	"github.com/pwpon500/caplance/internal/balancer/metrics"
 )
 
+// testConfig configures a balancer for services with the defaults the tests share
+func testConfig(services []balancer.ServiceConfig, connectIP net.IP) balancer.Config {
+	return balancer.Config{Services: services, ConnectIP: connectIP, ReadTimeout: 30, WriteTimeout: 10, DrainTimeout: 300}
+}
+
 func TestBalancerCreation(t *testing.T) {
 	vip := net.ParseIP("10.0.0.50")
 	connectIP := net.ParseIP("10.0.0.1")
-	_, err := balancer.New(vip, connectIP, 53)
+	services := []balancer.ServiceConfig{{Name: "test", VIPs: []net.IP{vip}, Capacity: 53}}
+	_, err := balancer.New(testConfig(services, connectIP))
+	ok(t, err)
+}
+
+func TestSharedVIPRejected(t *testing.T) {
+	vip := net.ParseIP("10.0.0.50")
+	connectIP := net.ParseIP("10.0.0.1")
+	services := []balancer.ServiceConfig{
+		{Name: "first", VIPs: []net.IP{vip}, Capacity: 53},
+		{Name: "second", VIPs: []net.IP{net.ParseIP("10.0.0.51"), vip}, Capacity: 53},
+	}
+	_, err := balancer.New(testConfig(services, connectIP))
+	assert(t, err != nil, "no error thrown for vip shared between services")
+}
+
+func TestSharedVIPPorts(t *testing.T) {
+	vip := net.ParseIP("10.0.0.50")
+	connectIP := net.ParseIP("10.0.0.1")
+	web, err := balancer.ParsePortRange("tcp/80")
+	ok(t, err)
+	dns, err := balancer.ParsePortRange("udp/53")
+	ok(t, err)
+	high, err := balancer.ParsePortRange("tcp/8000-8100")
+	ok(t, err)
+
+	services := []balancer.ServiceConfig{
+		{Name: "web", VIPs: []net.IP{vip}, Ports: []balancer.PortRange{web, high}, Capacity: 53},
+		{Name: "dns", VIPs: []net.IP{vip}, Ports: []balancer.PortRange{dns}, Capacity: 53},
+	}
+	_, err = balancer.New(testConfig(services, connectIP))
+	ok(t, err)
+
+	overlap, err := balancer.ParsePortRange("tcp/8080")
+	ok(t, err)
+	services = append(services, balancer.ServiceConfig{Name: "alt", VIPs: []net.IP{vip}, Ports: []balancer.PortRange{overlap}, Capacity: 53})
+	_, err = balancer.New(testConfig(services, connectIP))
+	assert(t, err != nil, "no error thrown for port served by two services on the same vip")
+}
+
+func TestIPv6Services(t *testing.T) {
+	connectIP := net.ParseIP("10.0.0.1")
+	web, err := balancer.ParsePortRange("tcp/80")
+	ok(t, err)
+	dns, err := balancer.ParsePortRange("udp/53")
+	ok(t, err)
+
+	v6 := net.ParseIP("fd00::50")
+	services := []balancer.ServiceConfig{
+		{Name: "dual", VIPs: []net.IP{net.ParseIP("10.0.0.50"), net.ParseIP("fd00::51")}, Capacity: 53},
+		{Name: "web6", VIPs: []net.IP{v6}, Ports: []balancer.PortRange{web}, Capacity: 53},
+		{Name: "dns6", VIPs: []net.IP{v6}, Ports: []balancer.PortRange{dns}, Capacity: 53},
+	}
+	_, err = balancer.New(testConfig(services, connectIP))
+	ok(t, err)
+
+	// the same vip written differently is still the same vip
+	services = append(services, balancer.ServiceConfig{Name: "alt", VIPs: []net.IP{net.ParseIP("fd00:0::50")}, Ports: []balancer.PortRange{web}, Capacity: 53})
+	_, err = balancer.New(testConfig(services, connectIP))
+	assert(t, err != nil, "no error thrown for ipv6 port served by two services on the same vip")
+}
+
+func TestInvalidHealthCheck(t *testing.T) {
+	vip := net.ParseIP("10.0.0.50")
+	connectIP := net.ParseIP("10.0.0.1")
+	check := &backends.HealthCheck{Type: "icmp", Port: 80, Interval: time.Second, Timeout: time.Second, Rise: 1, Fall: 1}
+	services := []balancer.ServiceConfig{{Name: "test", VIPs: []net.IP{vip}, Capacity: 53, Check: check}}
+	_, err := balancer.New(testConfig(services, connectIP))
+	assert(t, err != nil, "no error thrown for unknown health check type")
+
+	check.Type = backends.CheckHTTP
+	_, err = balancer.New(testConfig(services, connectIP))
+	ok(t, err)
+}
+
+func TestParsePortRange(t *testing.T) {
+	r, err := balancer.ParsePortRange("udp/5000-5100")
 	ok(t, err)
+	equals(t, balancer.PortRange{Proto: 17, From: 5000, To: 5100}, r)
+
+	for _, raw := range []string{"80", "sctp/80", "tcp/http", "tcp/90-80", "tcp/70000"} {
+		_, err = balancer.ParsePortRange(raw)
+		assert(t, err != nil, "no error thrown for port range "+raw)
+	}
 }
 
 func TestVIPAttachDetach(t *testing.T) {
 	vip := net.ParseIP("10.0.0.50")
 	connectIP := net.ParseIP("10.0.0.1")
-	bal, err := balancer.NewTest(vip, connectIP, 53)
+	services := []balancer.ServiceConfig{{Name: "test", VIPs: []net.IP{vip}, Capacity: 53}}
+	bal, err := balancer.NewTest(testConfig(services, connectIP))
 	go bal.Start()
 	time.Sleep(10 * time.Millisecond) // sleep long enough to ensure Start() gets mutex lock
 	bal.WaitForUnlock()
@@ -62,3 +156,149 @@ func TestVIPAttachDetach(t *testing.T) {
 	}
 	equals(t, "", foundDevice)
 }
+
+// receives reports whether a packet arrives on data before the timeout
+func receives(data net.PacketConn, timeout time.Duration) bool {
+	buf := make([]byte, 1500)
+	data.SetReadDeadline(time.Now().Add(timeout))
+	_, _, err := data.ReadFrom(buf)
+	return err == nil
+}
+
+func TestPausedBackendKeepsFlows(t *testing.T) {
+	conns := conntrack.New(100, time.Minute, time.Minute, time.Minute)
+	services := []balancer.ServiceConfig{{Name: "pinned", VIPs: []net.IP{vipIP}, Capacity: 53}}
+	conf := testConfig(services, localIP)
+	conf.Port, conf.Conns = 13388, conns
+	b, err := balancer.NewTest(conf)
+	ok(t, err)
+	go b.Manager().Listen()
+
+	data1, err := net.ListenPacket("udp", "127.0.0.1:0")
+	ok(t, err)
+	defer data1.Close()
+	comm1 := registerOn(t, dialManager(t, 13388, nil), "b1", data1)
+	defer comm1.Close()
+
+	pinned := ipPacket(6, clientIP, vipIP, 1000, 80, 0)
+	ok(t, b.Forward(pinned))
+	assert(t, receives(data1, time.Second), "flow not forwarded to b1")
+
+	data2, err := net.ListenPacket("udp", "127.0.0.1:0")
+	ok(t, err)
+	defer data2.Close()
+	comm2 := registerOn(t, dialManager(t, 13388, nil), "b2", data2)
+	defer comm2.Close()
+
+	ok(t, comm1.WriteLine("PAUSE"))
+	line, err := comm1.ReadLine()
+	ok(t, err)
+	equals(t, "PAUSED b1", line)
+
+	// the established flow stays with the paused backend, new ones go elsewhere
+	ok(t, b.Forward(pinned))
+	assert(t, receives(data1, time.Second), "pinned flow moved off paused b1")
+	ok(t, b.Forward(ipPacket(6, clientIP, vipIP, 1001, 80, 0)))
+	assert(t, receives(data2, time.Second), "new flow not forwarded to b2")
+	assert(t, !receives(data1, 100*time.Millisecond), "new flow forwarded to paused b1")
+
+	// the forwarders count what they forward, but not the sanity checks they send
+	equals(t, 2.0, testutil.ToFloat64(metrics.ForwardedPackets.WithLabelValues("pinned", "b1")))
+	equals(t, 1.0, testutil.ToFloat64(metrics.ForwardedPackets.WithLabelValues("pinned", "b2")))
+}
+
+// queueSource is a source.Source delivering whatever the test puts on its queues
+type queueSource struct {
+	queues   []chan []byte
+	released int32
+}
+
+func newQueueSource(n int) *queueSource {
+	src := &queueSource{}
+	for i := 0; i < n; i++ {
+		src.queues = append(src.queues, make(chan []byte, 100))
+	}
+	return src
+}
+
+func (s *queueSource) Queues() []<-chan []byte {
+	queues := make([]<-chan []byte, len(s.queues))
+	for i, queue := range s.queues {
+		queues[i] = queue
+	}
+	return queues
+}
+
+func (s *queueSource) Release(packet []byte) {
+	atomic.AddInt32(&s.released, 1)
+}
+
+func (s *queueSource) Close() error {
+	return nil
+}
+
+func TestServeKeepsFlowOrder(t *testing.T) {
+	const flows, perFlow, perRound = 12, 50, 10
+	services := []balancer.ServiceConfig{{Name: "ordered", VIPs: []net.IP{vipIP}, Capacity: 53}}
+	conf := testConfig(services, localIP)
+	conf.Port = 13398
+	b, err := balancer.NewTest(conf)
+	ok(t, err)
+	go b.Manager().Listen()
+
+	// every packet a backend gets is its flow's source port and its sequence number in the flow
+	received := make(chan [2]uint16, flows*perFlow)
+	for _, name := range []string{"b1", "b2"} {
+		data, err := net.ListenPacket("udp", "127.0.0.1:0")
+		ok(t, err)
+		defer data.Close()
+		comm := registerOn(t, dialManager(t, conf.Port, nil), name, data)
+		defer comm.Close()
+		go func(data net.PacketConn) {
+			buf := make([]byte, 1500)
+			for {
+				n, _, err := data.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				if n >= 30 {
+					received <- [2]uint16{binary.BigEndian.Uint16(buf[20:]), binary.BigEndian.Uint16(buf[28:])}
+				}
+			}
+		}(data)
+	}
+
+	src := newQueueSource(3)
+	done := make(chan struct{})
+	defer close(done)
+	go b.Serve(src, done)
+
+	// each flow only ever comes in on one queue, but every queue carries several flows. sent in
+	// rounds so the backends' socket buffers never overflow
+	next := make(map[uint16]uint16)
+	for round := 0; round < perFlow/perRound; round++ {
+		for seq := round * perRound; seq < (round+1)*perRound; seq++ {
+			for port := 2000; port < 2000+flows; port++ {
+				packet := ipPacket(17, clientIP, vipIP, uint16(port), 53, 0)
+				binary.BigEndian.PutUint16(packet[28:], uint16(seq))
+				src.queues[port%len(src.queues)] <- packet
+			}
+		}
+		for i := 0; i < flows*perRound; i++ {
+			select {
+			case p := <-received:
+				equals(t, next[p[0]], p[1])
+				next[p[0]]++
+			case <-time.After(5 * time.Second):
+				t.Fatalf("only %d of %d packets forwarded", round*flows*perRound+i, flows*perFlow)
+			}
+		}
+	}
+	equals(t, flows, len(next))
+	waitFor(t, 5*time.Second, "not every packet released", func() bool {
+		return atomic.LoadInt32(&src.released) == flows*perFlow
+	})
+	waitFor(t, 5*time.Second, "queue depth left above 0", func() bool {
+		return testutil.ToFloat64(metrics.QueueDepth) == 0
+	})
+}
@@ -0,0 +1,259 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pwpon500/caplance/internal/balancer/backends"
+	"github.com/pwpon500/caplance/pkg/util"
+)
+
+func TestBatchWriter(t *testing.T) {
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	ok(t, err)
+	defer sink.Close()
+	conn, err := net.Dial("udp", sink.LocalAddr().String())
+	ok(t, err)
+	defer conn.Close()
+	counts := &flushCounts{}
+	writer, err := util.NewBatchWriter(conn, util.BatchConfig{Size: 4, Flush: 20 * time.Millisecond}, counts.flushed)
+	ok(t, err)
+	defer writer.Close()
+
+	// a full batch, a packet too big for a slot and a lone packet that goes out on the timer
+	big := bytes.Repeat([]byte("b"), 3000)
+	sent := [][]byte{[]byte("p0"), []byte("p1"), []byte("p2"), []byte("p3"), big, []byte("p5")}
+	for _, p := range sent[:5] {
+		ok(t, writer.Write(p))
+	}
+	ok(t, writer.Write([]byte("p"), []byte("5")))
+
+	buf := make([]byte, 4096)
+	sink.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, p := range sent {
+		n, _, err := sink.ReadFrom(buf)
+		ok(t, err)
+		equals(t, p, buf[:n])
+	}
+	// the last batch may be read before it is reported
+	waitFor(t, time.Second, "batches not reported", func() bool {
+		return counts.get()[0] == 6
+	})
+	equals(t, [3]int{6, 2*5 + 3000, 0}, counts.get())
+}
+
+// flushCounts adds up what a BatchWriter reports
+type flushCounts struct {
+	sent, bytes, failed int
+	mux                 sync.Mutex
+}
+
+func (c *flushCounts) flushed(sent, bytes, failed int, err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.sent += sent
+	c.bytes += bytes
+	c.failed += failed
+}
+
+func (c *flushCounts) get() [3]int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return [3]int{c.sent, c.bytes, c.failed}
+}
+
+func TestBatchWriterFailures(t *testing.T) {
+	// nothing listens on the port, so the icmp error for the first batch fails a packet of the next
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	ok(t, err)
+	addr := closed.LocalAddr().String()
+	closed.Close()
+	conn, err := net.Dial("udp", addr)
+	ok(t, err)
+	defer conn.Close()
+	counts := &flushCounts{}
+	writer, err := util.NewBatchWriter(conn, util.BatchConfig{Size: 4, Flush: time.Hour}, counts.flushed)
+	ok(t, err)
+	defer writer.Close()
+
+	for i := 0; i < 4; i++ {
+		ok(t, writer.Write([]byte("p")))
+	}
+	waitFor(t, 5*time.Second, "first batch not sent", func() bool {
+		return counts.get()[0] == 4
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	// the packets that caused nothing are neither blamed for the failure nor counted as dropped
+	for i := 0; i < 4; i++ {
+		ok(t, writer.Write([]byte("p")))
+	}
+	equals(t, [3]int{7, 7, 1}, counts.get())
+}
+
+func TestBatchReader(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	ok(t, err)
+	defer conn.Close()
+	reader, err := util.NewBatchReader(conn, 8, 1500)
+	ok(t, err)
+
+	sender, err := net.Dial("udp", conn.LocalAddr().String())
+	ok(t, err)
+	defer sender.Close()
+	for i := byte(0); i < 5; i++ {
+		_, err = sender.Write([]byte{'p', '0' + i})
+		ok(t, err)
+	}
+
+	var got []string
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(got) < 5 {
+		batch, err := reader.Read()
+		ok(t, err)
+		for _, p := range batch {
+			got = append(got, string(p))
+		}
+	}
+	equals(t, []string{"p0", "p1", "p2", "p3", "p4"}, got)
+}
+
+// benchPacket is what the benchmarks push around, about the size of a small request
+var benchPacket = make([]byte, 200)
+
+func reportRate(b *testing.B) {
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+}
+
+// BenchmarkUDPForwarder compares sending a packet per write with sendmmsg batches on the way from
+// the balancer to a udp backend
+func BenchmarkUDPForwarder(b *testing.B) {
+	for _, bench := range []struct {
+		name  string
+		batch util.BatchConfig
+	}{{"write", util.BatchConfig{}}, {"sendmmsg", util.BatchConfig{Size: 32}}} {
+		b.Run(bench.name, func(b *testing.B) {
+			sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+			ok(b, err)
+			defer sink.Close()
+			conn, err := net.Dial("udp", sink.LocalAddr().String())
+			ok(b, err)
+			forwarder := backends.NewUDPForwarder(conn, nil, bench.batch)
+			defer forwarder.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				forwarder.SendData(benchPacket)
+			}
+			reportRate(b)
+		})
+	}
+}
+
+// BenchmarkDataReceive compares reading a packet per ReadFrom with recvmmsg batches on the client's
+// data socket
+func BenchmarkDataReceive(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		size int
+	}{{"readfrom", 0}, {"recvmmsg", 32}} {
+		b.Run(bench.name, func(b *testing.B) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			ok(b, err)
+			defer conn.Close()
+			out, err := net.Dial("udp", conn.LocalAddr().String())
+			ok(b, err)
+			defer out.Close()
+			writer, err := util.NewBatchWriter(out, util.BatchConfig{Size: 64}, nil)
+			ok(b, err)
+			defer writer.Close()
+
+			// fill the socket a round at a time outside of the timer, so only reading is measured.
+			// a round fits in the default receive buffer
+			const round = 128
+			buf := make([]byte, 1500)
+			reader, err := util.NewBatchReader(conn, bench.size, 1500)
+			ok(b, err)
+			b.ResetTimer()
+			for left := b.N; left > 0; left -= round {
+				b.StopTimer()
+				count := round
+				if left < count {
+					count = left
+				}
+				for i := 0; i < count; i++ {
+					ok(b, writer.Write(benchPacket))
+				}
+				writer.Flush()
+				b.StartTimer()
+				for n := 0; n < count; {
+					if bench.size == 0 {
+						_, _, err = conn.ReadFrom(buf)
+						n++
+					} else {
+						var batch [][]byte
+						batch, err = reader.Read()
+						n += len(batch)
+					}
+					ok(b, err)
+				}
+			}
+			reportRate(b)
+		})
+	}
+}
+
+// BenchmarkRawWrite compares a sendto per packet with sendmmsg batches on the raw socket the client
+// hands packets to its vips through
+func BenchmarkRawWrite(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		size int
+	}{{"sendto", 0}, {"sendmmsg", 32}} {
+		b.Run(bench.name, func(b *testing.B) {
+			fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+			if os.IsPermission(err) {
+				b.Skip("raw sockets need CAP_NET_RAW")
+			}
+			ok(b, err)
+			defer syscall.Close(fd)
+			sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+			ok(b, err)
+			defer sink.Close()
+
+			// an ip/udp packet to the sink, which never reads it
+			dst := net.ParseIP("127.0.0.1").To4()
+			packet := make([]byte, 28+len(benchPacket))
+			packet[0], packet[8], packet[9] = 0x45, 64, 17
+			binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+			copy(packet[12:], dst)
+			copy(packet[16:], dst)
+			binary.BigEndian.PutUint16(packet[20:], 9)
+			binary.BigEndian.PutUint16(packet[22:], uint16(sink.LocalAddr().(*net.UDPAddr).Port))
+			binary.BigEndian.PutUint16(packet[24:], uint16(8+len(benchPacket)))
+
+			addr := &syscall.SockaddrInet4{}
+			copy(addr.Addr[:], dst)
+			writer := util.NewRawBatchWriter(fd, dst, util.BatchConfig{Size: bench.size}, nil)
+			defer writer.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if bench.size == 0 {
+					err = syscall.Sendto(fd, packet, 0, addr)
+				} else {
+					err = writer.Write(packet)
+				}
+				if err != nil && err != syscall.ENOBUFS {
+					ok(b, err)
+				}
+			}
+			reportRate(b)
+		})
+	}
+}
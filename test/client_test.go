@@ -0,0 +1,186 @@
+package test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pwpon500/caplance/internal/balancer/backends"
+	"github.com/pwpon500/caplance/internal/client"
+	"github.com/pwpon500/caplance/pkg/protocol"
+	"github.com/pwpon500/caplance/pkg/util"
+	"github.com/vishvananda/netlink"
+)
+
+// cutProxy forwards tcp connections to target until they are cut
+type cutProxy struct {
+	listener net.Listener
+	target   string
+	conns    []net.Conn
+	mux      sync.Mutex
+}
+
+func startProxy(t *testing.T, addr, target string) *cutProxy {
+	listener, err := net.Listen("tcp", addr)
+	ok(t, err)
+	p := &cutProxy{listener: listener, target: target}
+	go p.serve()
+	return p
+}
+
+func (p *cutProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", p.target)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		p.mux.Lock()
+		p.conns = append(p.conns, conn, upstream)
+		p.mux.Unlock()
+		go io.Copy(upstream, conn)
+		go io.Copy(conn, upstream)
+	}
+}
+
+// cut closes every connection forwarded so far, as if the network between the ends went away
+func (p *cutProxy) cut() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func (p *cutProxy) Close() {
+	p.listener.Close()
+	p.cut()
+}
+
+// waitFor polls cond until it holds, failing the test if it doesn't within timeout
+func waitFor(t *testing.T, timeout time.Duration, msg string, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		assert(t, time.Now().Before(deadline), msg)
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// backendStatus returns the status of the backend named name, or false if it isn't registered
+func backendStatus(manager *backends.Manager, name string) (backends.BackendStatus, bool) {
+	for _, status := range manager.Statuses() {
+		if status.Name == name {
+			return status, true
+		}
+	}
+	return backends.BackendStatus{}, false
+}
+
+func TestClientReconnect(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the client needs root to attach its vip")
+	}
+	vip := net.ParseIP("10.99.0.50")
+	pool, err := backends.NewPool("test", []net.IP{vip}, 53, nil, nil, backends.StatusPolicy{Rise: 1, Fall: 1})
+	ok(t, err)
+	manager := backends.NewManager(localIP, 13392, 5, 5, time.Minute, nil, nil, util.BatchConfig{})
+	ok(t, manager.AddPool(pool))
+	go manager.Listen()
+	waitFor(t, 5*time.Second, "manager never started listening", func() bool {
+		conn, err := net.Dial("tcp", "127.0.0.1:13392")
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+
+	// clients always dial port 1338 of the balancer
+	balancerIP := net.ParseIP("127.0.0.3")
+	proxy := startProxy(t, "127.0.0.3:1338", "127.0.0.1:13392")
+	defer proxy.Close()
+
+	dir, err := ioutil.TempDir("", "caplance")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	defer func() {
+		lo, err := netlink.LinkByName("lo")
+		if err == nil {
+			netlink.AddrDel(lo, &netlink.Addr{IPNet: util.HostNet(vip)})
+		}
+	}()
+
+	cl := client.NewClient(client.Config{
+		Name:         "c1",
+		VIPs:         []net.IP{vip},
+		DataIP:       balancerIP,
+		ReadTimeout:  5,
+		WriteTimeout: 5,
+		HealthRate:   1,
+		Sockaddr:     filepath.Join(dir, "client.sock"),
+		Encap:        client.EncapUDP,
+		Weight:       1,
+		Protocol:     protocol.V2,
+	})
+	go cl.Start([]net.IP{balancerIP})
+
+	// talk to the client like caplancectl does, once it is up
+	sock := filepath.Join(dir, "client.sock")
+	var ctl *rpc.Client
+	waitFor(t, 5*time.Second, "client never opened its socket", func() bool {
+		ctl, err = rpc.DialHTTP("unix", sock)
+		return err == nil
+	})
+	defer ctl.Close()
+	state := func() string {
+		var reply string
+		ok(t, ctl.Call("Client.GetState", "", &reply))
+		return reply
+	}
+	waitFor(t, 5*time.Second, "client never became active", func() bool {
+		return strings.HasPrefix(state(), "Active")
+	})
+
+	var reply string
+	ok(t, ctl.Call("Client.Pause", "", &reply))
+	waitFor(t, 5*time.Second, "client never got paused", func() bool {
+		status, found := backendStatus(manager, "c1")
+		return found && status.State == backends.StatePaused && strings.HasPrefix(state(), "Paused")
+	})
+	before, _ := backendStatus(manager, "c1")
+
+	// the balancer forgets the client along with the connection, and the client registers again
+	proxy.cut()
+	var after backends.BackendStatus
+	waitFor(t, 10*time.Second, "client never registered again", func() bool {
+		status, found := backendStatus(manager, "c1")
+		after = status
+		return found && status.Since.After(before.Since)
+	})
+	equals(t, backends.StatePaused, after.State)
+	_, err = pool.Get("10.0.0.2:53686")
+	assert(t, err != nil, "client paused before reconnecting gets new flows")
+	waitFor(t, 5*time.Second, "client never left reconnecting", func() bool {
+		return strings.HasPrefix(state(), "Paused")
+	})
+
+	// the data socket is still read after the reconnect's sanity check went through it
+	conn, err := net.Dial("udp", "127.0.0.3:1337")
+	ok(t, err)
+	defer conn.Close()
+	waitFor(t, 5*time.Second, "client stopped reading its data socket", func() bool {
+		conn.Write([]byte("not sealed"))
+		return !strings.Contains(state(), "dropped packets: 0 unauthenticated")
+	})
+}
@@ -0,0 +1,116 @@
+package test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pwpon500/caplance/internal/balancer/conntrack"
+)
+
+func testKey(srcPort uint16) conntrack.Key {
+	return conntrack.NewKey(6, net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.50"), srcPort, 80)
+}
+
+func TestConnTrackPinsFlow(t *testing.T) {
+	conns := conntrack.New(1024, time.Minute, time.Minute, time.Minute)
+
+	assert(t, conns.Put(testKey(1000), "b1"), "flow not tracked")
+	actual, found := conns.Get(testKey(1000))
+	assert(t, found, "tracked flow not found")
+	equals(t, "b1", actual)
+
+	_, found = conns.Get(testKey(1001))
+	assert(t, !found, "untracked flow found")
+
+	conns.Delete(testKey(1000))
+	_, found = conns.Get(testKey(1000))
+	assert(t, !found, "deleted flow found")
+}
+
+func TestConnTrackTimeouts(t *testing.T) {
+	conns := conntrack.New(1024, time.Minute, time.Minute, 10*time.Millisecond)
+
+	conns.Put(testKey(1000), "b1")
+	conns.Put(testKey(1001), "b1")
+	conns.Closing(testKey(1000))
+	time.Sleep(20 * time.Millisecond)
+
+	_, found := conns.Get(testKey(1000))
+	assert(t, !found, "closed flow outlived its timeout")
+	_, found = conns.Get(testKey(1001))
+	assert(t, found, "open flow expired early")
+
+	conns.Expire()
+	equals(t, 1, conns.Len())
+}
+
+func TestConnTrackBounded(t *testing.T) {
+	conns := conntrack.New(64, time.Minute, time.Minute, time.Minute)
+
+	for port := uint16(0); port < 1000; port++ {
+		conns.Put(testKey(port), "b1")
+	}
+	assert(t, conns.Len() <= 64, "table grew past its bound to %v", conns.Len())
+}
+
+func TestConnTrackCount(t *testing.T) {
+	conns := conntrack.New(1024, time.Minute, time.Minute, 10*time.Millisecond)
+
+	conns.Put(testKey(1000), "web/b1")
+	conns.Put(testKey(1001), "web/b1")
+	conns.Put(testKey(1002), "dns/b1")
+	equals(t, 2, conns.Count("web/b1"))
+	equals(t, 1, conns.Count("dns/b1"))
+	equals(t, 0, conns.Count("b1"))
+
+	// moving, closing and deleting flows keep the counts up to date
+	conns.Put(testKey(1001), "dns/b1")
+	equals(t, 1, conns.Count("web/b1"))
+	equals(t, 2, conns.Count("dns/b1"))
+	conns.Delete(testKey(1000))
+	equals(t, 0, conns.Count("web/b1"))
+	conns.Closing(testKey(1001))
+	time.Sleep(20 * time.Millisecond)
+	conns.Expire()
+	equals(t, 1, conns.Count("dns/b1"))
+
+	conns.Evict("dns/b1")
+	equals(t, 0, conns.Count("dns/b1"))
+	equals(t, 0, conns.Len())
+}
+
+func TestKeyHashSpreadsFlows(t *testing.T) {
+	// every packet of a flow hashes the same, so the flow sticks to one worker
+	first, second := testKey(1000), testKey(1000)
+	equals(t, first.Hash(), second.Hash())
+
+	workers := make(map[uint32]bool)
+	for port := uint16(1000); port < 1100; port++ {
+		k := testKey(port)
+		workers[k.Hash()%20] = true
+	}
+	assert(t, len(workers) > 10, "flows not spread over workers")
+
+	// ipv6 clients that only differ in their prefix, and flows from one address and port to
+	// different destinations, spread as well
+	spread := func(keys func(i int) conntrack.Key) int {
+		workers := make(map[uint32]bool)
+		for i := 0; i < 100; i++ {
+			k := keys(i)
+			workers[k.Hash()%20] = true
+		}
+		return len(workers)
+	}
+	assert(t, spread(func(i int) conntrack.Key {
+		src := net.ParseIP("fd00::2")
+		src[2], src[3] = byte(i>>8), byte(i)
+		return conntrack.NewKey(6, src, net.ParseIP("fd00::50"), 1000, 80)
+	}) > 10, "ipv6 prefixes not spread over workers")
+	assert(t, spread(func(i int) conntrack.Key {
+		return conntrack.NewKey(6, net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.50"), 1000, uint16(8000+i))
+	}) > 10, "destination ports not spread over workers")
+	assert(t, spread(func(i int) conntrack.Key {
+		return conntrack.NewKey(17, net.ParseIP("10.0.0.2"), net.IPv4(10, 0, 1, byte(i)), 1000, 53)
+	}) > 10, "destinations not spread over workers")
+}
@@ -0,0 +1,228 @@
+package test
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pwpon500/caplance/internal/balancer"
+	"github.com/pwpon500/caplance/internal/balancer/backends"
+	"github.com/pwpon500/caplance/internal/balancer/conntrack"
+	"github.com/pwpon500/caplance/pkg/util"
+)
+
+// ipPacket builds a packet from src to dst with a transport header of proto, with room for 200
+// bytes of payload. flags goes in the tcp flags byte
+func ipPacket(proto uint8, src, dst net.IP, srcPort, dstPort uint16, flags byte) []byte {
+	var packet []byte
+	if ip4 := src.To4(); ip4 != nil {
+		packet = make([]byte, 20, 20+20+200)
+		packet[0], packet[8], packet[9] = 0x45, 64, proto
+		copy(packet[12:], ip4)
+		copy(packet[16:], dst.To4())
+	} else {
+		packet = make([]byte, 40, 40+20+200)
+		packet[0], packet[6], packet[7] = 0x60, proto, 64
+		copy(packet[8:], src.To16())
+		copy(packet[24:], dst.To16())
+	}
+
+	l4 := make([]byte, 8)
+	if proto == 6 {
+		l4 = make([]byte, 20)
+		l4[12], l4[13] = 0x50, flags
+	}
+	binary.BigEndian.PutUint16(l4[0:], srcPort)
+	binary.BigEndian.PutUint16(l4[2:], dstPort)
+	packet = append(packet, l4...)
+	return append(packet, benchPacket...)
+}
+
+func TestParseFlow(t *testing.T) {
+	var f balancer.Flow
+	ok(t, balancer.ParseFlow(ipPacket(17, clientIP, vipIP, 1000, 53, 0), &f))
+	equals(t, conntrack.NewKey(17, clientIP, vipIP, 1000, 53), f.Key)
+
+	ok(t, balancer.ParseFlow(ipPacket(6, clientIP, vipIP, 1000, 80, 0x01), &f))
+	equals(t, conntrack.NewKey(6, clientIP, vipIP, 1000, 80), f.Key)
+	assert(t, f.FIN && !f.RST, "fin flag not read")
+	ok(t, balancer.ParseFlow(ipPacket(6, clientIP, vipIP, 1000, 80, 0x04), &f))
+	assert(t, f.RST && !f.FIN, "rst flag not read")
+
+	src, dst := net.ParseIP("fd00::2"), net.ParseIP("fd00::50")
+	ok(t, balancer.ParseFlow(ipPacket(6, src, dst, 1000, 443, 0), &f))
+	equals(t, conntrack.NewKey(6, src, dst, 1000, 443), f.Key)
+}
+
+func TestParseFlowExtensionHeaders(t *testing.T) {
+	src, dst := net.ParseIP("fd00::2"), net.ParseIP("fd00::50")
+	plain := ipPacket(17, src, dst, 1000, 53, 0)
+
+	// a hop-by-hop options header between the ipv6 and udp headers
+	packet := append([]byte{}, plain[:40]...)
+	packet[6] = 0
+	packet = append(packet, 17, 0, 0, 0, 0, 0, 0, 0)
+	packet = append(packet, plain[40:]...)
+	var f balancer.Flow
+	ok(t, balancer.ParseFlow(packet, &f))
+	equals(t, conntrack.NewKey(17, src, dst, 1000, 53), f.Key)
+
+	// a fragment header leaves nothing to hash the later fragments by
+	packet[6] = 44
+	assert(t, balancer.ParseFlow(packet, &f) != nil, "fragment parsed")
+}
+
+func TestParseFlowInvalid(t *testing.T) {
+	var f balancer.Flow
+	packet := ipPacket(17, clientIP, vipIP, 1000, 53, 0)
+	assert(t, balancer.ParseFlow(packet[:24], &f) != nil, "truncated udp header parsed")
+	assert(t, balancer.ParseFlow(ipPacket(1, clientIP, vipIP, 0, 0, 0)[:28], &f) != nil, "icmp parsed")
+
+	// later fragments only carry payload where the ports would be
+	binary.BigEndian.PutUint16(packet[6:], 100)
+	assert(t, balancer.ParseFlow(packet, &f) != nil, "later fragment parsed")
+	// the first one still has them
+	binary.BigEndian.PutUint16(packet[6:], 0x2000)
+	ok(t, balancer.ParseFlow(packet, &f))
+
+	assert(t, balancer.ParseFlow([]byte{0x50, 0, 0, 0}, &f) != nil, "unknown ip version parsed")
+	assert(t, balancer.ParseFlow(nil, &f) != nil, "empty packet parsed")
+}
+
+func TestAppendKey(t *testing.T) {
+	for _, h := range []balancer.HashConfig{
+		{Policy: balancer.HashSrcIPPort},
+		{Policy: balancer.HashSrcIP},
+		{Policy: balancer.HashFiveTuple},
+		{Policy: balancer.HashFiveTuple, Symmetric: true},
+		{Policy: balancer.HashSrcIP, Symmetric: true},
+	} {
+		forward := conntrack.NewKey(6, clientIP, vipIP, 1000, 80)
+		reverse := conntrack.NewKey(6, vipIP, clientIP, 80, 1000)
+		for _, k := range []conntrack.Key{forward, reverse} {
+			var buf [balancer.KeyLen]byte
+			equals(t, h.Key(&k), string(h.AppendKey(buf[:0], &k)))
+		}
+	}
+}
+
+// newBenchHandler makes a handler with a few backends forwarding over udp to a sink that never
+// reads, along with the packet of a flow to it
+func newBenchHandler(tb testing.TB) (*backends.Handler, []byte, func()) {
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	ok(tb, err)
+	back, err := backends.NewHandler(65537)
+	ok(tb, err)
+	encap := backends.Encap{
+		Port:  sink.LocalAddr().(*net.UDPAddr).Port,
+		Batch: util.BatchConfig{Size: 32},
+	}
+	for _, name := range []string{"b1", "b2", "b3"} {
+		ok(tb, back.Add(name, localIP, encap, 1))
+	}
+	return back, ipPacket(6, clientIP, vipIP, 1000, 80, 0), func() { sink.Close() }
+}
+
+// TestFlowAllocs forwards packets of an established flow to a backend authenticating its packets,
+// sent in batches and one at a time, which mustn't allocate
+func TestFlowAllocs(t *testing.T) {
+	for i, batch := range []util.BatchConfig{{Size: 32}, {}} {
+		services := []balancer.ServiceConfig{{
+			Name:     "allocs",
+			VIPs:     []net.IP{vipIP},
+			Capacity: 53,
+			Hashing:  balancer.HashConfig{Policy: balancer.HashFiveTuple, Symmetric: true},
+		}}
+		conf := testConfig(services, localIP)
+		conf.Port = 13396 + i
+		conf.Conns = conntrack.New(100, time.Minute, time.Minute, time.Minute)
+		conf.Batch = batch
+		b, err := balancer.NewTest(conf)
+		ok(t, err)
+		go b.Manager().Listen()
+
+		data, err := net.ListenPacket("udp", "127.0.0.1:0")
+		ok(t, err)
+		defer data.Close()
+		conn, auth := registerSealed(t, conf.Port, "b1", data)
+		defer conn.Close()
+
+		// the flow's first packet pins it and comes out sealed
+		packet := ipPacket(6, clientIP, vipIP, 1000, 80, 0)
+		ok(t, b.Forward(packet))
+		buf := make([]byte, 1500)
+		data.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := data.ReadFrom(buf)
+		ok(t, err)
+		opened, _, err := auth.Open(buf[:n])
+		ok(t, err)
+		equals(t, packet, opened)
+
+		if raceEnabled {
+			continue
+		}
+		allocs := testing.AllocsPerRun(1000, func() {
+			ok(t, b.Forward(packet))
+		})
+		equals(t, 0.0, allocs)
+	}
+}
+
+func BenchmarkParseFlow(b *testing.B) {
+	for _, bench := range []struct {
+		name   string
+		packet []byte
+	}{
+		{"tcp4", ipPacket(6, clientIP, vipIP, 1000, 80, 0)},
+		{"udp4", ipPacket(17, clientIP, vipIP, 1000, 53, 0)},
+		{"tcp6", ipPacket(6, net.ParseIP("fd00::2"), net.ParseIP("fd00::50"), 1000, 80, 0)},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			var f balancer.Flow
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				balancer.ParseFlow(bench.packet, &f)
+			}
+			reportRate(b)
+		})
+	}
+}
+
+// BenchmarkLookup hashes a flow's key into a maglev table and finds its backend
+func BenchmarkLookup(b *testing.B) {
+	back, packet, done := newBenchHandler(b)
+	defer done()
+	var f balancer.Flow
+	ok(b, balancer.ParseFlow(packet, &f))
+	h := balancer.HashConfig{Policy: balancer.HashFiveTuple}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var buf [balancer.KeyLen]byte
+		back.Lookup(h.AppendKey(buf[:0], &f.Key))
+	}
+	reportRate(b)
+}
+
+// BenchmarkForward runs a packet through the whole data path short of the packet source: parsing
+// it, picking its backend and sending it there in a batch
+func BenchmarkForward(b *testing.B) {
+	back, packet, done := newBenchHandler(b)
+	defer done()
+	h := balancer.HashConfig{Policy: balancer.HashSrcIPPort}
+
+	var f balancer.Flow
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		balancer.ParseFlow(packet, &f)
+		var buf [balancer.KeyLen]byte
+		backend, err := back.Lookup(h.AppendKey(buf[:0], &f.Key))
+		if err == nil {
+			backend.Writer.SendData(packet)
+		}
+	}
+	reportRate(b)
+}
@@ -0,0 +1,116 @@
+package test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pwpon500/caplance/internal/balancer/ha"
+)
+
+var haKey = []byte("0123456789abcdef")
+
+func haConfig(peer string, port, priority int, key []byte) ha.Config {
+	return ha.Config{
+		Peer:      net.ParseIP(peer),
+		Port:      port,
+		Priority:  priority,
+		Interval:  20 * time.Millisecond,
+		DeadAfter: 100 * time.Millisecond,
+		Key:       key,
+	}
+}
+
+// startElector runs an elector for local against peer until the returned channel is closed
+func startElector(t *testing.T, local, peer string, priority int) (*ha.Elector, chan struct{}) {
+	elector, err := ha.NewElector(haConfig(peer, 13390, priority, haKey), net.ParseIP(local), func() error { return nil }, func() {}, nil)
+	ok(t, err)
+	done := make(chan struct{})
+	go elector.Run(done)
+	return elector, done
+}
+
+func TestElection(t *testing.T) {
+	high, highDone := startElector(t, "127.0.0.1", "127.0.0.2", 200)
+	low, lowDone := startElector(t, "127.0.0.2", "127.0.0.1", 100)
+	defer close(lowDone)
+
+	time.Sleep(300 * time.Millisecond)
+	assert(t, high.Leader(), "higher priority balancer is not leading")
+	assert(t, !low.Leader(), "both balancers are leading")
+
+	close(highDone)
+	time.Sleep(300 * time.Millisecond)
+	assert(t, low.Leader(), "standby did not take over")
+
+	// no preemption: the leader keeps the vips when the other balancer comes back
+	high, highDone = startElector(t, "127.0.0.1", "127.0.0.2", 200)
+	defer close(highDone)
+	time.Sleep(300 * time.Millisecond)
+	assert(t, low.Leader(), "leader lost the vips to a returning balancer")
+	assert(t, !high.Leader(), "both balancers are leading")
+}
+
+func TestElectionKey(t *testing.T) {
+	_, err := ha.NewElector(haConfig("127.0.0.2", 13393, 100, []byte("short")), localIP, func() error { return nil }, func() {}, nil)
+	assert(t, err != nil, "elector made without a proper key")
+
+	elector, err := ha.NewElector(haConfig("127.0.0.2", 13393, 100, haKey), localIP, func() error { return nil }, func() {}, nil)
+	ok(t, err)
+	done := make(chan struct{})
+	defer close(done)
+	go elector.Run(done)
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 13393})
+	ok(t, err)
+	defer peer.Close()
+	to := &net.UDPAddr{IP: localIP, Port: 13393}
+	heartbeat := func(seq uint64, key []byte) []byte {
+		msg := "HEARTBEAT " + strconv.FormatUint(seq, 10) + " 200 LEADER"
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(msg))
+		return []byte(msg + " " + hex.EncodeToString(mac.Sum(nil)))
+	}
+	// keeps the elector standing by for as long as it takes them
+	beat := func(packet func(i int) []byte) bool {
+		for i := 0; i < 15; i++ {
+			_, err := peer.WriteToUDP(packet(i), to)
+			ok(t, err)
+			time.Sleep(20 * time.Millisecond)
+		}
+		return !elector.Leader()
+	}
+
+	assert(t, beat(func(i int) []byte { return heartbeat(uint64(i+1), haKey) }), "signed heartbeats of a leading peer ignored")
+	assert(t, !beat(func(i int) []byte { return heartbeat(uint64(i+100), []byte("fedcba9876543210")) }), "heartbeats signed with another key taken")
+	replayed := heartbeat(1000, haKey)
+	assert(t, !beat(func(i int) []byte { return replayed }), "replayed heartbeat taken")
+}
+
+func TestElectionUpdates(t *testing.T) {
+	updates := make(chan ha.Update, 10)
+	onUpdate := func(u ha.Update) { updates <- u }
+	leader, err := ha.NewElector(haConfig("127.0.0.2", 13394, 200, haKey), localIP, func() error { return nil }, func() {}, nil)
+	ok(t, err)
+	standby, err := ha.NewElector(haConfig("127.0.0.1", 13394, 100, haKey), net.ParseIP("127.0.0.2"), func() error { return nil }, func() {}, onUpdate)
+	ok(t, err)
+	done := make(chan struct{})
+	defer close(done)
+	go leader.Run(done)
+	go standby.Run(done)
+
+	time.Sleep(300 * time.Millisecond)
+	assert(t, leader.Leader() && !standby.Leader(), "election not settled")
+	sent := ha.Update{Backend: "test/b1", State: "paused", StatusDown: true}
+	ok(t, leader.Send(sent))
+	select {
+	case u := <-updates:
+		equals(t, sent, u)
+	case <-time.After(time.Second):
+		t.Fatal("standby never got the update")
+	}
+}
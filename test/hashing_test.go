@@ -0,0 +1,51 @@
+package test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pwpon500/caplance/internal/balancer"
+	"github.com/pwpon500/caplance/internal/balancer/conntrack"
+)
+
+var (
+	clientIP = net.ParseIP("10.0.0.2")
+	vipIP    = net.ParseIP("10.0.0.50")
+)
+
+func TestFiveTupleHash(t *testing.T) {
+	h := balancer.HashConfig{Policy: balancer.HashFiveTuple}
+	tcp := conntrack.NewKey(6, clientIP, vipIP, 1000, 53)
+	udp := conntrack.NewKey(17, clientIP, vipIP, 1000, 53)
+	assert(t, h.Key(&tcp) != h.Key(&udp), "tcp and udp flows hashed the same")
+
+	other := conntrack.NewKey(6, clientIP, vipIP, 1000, 80)
+	assert(t, h.Key(&tcp) != h.Key(&other), "flows to different ports hashed the same")
+}
+
+func TestSrcIPPortHash(t *testing.T) {
+	h := balancer.HashConfig{Policy: balancer.HashSrcIPPort}
+	tcp := conntrack.NewKey(6, clientIP, vipIP, 1000, 53)
+	udp := conntrack.NewKey(17, clientIP, vipIP, 1000, 80)
+	equals(t, h.Key(&tcp), h.Key(&udp))
+
+	other := conntrack.NewKey(6, clientIP, vipIP, 1001, 53)
+	assert(t, h.Key(&tcp) != h.Key(&other), "flows from different ports hashed the same")
+}
+
+func TestSrcIPHash(t *testing.T) {
+	h := balancer.HashConfig{Policy: balancer.HashSrcIP}
+	first := conntrack.NewKey(6, clientIP, vipIP, 1000, 80)
+	second := conntrack.NewKey(6, clientIP, vipIP, 2000, 443)
+	equals(t, h.Key(&first), h.Key(&second))
+}
+
+func TestSymmetricHash(t *testing.T) {
+	h := balancer.HashConfig{Policy: balancer.HashFiveTuple, Symmetric: true}
+	forward := conntrack.NewKey(6, clientIP, vipIP, 1000, 80)
+	reverse := conntrack.NewKey(6, vipIP, clientIP, 80, 1000)
+	equals(t, h.Key(&forward), h.Key(&reverse))
+
+	h.Symmetric = false
+	assert(t, h.Key(&forward) != h.Key(&reverse), "asymmetric hash matched the reverse flow")
+}
@@ -0,0 +1,310 @@
+package test
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pwpon500/caplance/internal/balancer/backends"
+	"github.com/pwpon500/caplance/internal/balancer/conntrack"
+	"github.com/pwpon500/caplance/pkg/util"
+)
+
+// dialManager connects to the manager listening on port, over tls if tlsConf is not nil
+func dialManager(t *testing.T, port int, tlsConf *tls.Config) util.Communicator {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if tlsConf != nil {
+			conn, err = tls.Dial("tcp", addr, tlsConf)
+		} else {
+			conn, err = net.Dial("tcp", addr)
+		}
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ok(t, err)
+	return util.NewTCPCommunicator(conn, 5, 5)
+}
+
+// registerBackend registers a backend named name with the manager listening on port, answering
+// the sanity check over udp. Returns the communicator for the registered backend
+func registerBackend(t *testing.T, port int, name string) util.Communicator {
+	return registerWith(t, dialManager(t, port, nil), name)
+}
+
+// registerWith registers a backend named name over comm
+func registerWith(t *testing.T, comm util.Communicator, name string) util.Communicator {
+	return registerAt(t, comm, name, localIP)
+}
+
+// registerAt registers a backend named name taking its packets on dataIP over comm
+func registerAt(t *testing.T, comm util.Communicator, name string, dataIP net.IP) util.Communicator {
+	data, err := net.ListenPacket("udp", net.JoinHostPort(dataIP.String(), "0"))
+	ok(t, err)
+	defer data.Close()
+	return registerOn(t, comm, name, data)
+}
+
+// registerOn registers a backend named name taking its packets on the udp socket data over comm
+func registerOn(t *testing.T, comm util.Communicator, name string, data net.PacketConn) util.Communicator {
+	dataIP := data.LocalAddr().(*net.UDPAddr).IP
+	dataPort := data.LocalAddr().(*net.UDPAddr).Port
+	ok(t, comm.WriteLine("REGISTER "+name+" "+dataIP.String()+" port="+strconv.Itoa(dataPort)))
+
+	buf := make([]byte, 100)
+	data.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := data.ReadFrom(buf)
+	ok(t, err)
+	sanity := strings.Split(string(buf[:n]), " ")
+	equals(t, "SANITY", sanity[0])
+	ok(t, comm.WriteLine("SANE "+sanity[1]))
+
+	line, err := comm.ReadLine()
+	ok(t, err)
+	assert(t, strings.HasPrefix(line, "REGISTERED "+name), "registration failed: "+line)
+	return comm
+}
+
+func sendHealth(t *testing.T, comm util.Communicator, code string) string {
+	ok(t, comm.WriteLine("HEALTH "+code))
+	line, err := comm.ReadLine()
+	ok(t, err)
+	return line
+}
+
+func TestHealthStatus(t *testing.T) {
+	pool, err := backends.NewPool("test", []net.IP{net.ParseIP("10.0.0.50")}, 53, nil, nil, backends.StatusPolicy{Rise: 2, Fall: 2})
+	ok(t, err)
+	// a live flow keeps the backend draining instead of being paused right away
+	conns := conntrack.New(100, time.Minute, time.Minute, time.Minute)
+	flow := conntrack.NewKey(6, net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.50"), 53686, 80)
+	conns.Put(flow, "test/b1")
+	manager := backends.NewManager(localIP, 13381, 5, 5, time.Minute, conns, nil, util.BatchConfig{})
+	ok(t, manager.AddPool(pool))
+	go manager.Listen()
+
+	comm := registerBackend(t, 13381, "b1")
+	defer comm.Close()
+
+	equals(t, "HEALTHACK 200 active", sendHealth(t, comm, "200"))
+	equals(t, "HEALTHACK 200 active", sendHealth(t, comm, "503"))
+	equals(t, "HEALTHACK 503 draining", sendHealth(t, comm, "503"))
+	assert(t, pool.GetByName("b1") != nil, "draining backend not reachable by name")
+	_, err = pool.Get("10.0.0.2:53686")
+	assert(t, err != nil, "draining backend still gets new flows")
+
+	equals(t, "HEALTHACK 503 paused", sendHealth(t, comm, "500"))
+	// the flows of an unhealthy backend go elsewhere
+	_, pinned := conns.Get(flow)
+	assert(t, !pinned, "flow still pinned to unhealthy backend")
+
+	equals(t, "HEALTHACK 503 paused", sendHealth(t, comm, "200"))
+	equals(t, "HEALTHACK 200 active", sendHealth(t, comm, "200"))
+	back, err := pool.Get("10.0.0.2:53686")
+	ok(t, err)
+	equals(t, "b1", back.Name())
+}
+
+func TestHealthStatusLeavesDrained(t *testing.T) {
+	pool, err := backends.NewPool("test", []net.IP{net.ParseIP("10.0.0.50")}, 53, nil, nil, backends.StatusPolicy{Rise: 1, Fall: 1})
+	ok(t, err)
+	conns := conntrack.New(100, time.Minute, time.Minute, time.Minute)
+	conns.Put(conntrack.NewKey(6, net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.50"), 53686, 80), "test/b1")
+	manager := backends.NewManager(localIP, 13389, 5, 5, time.Minute, conns, nil, util.BatchConfig{})
+	ok(t, manager.AddPool(pool))
+	go manager.Listen()
+
+	comm := registerBackend(t, 13389, "b1")
+	defer comm.Close()
+
+	// client errors say nothing about the backend itself
+	equals(t, "HEALTHACK 200 active", sendHealth(t, comm, "404"))
+
+	ok(t, comm.WriteLine("DRAIN"))
+	line, err := comm.ReadLine()
+	ok(t, err)
+	equals(t, "DRAINING b1", line)
+
+	// a drain by request is neither turned into a pause nor undone by the backend's reports
+	equals(t, "HEALTHACK 503 draining", sendHealth(t, comm, "500"))
+	equals(t, "HEALTHACK 503 draining", sendHealth(t, comm, "200"))
+	_, err = pool.Get("10.0.0.2:53686")
+	assert(t, err != nil, "drained backend put back by healthy reports")
+}
+
+func TestDrain(t *testing.T) {
+	pool, err := backends.NewPool("test", []net.IP{net.ParseIP("10.0.0.50")}, 53, nil, nil, backends.StatusPolicy{Rise: 1, Fall: 1})
+	ok(t, err)
+	conns := conntrack.New(100, time.Minute, time.Minute, time.Minute)
+	flow := conntrack.NewKey(6, net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.50"), 53686, 80)
+	conns.Put(flow, "test/b1")
+	// a backend of the same name in another pool doesn't hold up the drain
+	conns.Put(conntrack.NewKey(6, net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.60"), 53686, 80), "other/b1")
+	manager := backends.NewManager(localIP, 13382, 5, 5, time.Minute, conns, nil, util.BatchConfig{})
+	ok(t, manager.AddPool(pool))
+	go manager.Listen()
+
+	comm := registerBackend(t, 13382, "b1")
+	defer comm.Close()
+
+	ok(t, comm.WriteLine("DRAIN"))
+	line, err := comm.ReadLine()
+	ok(t, err)
+	equals(t, "DRAINING b1", line)
+	_, err = pool.Get("10.0.0.2:53686")
+	assert(t, err != nil, "draining backend still gets new flows")
+	assert(t, pool.GetByName("b1") != nil, "draining backend not reachable by name")
+
+	// once its last flow is gone the backend gets paused on its own
+	conns.Delete(flow)
+	line, err = comm.ReadLine()
+	ok(t, err)
+	equals(t, "PAUSED b1", line)
+	_, err = pool.Get("10.0.0.2:53686")
+	assert(t, err != nil, "drained backend gets new flows")
+}
+
+func TestDrainWithoutConnTrack(t *testing.T) {
+	pool, err := backends.NewPool("test", []net.IP{net.ParseIP("10.0.0.50")}, 53, nil, nil, backends.StatusPolicy{Rise: 1, Fall: 1})
+	ok(t, err)
+	manager := backends.NewManager(localIP, 13399, 5, 5, time.Minute, nil, nil, util.BatchConfig{})
+	ok(t, manager.AddPool(pool))
+	go manager.Listen()
+
+	comm := registerBackend(t, 13399, "b1")
+	defer comm.Close()
+
+	// nothing would keep the established flows with the backend, so it isn't drained
+	ok(t, comm.WriteLine("DRAIN"))
+	line, err := comm.ReadLine()
+	ok(t, err)
+	assert(t, strings.HasPrefix(line, "INVALID"), "drained without connection tracking: "+line)
+	assert(t, manager.DrainBackend("test/b1") != nil, "drained from the balancer side without connection tracking")
+	back, err := pool.Get("10.0.0.2:53686")
+	ok(t, err)
+	equals(t, "b1", back.Name())
+
+	// and an overloaded one is paused instead
+	equals(t, "HEALTHACK 503 paused", sendHealth(t, comm, "503"))
+}
+
+func TestIPv6Backend(t *testing.T) {
+	// a dual-stack pool takes backends of either family
+	vips := []net.IP{net.ParseIP("10.0.0.50"), net.ParseIP("fd00::50")}
+	pool, err := backends.NewPool("test", vips, 53, nil, nil, backends.StatusPolicy{Rise: 1, Fall: 1})
+	ok(t, err)
+	manager := backends.NewManager(localIP, 13387, 5, 5, time.Minute, nil, nil, util.BatchConfig{})
+	ok(t, manager.AddPool(pool))
+	go manager.Listen()
+
+	comm := registerAt(t, dialManager(t, 13387, nil), "b6", net.ParseIP("::1"))
+	defer comm.Close()
+	back, err := pool.Get("fd00::2")
+	ok(t, err)
+	equals(t, "b6", back.Name())
+	assert(t, back.IP().Equal(net.ParseIP("::1")), "backend registered with the wrong data ip")
+}
+
+func TestHealthCheckRiseFall(t *testing.T) {
+	// served counts the probes answered with each status
+	var mux sync.Mutex
+	status, served := http.StatusOK, make(map[int]int)
+	setStatus := func(code int) {
+		mux.Lock()
+		status, served = code, make(map[int]int)
+		mux.Unlock()
+	}
+	probes := func(code int) int {
+		mux.Lock()
+		defer mux.Unlock()
+		return served[code]
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		code := status
+		served[code]++
+		mux.Unlock()
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+	check := &backends.HealthCheck{Type: backends.CheckHTTP, Port: port, Interval: 100 * time.Millisecond, Timeout: time.Second, Rise: 2, Fall: 3}
+	pool, err := backends.NewPool("test", []net.IP{net.ParseIP("10.0.0.50")}, 53, nil, check, backends.StatusPolicy{Rise: 1, Fall: 1})
+	ok(t, err)
+	manager := backends.NewManager(localIP, 13391, 5, 5, time.Minute, nil, nil, util.BatchConfig{})
+	ok(t, manager.AddPool(pool))
+	go manager.Listen()
+
+	comm := registerBackend(t, 13391, "b1")
+	defer comm.Close()
+	_, err = pool.Get("10.0.0.2:53686")
+	ok(t, err)
+
+	// the backend is taken out on its third failure in a row
+	setStatus(http.StatusInternalServerError)
+	line, err := comm.ReadLine()
+	ok(t, err)
+	equals(t, "PAUSED b1", line)
+	equals(t, 3, probes(http.StatusInternalServerError))
+	_, err = pool.Get("10.0.0.2:53686")
+	assert(t, err != nil, "backend failing its health check still gets new flows")
+
+	// and put back on its second pass in a row
+	setStatus(http.StatusOK)
+	line, err = comm.ReadLine()
+	ok(t, err)
+	equals(t, "RESUMED b1", line)
+	equals(t, 2, probes(http.StatusOK))
+	back, err := pool.Get("10.0.0.2:53686")
+	ok(t, err)
+	equals(t, "b1", back.Name())
+}
+
+func TestReplicate(t *testing.T) {
+	pool, err := backends.NewPool("test", []net.IP{net.ParseIP("10.0.0.50")}, 53, nil, nil, backends.StatusPolicy{Rise: 1, Fall: 1})
+	ok(t, err)
+	conns := conntrack.New(100, time.Minute, time.Minute, time.Minute)
+	flow := conntrack.NewKey(6, net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.50"), 53686, 80)
+	conns.Put(flow, "test/b1")
+	manager := backends.NewManager(localIP, 13395, 5, 5, time.Minute, conns, nil, util.BatchConfig{})
+	ok(t, manager.AddPool(pool))
+	go manager.Listen()
+
+	comm := registerBackend(t, 13395, "b1")
+	defer comm.Close()
+	assert(t, manager.Replicate("test/b2", backends.StatePaused, false, false) != nil, "unregistered backend replicated")
+
+	// taken out by the leader for failing its health, flows and all
+	ok(t, manager.Replicate("test/b1", backends.StatePaused, false, true))
+	status, _ := backendStatus(manager, "b1")
+	equals(t, backends.StatePaused, status.State)
+	assert(t, status.StatusDown, "health verdict not replicated")
+	_, err = pool.Get("10.0.0.2:53686")
+	assert(t, err != nil, "backend paused by the leader still gets new flows")
+	_, pinned := conns.Get(flow)
+	assert(t, !pinned, "flow still pinned to unhealthy backend")
+
+	// and the standby's own reports are judged against it, so it comes back on them
+	equals(t, "HEALTHACK 200 active", sendHealth(t, comm, "200"))
+
+	// a live flow keeps the drain going
+	conns.Put(flow, "test/b1")
+	ok(t, manager.Replicate("test/b1", backends.StateDraining, false, false))
+	status, _ = backendStatus(manager, "b1")
+	equals(t, backends.StateDraining, status.State)
+	ok(t, manager.Replicate("test/b1", backends.StateActive, false, false))
+	back, err := pool.Get("10.0.0.2:53686")
+	ok(t, err)
+	equals(t, "b1", back.Name())
+}
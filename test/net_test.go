@@ -0,0 +1,57 @@
+package test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pwpon500/caplance/pkg/util"
+)
+
+func TestParseIPs(t *testing.T) {
+	ips, err := util.ParseIPs([]string{"10.0.0.50", "fd00::50"})
+	ok(t, err)
+	equals(t, 2, len(ips))
+	assert(t, ips[0].To4() != nil && ips[1].To4() == nil, "families not kept apart")
+
+	_, err = util.ParseIPs([]string{"10.0.0.50", "10.0.0"})
+	assert(t, err != nil, "no error thrown for unparsable ip")
+	_, err = util.ParseIPs(nil)
+	assert(t, err != nil, "no error thrown for empty list")
+}
+
+func TestHasIPv4(t *testing.T) {
+	assert(t, util.HasIPv4([]net.IP{net.ParseIP("fd00::50"), net.ParseIP("10.0.0.50")}), "ipv4 address not found")
+	assert(t, !util.HasIPv4([]net.IP{net.ParseIP("fd00::50")}), "ipv4 address found in ipv6 list")
+	assert(t, !util.HasIPv4(nil), "ipv4 address found in empty list")
+}
+
+func TestHostNet(t *testing.T) {
+	equals(t, "10.0.0.50/32", util.HostNet(net.ParseIP("10.0.0.50")).String())
+	equals(t, "fd00::50/128", util.HostNet(net.ParseIP("fd00::50")).String())
+}
+
+func TestHideLoopbackAddrs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing arp settings needs root")
+	}
+	read := func(name string) string {
+		value, err := ioutil.ReadFile("/proc/sys/net/ipv4/conf/all/" + name)
+		ok(t, err)
+		return strings.TrimSpace(string(value))
+	}
+	ignore, announce := read("arp_ignore"), read("arp_announce")
+
+	show, err := util.HideLoopbackAddrs()
+	if err != nil {
+		t.Skip("arp settings not writable: " + err.Error())
+	}
+	hidden := [2]string{read("arp_ignore"), read("arp_announce")}
+	show()
+	assert(t, ignore != "0" || hidden[0] == "1", "host still answers arp for addresses on loopback")
+	assert(t, announce == "2" || hidden[1] == "2", "host still announces addresses on loopback")
+	equals(t, ignore, read("arp_ignore"))
+	equals(t, announce, read("arp_announce"))
+}
@@ -0,0 +1,60 @@
+package test
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pwpon500/caplance/internal/client"
+)
+
+func TestProbeTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	ok(t, err)
+	defer listener.Close()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	probe := &client.Probe{Type: client.ProbeTCP, Target: port, Timeout: time.Second}
+
+	code, _ := probe.Run([]net.IP{localIP})
+	equals(t, http.StatusOK, code)
+
+	// every vip has to take connections, not just the first
+	code, _ = probe.Run([]net.IP{localIP, net.ParseIP("127.0.0.2")})
+	equals(t, http.StatusServiceUnavailable, code)
+}
+
+func TestProbeStreak(t *testing.T) {
+	streak := &client.ProbeStreak{Rise: 2, Fall: 3}
+
+	// an active client pauses itself on its third failure in a row
+	for i := 0; i < 2; i++ {
+		pause, resume := streak.Record(http.StatusServiceUnavailable, client.Active)
+		assert(t, !pause && !resume, "client paused before its probes failed enough")
+	}
+	pause, resume := streak.Record(http.StatusOK, client.Active)
+	assert(t, !pause && !resume, "passing probe changed an active client")
+	for i := 0; i < 2; i++ {
+		pause, _ = streak.Record(http.StatusServiceUnavailable, client.Active)
+		assert(t, !pause, "failures not counted in a row")
+	}
+	pause, resume = streak.Record(http.StatusServiceUnavailable, client.Active)
+	assert(t, pause && !resume, "client not paused by failing probes")
+
+	// and resumes on its second pass in a row once the balancer has it paused
+	pause, resume = streak.Record(http.StatusOK, client.Paused)
+	assert(t, !pause && !resume, "client resumed before its probes passed enough")
+	pause, resume = streak.Record(http.StatusOK, client.Paused)
+	assert(t, !pause && resume, "client not resumed by passing probes")
+
+	// a pause by request isn't undone by passing probes
+	for i := 0; i < 3; i++ {
+		streak.Record(http.StatusServiceUnavailable, client.Active)
+	}
+	streak.Forget()
+	for i := 0; i < 3; i++ {
+		_, resume = streak.Record(http.StatusOK, client.Paused)
+		assert(t, !resume, "client paused by request resumed by its probes")
+	}
+}
@@ -0,0 +1,98 @@
+package test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pwpon500/caplance/internal/balancer/backends"
+	"github.com/pwpon500/caplance/pkg/protocol"
+	"github.com/pwpon500/caplance/pkg/util"
+)
+
+func TestFramedProtocol(t *testing.T) {
+	pool, err := backends.NewPool("test", []net.IP{net.ParseIP("10.0.0.50")}, 53, nil, nil, backends.StatusPolicy{Rise: 1, Fall: 1})
+	ok(t, err)
+	manager := backends.NewManager(localIP, 13385, 5, 5, time.Minute, nil, nil, util.BatchConfig{})
+	ok(t, manager.AddPool(pool))
+	go manager.Listen()
+
+	data, err := net.ListenPacket("udp", "127.0.0.1:0")
+	ok(t, err)
+	defer data.Close()
+
+	conn, hello, err := protocol.Connect(dialManager(t, 13385, nil), protocol.V2, protocol.Capabilities)
+	ok(t, err)
+	defer conn.Close()
+	equals(t, protocol.V2, hello.Version)
+	equals(t, protocol.Capabilities, hello.Capabilities)
+
+	register := &protocol.Message{
+		Type:   protocol.Register,
+		Name:   "b1",
+		DataIP: "127.0.0.1",
+		Port:   data.LocalAddr().(*net.UDPAddr).Port,
+		Weight: 3,
+		Labels: map[string]string{"zone": "a"},
+	}
+	ok(t, conn.Request(register))
+	buf := make([]byte, 100)
+	data.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := data.ReadFrom(buf)
+	ok(t, err)
+	sanity := strings.Split(string(buf[:n]), " ")
+	ok(t, conn.Request(&protocol.Message{Type: protocol.Sane, Nonce: sanity[1]}))
+	reply, err := conn.ReadMessage()
+	ok(t, err)
+	equals(t, protocol.Registered, reply.Type)
+	equals(t, register.ID, reply.ID)
+
+	// replies carry the id of the request they answer
+	health := &protocol.Message{Type: protocol.Health, Code: 500, Detail: "http down"}
+	ok(t, conn.Request(health))
+	reply, err = conn.ReadMessage()
+	ok(t, err)
+	equals(t, protocol.HealthAck, reply.Type)
+	equals(t, health.ID, reply.ID)
+	equals(t, "paused", reply.State)
+
+	weight := &protocol.Message{Type: protocol.Weight, Weight: -1}
+	ok(t, conn.Request(weight))
+	reply, err = conn.ReadMessage()
+	ok(t, err)
+	equals(t, protocol.Invalid, reply.Type)
+	equals(t, weight.ID, reply.ID)
+
+	statuses := manager.Statuses()
+	equals(t, 1, len(statuses))
+	equals(t, protocol.V2, statuses[0].Protocol)
+	equals(t, "a", statuses[0].Labels["zone"])
+	equals(t, "http down", statuses[0].HealthNote)
+}
+
+func TestTextMessages(t *testing.T) {
+	left, right := net.Pipe()
+	sender, _, err := protocol.Connect(util.NewTCPCommunicator(left, 5, 5), protocol.V1, nil)
+	ok(t, err)
+	defer sender.Close()
+	receiver := util.NewTCPCommunicator(right, 5, 5)
+	defer receiver.Close()
+
+	go sender.Request(&protocol.Message{Type: protocol.Register, Name: "b1", DataIP: "10.0.0.2", Weight: 2, State: "paused", KeyID: 7, Key: "ab"})
+	line, err := receiver.ReadLine()
+	ok(t, err)
+	equals(t, "REGISTER b1 10.0.0.2 weight=2 state=paused keyid=7 key=ab", strings.TrimSpace(line))
+
+	go receiver.WriteLine("HEALTHACK 503 paused")
+	reply, err := sender.ReadMessage()
+	ok(t, err)
+	equals(t, protocol.HealthAck, reply.Type)
+	equals(t, 503, reply.Code)
+	equals(t, "paused", reply.State)
+
+	go receiver.WriteLine("WEIGHT many")
+	_, err = sender.ReadMessage()
+	_, malformed := err.(*protocol.MalformedError)
+	assert(t, malformed, "unparseable weight accepted")
+}
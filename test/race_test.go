@@ -0,0 +1,8 @@
+//go:build race
+// +build race
+
+package test
+
+// raceEnabled is whether the tests run under the race detector, which allocates on its own and
+// makes sync.Pool drop what it is given now and then
+const raceEnabled = true
@@ -0,0 +1,53 @@
+package test
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pwpon500/caplance/internal/balancer/source"
+)
+
+func TestRingSource(t *testing.T) {
+	vip := net.ParseIP("127.0.0.3").To4()
+	ring, err := source.NewRing([]string{"lo"}, 2, os.Getpagesize()*16, 4, []net.IP{vip})
+	if os.IsPermission(err) {
+		t.Skip("opening AF_PACKET sockets needs CAP_NET_RAW")
+	}
+	ok(t, err)
+	defer ring.Close()
+
+	// the ring only gets packets to the vip
+	for _, dst := range []string{"127.0.0.1:9", "127.0.0.3:9"} {
+		conn, err := net.Dial("udp", dst)
+		ok(t, err)
+		_, err = conn.Write([]byte("ring test"))
+		ok(t, err)
+		conn.Close()
+	}
+
+	// the packet may come in on any of the ring's sockets
+	packets := make(chan []byte, 1)
+	for _, queue := range ring.Queues() {
+		go func(queue <-chan []byte) {
+			packets <- <-queue
+		}(queue)
+	}
+	select {
+	case packet := <-packets:
+		equals(t, byte(4), packet[0]>>4)
+		equals(t, []byte(vip), packet[16:20])
+		assert(t, bytes.HasSuffix(packet, []byte("ring test")), "payload missing from packet")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no packet read from the ring")
+	}
+}
+
+func TestQueueCount(t *testing.T) {
+	_, err := source.Open(source.Config{Type: source.NFQueue, Queues: -1}, nil)
+	assert(t, err != nil, "no error thrown for negative queue count")
+	_, err = source.Open(source.Config{Type: source.NFQueue, Queues: 70000}, nil)
+	assert(t, err != nil, "no error thrown for queue count past the last nfqueue")
+}
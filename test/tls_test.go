@@ -0,0 +1,92 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pwpon500/caplance/internal/balancer/backends"
+	"github.com/pwpon500/caplance/pkg/util"
+)
+
+// writeCert issues a certificate for name, signed by parent or self signed if parent is nil, and
+// writes it and its key to dir as name.pem and name.key
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ok(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{localIP},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	ok(t, err)
+	cert, err := x509.ParseCertificate(raw)
+	ok(t, err)
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	ok(t, err)
+
+	ok(t, ioutil.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw}), 0600))
+	ok(t, ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey}), 0600))
+	return cert, key
+}
+
+func TestTLSRegistration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caplance-tls")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "balancer", ca, caKey)
+	writeCert(t, dir, "b1", ca, caKey)
+	path := func(file string) string { return filepath.Join(dir, file) }
+
+	serverConf, err := util.ServerTLSConfig(path("balancer.pem"), path("balancer.key"), path("ca.pem"))
+	ok(t, err)
+	pool, err := backends.NewPool("test", []net.IP{net.ParseIP("10.0.0.50")}, 53, nil, nil, backends.StatusPolicy{Rise: 1, Fall: 1})
+	ok(t, err)
+	manager := backends.NewManager(localIP, 13383, 5, 5, time.Minute, nil, serverConf, util.BatchConfig{})
+	ok(t, manager.AddPool(pool))
+	go manager.Listen()
+
+	certConf, err := util.ClientTLSConfig(path("ca.pem"), path("b1.pem"), path("b1.key"), "")
+	ok(t, err)
+	comm := registerWith(t, dialManager(t, 13383, certConf), "b1")
+	comm.Close()
+
+	// a certificate only registers the name it was issued to
+	comm = dialManager(t, 13383, certConf)
+	defer comm.Close()
+	ok(t, comm.WriteLine("REGISTER b2 127.0.0.1"))
+	line, err := comm.ReadLine()
+	ok(t, err)
+	assert(t, strings.HasPrefix(line, "INVALID"), "registered under a name the certificate was not issued to: "+line)
+
+	// and backends without one can't register at all, or they could take any name
+	anonConf, err := util.ClientTLSConfig(path("ca.pem"), "", "", "")
+	ok(t, err)
+	comm = dialManager(t, 13383, anonConf)
+	defer comm.Close()
+	comm.WriteLine("REGISTER b1 127.0.0.1")
+	_, err = comm.ReadLine()
+	assert(t, err != nil, "registered without a client certificate")
+}
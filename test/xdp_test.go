@@ -0,0 +1,190 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pwpon500/caplance/internal/balancer"
+	"github.com/pwpon500/caplance/internal/balancer/backends"
+	"github.com/pwpon500/caplance/internal/balancer/conntrack"
+	"github.com/pwpon500/caplance/internal/balancer/xdp"
+	"github.com/pwpon500/caplance/pkg/protocol"
+	"github.com/pwpon500/caplance/pkg/util"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// wire is an AF_PACKET socket on one end of a veth pair
+type wire struct {
+	fd   int
+	link netlink.Link
+}
+
+func openWire(t *testing.T, link netlink.Link) *wire {
+	proto := int(uint16(unix.ETH_P_ALL)<<8 | uint16(unix.ETH_P_ALL)>>8)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, proto)
+	ok(t, err)
+	ok(t, unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: uint16(proto), Ifindex: link.Attrs().Index}))
+	tv := unix.NsecToTimeval(int64(100 * time.Millisecond))
+	ok(t, unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv))
+	return &wire{fd, link}
+}
+
+func (w *wire) send(t *testing.T, frame []byte) {
+	ok(t, unix.Sendto(w.fd, frame, 0, &unix.SockaddrLinklayer{Ifindex: w.link.Attrs().Index, Halen: 6}))
+}
+
+// next returns the payload of the next ipv4 udp frame coming in that match accepts
+func (w *wire) next(t *testing.T, match func(ip []byte) bool) []byte {
+	buf := make([]byte, 2048)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		n, from, err := unix.Recvfrom(w.fd, buf, 0)
+		if err != nil {
+			continue
+		}
+		if from.(*unix.SockaddrLinklayer).Pkttype == unix.PACKET_OUTGOING || n < 42 || buf[12] != 0x08 || buf[13] != 0 {
+			continue
+		}
+		if ip := buf[14:n]; ip[9] == 17 && match(ip) {
+			return append([]byte(nil), ip...)
+		}
+	}
+	t.Fatal("no matching frame on " + w.link.Attrs().Name)
+	return nil
+}
+
+// registerThrough registers a backend at ip, answering the sanity check it gets over the wire
+func registerThrough(t *testing.T, w *wire, name, ip string, port int) *protocol.Conn {
+	conn, _, err := protocol.Connect(dialManager(t, 13386, nil), protocol.V2, protocol.Capabilities)
+	ok(t, err)
+	register := &protocol.Message{Type: protocol.Register, Name: name, DataIP: ip, Port: port}
+	ok(t, conn.Request(register))
+	sanity := w.next(t, func(packet []byte) bool {
+		return net.IP(packet[16:20]).Equal(net.ParseIP(ip)) && bytes.HasPrefix(packet[28:], []byte("SANITY "))
+	})
+	nonce := strings.Split(string(sanity[28:]), " ")[1]
+	ok(t, conn.Request(&protocol.Message{Type: protocol.Sane, Nonce: nonce}))
+	reply, err := conn.ReadMessage()
+	ok(t, err)
+	equals(t, protocol.Registered, reply.Type)
+	return conn
+}
+
+func TestXDPForwarding(t *testing.T) {
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "cpxdp0"}, PeerName: "cpxdp1"}
+	err := netlink.LinkAdd(veth)
+	if os.IsPermission(err) {
+		t.Skip("creating veth devices needs CAP_NET_ADMIN")
+	}
+	ok(t, err)
+	defer netlink.LinkDel(veth)
+
+	// the balancer side is cpxdp0, with the backends and clients behind cpxdp1
+	lb, err := netlink.LinkByName("cpxdp0")
+	ok(t, err)
+	peer, err := netlink.LinkByName("cpxdp1")
+	ok(t, err)
+	ok(t, netlink.LinkSetUp(lb))
+	ok(t, netlink.LinkSetUp(peer))
+	addr, err := netlink.ParseAddr("10.99.0.1/24")
+	ok(t, err)
+	ok(t, netlink.AddrAdd(lb, addr))
+	ok(t, ioutil.WriteFile("/proc/sys/net/ipv4/conf/cpxdp0/forwarding", []byte("1"), 0644))
+	backIPs := []string{"10.99.0.2", "10.99.0.3"}
+	for _, ip := range backIPs {
+		ok(t, netlink.NeighAdd(&netlink.Neigh{
+			LinkIndex:    lb.Attrs().Index,
+			State:        netlink.NUD_PERMANENT,
+			IP:           net.ParseIP(ip),
+			HardwareAddr: peer.Attrs().HardwareAddr,
+		}))
+	}
+
+	vip := net.ParseIP("10.99.1.1")
+	pool, err := backends.NewPool("xdp", []net.IP{vip}, 53, nil, nil, backends.StatusPolicy{Rise: 1, Fall: 1})
+	ok(t, err)
+	dp, err := xdp.New([]*backends.Pool{pool}, true)
+	if os.IsPermission(err) {
+		t.Skip("loading xdp programs needs CAP_BPF")
+	}
+	ok(t, err)
+	defer dp.Close()
+	ok(t, dp.SetVIP(vip, []xdp.Range{{Proto: 17, From: 80, To: 80, Policy: xdp.PolicySrcIPPort, Pool: pool}}))
+	pool.OnChange(func() {
+		if err := dp.Sync(pool); err != nil {
+			t.Error(err)
+		}
+	})
+	ok(t, dp.Attach([]netlink.Link{lb}))
+
+	manager := backends.NewManager(localIP, 13386, 5, 5, time.Minute, nil, nil, util.BatchConfig{})
+	ok(t, manager.AddPool(pool))
+	go manager.Listen()
+	w := openWire(t, peer)
+	defer unix.Close(w.fd)
+	for i, ip := range backIPs {
+		conn := registerThrough(t, w, "x"+ip, ip, 6080+i)
+		defer conn.Close()
+	}
+
+	// every flow comes out encapsulated to the backend userspace would have picked
+	client := net.ParseIP("10.98.0.5").To4()
+	send := func(sport uint16) []byte {
+		frame := make([]byte, 14+28+4)
+		copy(frame[0:], lb.Attrs().HardwareAddr)
+		copy(frame[6:], peer.Attrs().HardwareAddr)
+		frame[12] = 0x08
+		ip := frame[14:]
+		ip[0], ip[8], ip[9] = 0x45, 64, 17
+		binary.BigEndian.PutUint16(ip[2:], 32)
+		copy(ip[12:], client)
+		copy(ip[16:], vip.To4())
+		binary.BigEndian.PutUint16(ip[20:], sport)
+		binary.BigEndian.PutUint16(ip[22:], 80)
+		binary.BigEndian.PutUint16(ip[24:], 12)
+		copy(ip[28:], "xdp!")
+		w.send(t, frame)
+		return append([]byte(nil), ip...)
+	}
+	check := func(sport uint16) string {
+		inner := send(sport)
+		outer := w.next(t, func(packet []byte) bool { return bytes.HasSuffix(packet, inner) })
+		key := conntrack.NewKey(17, client, vip, sport, 80)
+		back, err := pool.Get(balancer.HashConfig{}.Key(&key))
+		ok(t, err)
+		equals(t, back.IP().String(), net.IP(outer[16:20]).String())
+		equals(t, "10.99.0.1", net.IP(outer[12:16]).String())
+		var sum uint32
+		for i := 0; i < 20; i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(outer[i:]))
+		}
+		for sum > 0xffff {
+			sum = sum&0xffff + sum>>16
+		}
+		equals(t, uint32(0xffff), sum)
+		port := 6080
+		if back.IP().String() == backIPs[1] {
+			port = 6081
+		}
+		equals(t, uint16(port), binary.BigEndian.Uint16(outer[22:]))
+		return back.Name()
+	}
+	seen := make(map[string]bool)
+	for sport := uint16(40000); sport < 40016; sport++ {
+		seen[check(sport)] = true
+	}
+	equals(t, 2, len(seen))
+
+	// pausing a backend takes it out of the kernel's table too
+	ok(t, manager.PauseBackend("xdp/x"+backIPs[0]))
+	for sport := uint16(40000); sport < 40016; sport++ {
+		equals(t, "x"+backIPs[1], check(sport))
+	}
+}